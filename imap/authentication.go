@@ -0,0 +1,272 @@
+package imap
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+)
+
+// Header fields holding the authentication verdicts of receiving servers
+const (
+	authResultsHeader    = "Authentication-Results"
+	arcAuthResultsHeader = "ARC-Authentication-Results"
+)
+
+// authResult is a method result of an Authentication-Results or
+// ARC-Authentication-Results header field, see RFC 8601 and RFC 8617.
+type authResult struct {
+	Header string
+	// Index is the position of the field among the authentication fields of
+	// the message, from 0 for the topmost, i.e. most recently added
+	Index int
+	// Instance is the i= tag of ARC-Authentication-Results fields
+	Instance   *int
+	AuthservID string
+	Method     string
+	Result     string
+	Reason     string
+	// Properties are keyed by ptype.property, e.g. header.from
+	Properties map[string]string
+}
+
+// authResults returns the method results of the authentication fields of a
+// message, in order from the topmost field.
+func authResults(fields []headerField) []authResult {
+	var results []authResult
+	index := 0
+	for _, f := range fields {
+		var header string
+		switch {
+		case strings.EqualFold(f.Name, authResultsHeader):
+			header = authResultsHeader
+		case strings.EqualFold(f.Name, arcAuthResultsHeader):
+			header = arcAuthResultsHeader
+		default:
+			continue
+		}
+		results = append(results, parseAuthResults(header, index, f.Value)...)
+		index++
+	}
+	return results
+}
+
+// parseAuthResults parses the value of an authentication field:
+//
+//	Authentication-Results: mx.example.com; spf=pass smtp.mailfrom=example.net
+//	ARC-Authentication-Results: i=1; mx.example.com; dkim=pass header.d=example.net
+//
+// Malformed method results are skipped, rather than failing the message.
+func parseAuthResults(header string, index int, value string) []authResult {
+	segments := splitAuthResults(stripComments(value), func(c byte) bool { return c == ';' })
+	var instance *int
+	if header == arcAuthResultsHeader && len(segments) > 0 {
+		if tag, v, ok := strings.Cut(segments[0], "="); ok && strings.TrimSpace(strings.ToLower(tag)) == "i" {
+			if i, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+				instance = &i
+			}
+			segments = segments[1:]
+		}
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+	// The authserv-id may be followed by a version
+	authservID := ""
+	if id := splitAuthResults(segments[0], isSpace); len(id) > 0 {
+		authservID = unquote(id[0])
+	}
+
+	var results []authResult
+	for _, segment := range segments[1:] {
+		pairs := authResultPairs(segment)
+		if len(pairs) == 0 {
+			// e.g. "none", when no methods were applied
+			continue
+		}
+		method, _, _ := strings.Cut(pairs[0][0], "/")
+		r := authResult{
+			Header:     header,
+			Index:      index,
+			Instance:   instance,
+			AuthservID: authservID,
+			Method:     method,
+			Result:     strings.ToLower(pairs[0][1]),
+			Properties: map[string]string{},
+		}
+		for _, pair := range pairs[1:] {
+			if pair[0] == "reason" {
+				r.Reason = pair[1]
+			} else if _, ok := r.Properties[pair[0]]; !ok && strings.Contains(pair[0], ".") {
+				r.Properties[pair[0]] = pair[1]
+			}
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// authResultPairs returns the key=value pairs of a method result, with the
+// keys in lower case. Whitespace is allowed either side of the "=".
+func authResultPairs(segment string) [][2]string {
+	fields := splitAuthResults(segment, isSpace)
+	var pairs [][2]string
+	for i := 0; i < len(fields); i++ {
+		key, value, ok := strings.Cut(fields[i], "=")
+		if !ok {
+			if i+1 >= len(fields) || !strings.HasPrefix(fields[i+1], "=") {
+				continue
+			}
+			i++
+			value = fields[i][1:]
+		}
+		if value == "" && i+1 < len(fields) {
+			i++
+			value = fields[i]
+		}
+		if key == "" {
+			continue
+		}
+		pairs = append(pairs, [2]string{strings.ToLower(key), unquote(value)})
+	}
+	return pairs
+}
+
+// stripComments replaces the comments of a header value with a space. They
+// are in parentheses, and can be nested.
+func stripComments(s string) string {
+	var b strings.Builder
+	depth := 0
+	quoted, escaped := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && (quoted || depth > 0):
+			escaped = true
+		case c == '"' && depth == 0:
+			quoted = !quoted
+		case c == '(' && !quoted:
+			depth++
+			continue
+		case c == ')' && !quoted && depth > 0:
+			if depth--; depth == 0 {
+				b.WriteByte(' ')
+			}
+			continue
+		}
+		if depth == 0 {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// splitAuthResults splits s at the separators outside quoted strings,
+// dropping empty parts.
+func splitAuthResults(s string, isSep func(byte) bool) []string {
+	var parts []string
+	start := 0
+	quoted, escaped := false, false
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) {
+			c := s[i]
+			switch {
+			case escaped:
+				escaped = false
+				continue
+			case c == '\\' && quoted:
+				escaped = true
+				continue
+			case c == '"':
+				quoted = !quoted
+				continue
+			case quoted || !isSep(c):
+				continue
+			}
+		}
+		if part := strings.TrimSpace(s[start:i]); part != "" {
+			parts = append(parts, part)
+		}
+		start = i + 1
+	}
+	return parts
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// unquote returns the content of a quoted string, or s if it isn't one.
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	var b strings.Builder
+	escaped := false
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// authSummary holds the verdicts of a message's receiving server, for the
+// spf_result, dkim_result, dmarc_result and arc_result columns.
+type authSummary struct {
+	SPF   string
+	DKIM  string
+	DMARC string
+	ARC   string
+}
+
+// summarizeAuthResults returns the verdicts of the topmost
+// Authentication-Results field, or of the fields added by the configured
+// authserv_id. Fields further down may have been added by the sender, so
+// can't be trusted. A message with several DKIM signatures passes if any of
+// them does.
+func summarizeAuthResults(d *plugin.QueryData, results []authResult) authSummary {
+	trusted := ""
+	if imapConfig := GetConfig(d.Connection); imapConfig.AuthservID != nil {
+		trusted = *imapConfig.AuthservID
+	}
+	var summary authSummary
+	index := -1
+	for _, r := range results {
+		if r.Header != authResultsHeader {
+			continue
+		}
+		if trusted != "" {
+			if !strings.EqualFold(r.AuthservID, trusted) {
+				continue
+			}
+		} else if index >= 0 && r.Index != index {
+			break
+		}
+		index = r.Index
+		switch r.Method {
+		case "spf":
+			if summary.SPF == "" {
+				summary.SPF = r.Result
+			}
+		case "dkim":
+			if summary.DKIM == "" || r.Result == "pass" {
+				summary.DKIM = r.Result
+			}
+		case "dmarc":
+			if summary.DMARC == "" {
+				summary.DMARC = r.Result
+			}
+		case "arc":
+			if summary.ARC == "" {
+				summary.ARC = r.Result
+			}
+		}
+	}
+	return summary
+}
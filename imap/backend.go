@@ -0,0 +1,654 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-message/textproto"
+	"github.com/jhillyerd/enmime"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+)
+
+// Local backends hold mail outside an IMAP server, or behind another
+// protocol such as JMAP. They are served to the tables through an in-process
+// IMAP server, so every table, search and fetch works the same way as for a
+// remote IMAP server.
+const (
+	backendIMAP    = "imap"
+	backendMaildir = "maildir"
+	backendMbox    = "mbox"
+	backendJMAP    = "jmap"
+)
+
+var errReadOnly = errors.New("local mailboxes are read-only")
+
+// localStore is mail held outside an IMAP server, e.g. a Maildir tree.
+type localStore interface {
+	folders() ([]localFolder, error)
+}
+
+// localFolder is a folder of a localStore, served as a mailbox.
+type localFolder interface {
+	info() *imap.MailboxInfo
+	// messages returns the messages in UID order, and the UIDVALIDITY of the
+	// folder
+	messages() ([]*localMessage, uint32, error)
+}
+
+// localMessage is a message of a localFolder. The message itself is only
+// read when its headers or body are needed.
+type localMessage struct {
+	Uid   uint32
+	Flags []string
+	Date  time.Time
+	Size  uint32
+	// Extension fetch items, e.g. X-GM-LABELS
+	Items map[imap.FetchItem]interface{}
+
+	open func() (io.ReadCloser, error)
+}
+
+// orderedUidValidity returns the UIDVALIDITY of a folder whose UIDs are
+// assigned in the order of its messages, rather than kept by a server. It is
+// a hash of the keys of the messages numbered, in UID order, so it changes
+// whenever messages are renumbered, e.g. when a message with an earlier date
+// is added or one before the last is removed. As the UIDs assigned aren't
+// stored, it also changes when messages are appended.
+func orderedUidValidity(seed uint32, keys []string) uint32 {
+	h := fnv.New32a()
+	_ = binary.Write(h, binary.BigEndian, seed)
+	for _, key := range keys {
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+	}
+	// UIDVALIDITY is never zero
+	if v := h.Sum32(); v != 0 {
+		return v
+	}
+	return 1
+}
+
+// backendName returns the configured backend, defaulting to imap.
+func backendName(imapConfig imapConfig) string {
+	if imapConfig.Backend == nil || *imapConfig.Backend == "" {
+		return backendIMAP
+	}
+	return strings.ToLower(*imapConfig.Backend)
+}
+
+// newLocalBackend returns the configured local backend, or nil if the
+// connection is to an IMAP server.
+func newLocalBackend(d *plugin.QueryData) (backend.Backend, error) {
+	imapConfig := GetConfig(d.Connection)
+	name := backendName(imapConfig)
+	switch name {
+	case backendIMAP:
+		return nil, nil
+	case backendJMAP:
+		loc, err := searchLocation(d)
+		if err != nil {
+			return nil, err
+		}
+		return newJMAPBackend(imapConfig, loc)
+	}
+
+	if imapConfig.Path == nil || *imapConfig.Path == "" {
+		return nil, fmt.Errorf("path must be configured for the %s backend", name)
+	}
+	path, err := expandHome(*imapConfig.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case backendMaildir:
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("cannot read maildir path: %w", err)
+		}
+		return &localBackend{store: &maildirStore{root: path}}, nil
+	case backendMbox:
+		format := mboxrd
+		if imapConfig.MboxFormat != nil && *imapConfig.MboxFormat != "" {
+			format = strings.ToLower(*imapConfig.MboxFormat)
+		}
+		switch format {
+		case mboxo, mboxrd, mboxcl, mboxcl2:
+		default:
+			return nil, fmt.Errorf("mbox_format must be one of %s, %s, %s or %s", mboxo, mboxrd, mboxcl, mboxcl2)
+		}
+		// Google Takeout labels are served as Gmail extension fetch items, but
+		// X-GM-EXT-1 isn't advertised as X-GM-RAW searches aren't supported
+		return &localBackend{store: &mboxStore{pattern: path, format: format}}, nil
+	}
+	return nil, fmt.Errorf("backend must be one of %s, %s, %s, %s or %s", backendIMAP, backendMaildir, backendMbox, backendJMAP, backendReplay)
+}
+
+// connectLocal starts an in-process IMAP server for the backend, and returns
+// a client logged in to it.
+func connectLocal(ctx context.Context, d *plugin.QueryData, be backend.Backend) (*client.Client, error) {
+	s := server.New(be)
+	// The connection never leaves the process
+	s.AllowInsecureAuth = true
+	// Errors reach the client, and the server complains when it closes
+	s.ErrorLog = log.New(io.Discard, "", 0)
+
+	clientConn, serverConn := net.Pipe()
+	l := newPipeListener(serverConn)
+	go func() {
+		_ = s.Serve(l)
+	}()
+
+	c, err := client.New(clientConn)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	_, login := hostAndLogin(d)
+	if err := c.Login(login, ""); err != nil {
+		plugin.Logger(ctx).Error("connection_error", "backend", backendName(GetConfig(d.Connection)), "err", err)
+		c.Terminate()
+		return nil, err
+	}
+	return c, nil
+}
+
+// pipeListener is a net.Listener that accepts a single in-process
+// connection, and closes once that connection is closed.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener(conn net.Conn) *pipeListener {
+	l := &pipeListener{
+		conns:  make(chan net.Conn, 1),
+		closed: make(chan struct{}),
+	}
+	l.conns <- &pipeConn{Conn: conn, listener: l}
+	return l
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+type pipeConn struct {
+	net.Conn
+	listener *pipeListener
+}
+
+func (c *pipeConn) Close() error {
+	c.listener.Close()
+	return c.Conn.Close()
+}
+
+// localBackend implements the go-imap server backend for a localStore.
+type localBackend struct {
+	store localStore
+}
+
+func (be *localBackend) Login(_ *imap.ConnInfo, username, _ string) (backend.User, error) {
+	return &localUser{store: be.store, username: username}, nil
+}
+
+type localUser struct {
+	store    localStore
+	username string
+}
+
+func (u *localUser) Username() string {
+	return u.username
+}
+
+func (u *localUser) ListMailboxes(_ bool) ([]backend.Mailbox, error) {
+	folders, err := u.store.folders()
+	if err != nil {
+		return nil, err
+	}
+	mailboxes := make([]backend.Mailbox, len(folders))
+	for i, f := range folders {
+		mailboxes[i] = &localMailbox{folder: f}
+	}
+	return mailboxes, nil
+}
+
+func (u *localUser) GetMailbox(name string) (backend.Mailbox, error) {
+	folders, err := u.store.folders()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range folders {
+		info := f.info()
+		if info.Name == name || (strings.EqualFold(name, imap.InboxName) && info.Name == imap.InboxName) {
+			return &localMailbox{folder: f}, nil
+		}
+	}
+	return nil, backend.ErrNoSuchMailbox
+}
+
+func (u *localUser) CreateMailbox(string) error         { return errReadOnly }
+func (u *localUser) DeleteMailbox(string) error         { return errReadOnly }
+func (u *localUser) RenameMailbox(string, string) error { return errReadOnly }
+func (u *localUser) Logout() error                      { return nil }
+
+// localMailbox implements the go-imap server mailbox for a localFolder. The
+// folder is read once, when the mailbox is first used.
+type localMailbox struct {
+	folder localFolder
+
+	once        sync.Once
+	list        []*localMessage
+	uidValidity uint32
+	err         error
+}
+
+func (mbox *localMailbox) load() ([]*localMessage, error) {
+	mbox.once.Do(func() {
+		mbox.list, mbox.uidValidity, mbox.err = mbox.folder.messages()
+	})
+	return mbox.list, mbox.err
+}
+
+func (mbox *localMailbox) Name() string {
+	return mbox.folder.info().Name
+}
+
+func (mbox *localMailbox) Info() (*imap.MailboxInfo, error) {
+	return mbox.folder.info(), nil
+}
+
+func (mbox *localMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	list, err := mbox.load()
+	if err != nil {
+		return nil, err
+	}
+
+	status := imap.NewMailboxStatus(mbox.Name(), items)
+	status.ReadOnly = true
+	status.PermanentFlags = []string{}
+
+	flags := map[string]bool{}
+	var recent, unseen, uidNext uint32 = 0, 0, 1
+	for i, m := range list {
+		for _, f := range m.Flags {
+			flags[f] = true
+		}
+		if hasLocalFlag(m, imap.RecentFlag) {
+			recent++
+		}
+		if !hasLocalFlag(m, imap.SeenFlag) {
+			unseen++
+			if status.UnseenSeqNum == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+		}
+		uidNext = m.Uid + 1
+	}
+	for f := range flags {
+		if f != imap.RecentFlag {
+			status.Flags = append(status.Flags, f)
+		}
+	}
+
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(list))
+		case imap.StatusRecent:
+			status.Recent = recent
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		case imap.StatusUidNext:
+			status.UidNext = uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = mbox.uidValidity
+		}
+	}
+	return status, nil
+}
+
+func (mbox *localMailbox) SetSubscribed(bool) error {
+	return errReadOnly
+}
+
+func (mbox *localMailbox) Check() error {
+	return nil
+}
+
+func (mbox *localMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	list, err := mbox.load()
+	if err != nil {
+		return err
+	}
+	for i, m := range list {
+		seqNum := uint32(i + 1)
+		id := seqNum
+		if uid {
+			id = m.Uid
+		}
+		if !seqSet.Contains(id) {
+			continue
+		}
+		fetched, err := m.fetch(seqNum, items)
+		if err != nil {
+			return err
+		}
+		ch <- fetched
+	}
+	return nil
+}
+
+func (mbox *localMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	list, err := mbox.load()
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	for i, m := range list {
+		seqNum := uint32(i + 1)
+		lm := &localMatch{message: m, seqNum: seqNum}
+		ok, err := lm.match(criteria)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if uid {
+			ids = append(ids, m.Uid)
+		} else {
+			ids = append(ids, seqNum)
+		}
+	}
+	return ids, nil
+}
+
+func (mbox *localMailbox) CreateMessage([]string, time.Time, imap.Literal) error {
+	return errReadOnly
+}
+
+func (mbox *localMailbox) UpdateMessagesFlags(bool, *imap.SeqSet, imap.FlagsOp, []string) error {
+	return errReadOnly
+}
+
+func (mbox *localMailbox) CopyMessages(bool, *imap.SeqSet, string) error {
+	return errReadOnly
+}
+
+func (mbox *localMailbox) Expunge() error {
+	return errReadOnly
+}
+
+func hasLocalFlag(m *localMessage, flag string) bool {
+	for _, f := range m.Flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *localMessage) read() ([]byte, error) {
+	r, err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// fetch returns the requested items of the message, reading it at most once.
+func (m *localMessage) fetch(seqNum uint32, items []imap.FetchItem) (*imap.Message, error) {
+	fetched := imap.NewMessage(seqNum, items)
+
+	var raw []byte
+	headerAndBody := func() (textproto.Header, *bufio.Reader, error) {
+		if raw == nil {
+			var err error
+			if raw, err = m.read(); err != nil {
+				return textproto.Header{}, nil, err
+			}
+		}
+		body := bufio.NewReader(bytes.NewReader(raw))
+		hdr, err := textproto.ReadHeader(body)
+		return hdr, body, err
+	}
+
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			hdr, _, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			hdr, body, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = m.Flags
+		case imap.FetchInternalDate:
+			fetched.InternalDate = m.Date
+		case imap.FetchRFC822Size:
+			fetched.Size = m.Size
+		case imap.FetchUid:
+			fetched.Uid = m.Uid
+		default:
+			if v, ok := m.Items[item]; ok {
+				fetched.Items[item] = v
+				continue
+			}
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				continue
+			}
+			hdr, body, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			l, _ := backendutil.FetchBodySection(hdr, body, section)
+			fetched.Body[section] = l
+		}
+	}
+	return fetched, nil
+}
+
+// localMatch matches a message against search criteria with the semantics
+// of RFC 3501 section 6.4.4. The message is only read, and parsed with
+// enmime, if the criteria refer to its headers or body.
+type localMatch struct {
+	message *localMessage
+	seqNum  uint32
+
+	env *enmime.Envelope
+	err error
+}
+
+func (lm *localMatch) envelope() (*enmime.Envelope, error) {
+	if lm.env == nil && lm.err == nil {
+		var r io.ReadCloser
+		if r, lm.err = lm.message.open(); lm.err == nil {
+			lm.env, lm.err = enmime.ReadEnvelope(r)
+			r.Close()
+		}
+	}
+	return lm.env, lm.err
+}
+
+func (lm *localMatch) match(c *imap.SearchCriteria) (bool, error) {
+	m := lm.message
+
+	if c.SeqNum != nil && !c.SeqNum.Contains(lm.seqNum) {
+		return false, nil
+	}
+	if c.Uid != nil && !c.Uid.Contains(m.Uid) {
+		return false, nil
+	}
+	for _, f := range c.WithFlags {
+		if !hasLocalFlag(m, f) {
+			return false, nil
+		}
+	}
+	for _, f := range c.WithoutFlags {
+		if hasLocalFlag(m, f) {
+			return false, nil
+		}
+	}
+	if !matchDay(m.Date, c.Since, c.Before) {
+		return false, nil
+	}
+	if c.Larger > 0 && m.Size <= c.Larger {
+		return false, nil
+	}
+	if c.Smaller > 0 && m.Size >= c.Smaller {
+		return false, nil
+	}
+
+	if !c.SentSince.IsZero() || !c.SentBefore.IsZero() {
+		env, err := lm.envelope()
+		if err != nil {
+			return false, err
+		}
+		// Messages without a valid Date header never match
+		sent, err := mail.ParseDate(env.GetHeader("Date"))
+		if err != nil || !matchDay(sent, c.SentSince, c.SentBefore) {
+			return false, nil
+		}
+	}
+	for key, values := range c.Header {
+		env, err := lm.envelope()
+		if err != nil {
+			return false, err
+		}
+		for _, want := range values {
+			if !matchHeader(env, key, want) {
+				return false, nil
+			}
+		}
+	}
+	for _, want := range c.Body {
+		env, err := lm.envelope()
+		if err != nil {
+			return false, err
+		}
+		if !containsFold(env.Text, want) && !containsFold(env.HTML, want) {
+			return false, nil
+		}
+	}
+	for _, want := range c.Text {
+		env, err := lm.envelope()
+		if err != nil {
+			return false, err
+		}
+		if !containsFold(env.Text, want) && !containsFold(env.HTML, want) && !matchAnyHeader(env, want) {
+			return false, nil
+		}
+	}
+
+	for _, not := range c.Not {
+		ok, err := lm.match(not)
+		if err != nil || ok {
+			return false, err
+		}
+	}
+	for _, or := range c.Or {
+		ok, err := lm.match(or[0])
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			if ok, err = lm.match(or[1]); err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// matchDay compares the calendar day of t, ignoring time and time zone,
+// with the SINCE (inclusive) and BEFORE (exclusive) dates of a search.
+func matchDay(t, since, before time.Time) bool {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if !since.IsZero() && day.Before(since) {
+		return false
+	}
+	if !before.IsZero() && !day.Before(before) {
+		return false
+	}
+	return true
+}
+
+// matchHeader reports whether the header is present and, if want is not
+// empty, contains it.
+func matchHeader(env *enmime.Envelope, key, want string) bool {
+	values := env.GetHeaderValues(key)
+	if want == "" {
+		return len(values) > 0
+	}
+	for _, v := range values {
+		if containsFold(v, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAnyHeader(env *enmime.Envelope, want string) bool {
+	for _, key := range env.GetHeaderKeys() {
+		if matchHeader(env, key, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
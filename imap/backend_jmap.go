@@ -0,0 +1,895 @@
+package imap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// JMAP capabilities, see RFC 8620 and RFC 8621.
+const (
+	jmapCore = "urn:ietf:params:jmap:core"
+	jmapMail = "urn:ietf:params:jmap:mail"
+)
+
+// jmapDefaultMaxObjects is used when the server does not give maxObjectsInGet.
+const jmapDefaultMaxObjects = 500
+
+// jmapTimeout limits each request to the JMAP server.
+const jmapTimeout = 60 * time.Second
+
+// jmapKeywords maps the JMAP keywords with an IMAP system flag equivalent.
+// JMAP has no \Recent or \Deleted.
+var jmapKeywords = map[string]string{
+	"$seen":     imap.SeenFlag,
+	"$flagged":  imap.FlaggedFlag,
+	"$answered": imap.AnsweredFlag,
+	"$draft":    imap.DraftFlag,
+}
+
+// jmapRoleAttributes maps mailbox roles to their special-use attribute.
+var jmapRoleAttributes = map[string]string{
+	"all":       imap.AllAttr,
+	"archive":   imap.ArchiveAttr,
+	"drafts":    imap.DraftsAttr,
+	"flagged":   imap.FlaggedAttr,
+	"important": imap.ImportantAttr,
+	"junk":      imap.JunkAttr,
+	"sent":      imap.SentAttr,
+	"trash":     imap.TrashAttr,
+}
+
+// jmapEmailProperties are the Email properties needed for everything but
+// the message body, which is downloaded as a blob.
+var jmapEmailProperties = []string{
+	"id", "blobId", "keywords", "receivedAt", "size", "sentAt", "subject",
+	"from", "sender", "replyTo", "to", "cc", "bcc", "messageId", "inReplyTo",
+	"bodyStructure",
+}
+
+const jmapDelimiter = "/"
+
+// jmapBackend serves a JMAP account (RFC 8621), such as Fastmail or Cyrus.
+// Mailboxes come from Mailbox/get, and searches are translated to Email/query
+// filters so they run on the server.
+type jmapBackend struct {
+	sessionURL string
+	token      string
+	// loc is the zone of the days in SINCE and BEFORE searches
+	loc *time.Location
+}
+
+func newJMAPBackend(imapConfig imapConfig, loc *time.Location) (backend.Backend, error) {
+	token := os.Getenv("JMAP_TOKEN")
+	if imapConfig.JMAPToken != nil {
+		token = *imapConfig.JMAPToken
+	}
+	if imapConfig.JMAPSessionURL == nil || *imapConfig.JMAPSessionURL == "" {
+		return nil, errors.New("jmap_session_url must be configured for the jmap backend")
+	}
+	if token == "" {
+		return nil, errors.New("jmap_token must be configured for the jmap backend")
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	return &jmapBackend{sessionURL: *imapConfig.JMAPSessionURL, token: token, loc: loc}, nil
+}
+
+func (be *jmapBackend) Login(_ *imap.ConnInfo, username, _ string) (backend.User, error) {
+	c := &jmapClient{http: &http.Client{Timeout: jmapTimeout}, token: be.token}
+	if err := c.connect(be.sessionURL); err != nil {
+		return nil, err
+	}
+	return &jmapUser{client: c, username: username, loc: be.loc}, nil
+}
+
+// jmapClient makes requests to the JMAP API of an account.
+type jmapClient struct {
+	http  *http.Client
+	token string
+
+	apiURL      string
+	downloadURL string
+	accountID   string
+	maxObjects  int
+}
+
+type jmapSession struct {
+	APIURL          string                     `json:"apiUrl"`
+	DownloadURL     string                     `json:"downloadUrl"`
+	PrimaryAccounts map[string]string          `json:"primaryAccounts"`
+	Capabilities    map[string]json.RawMessage `json:"capabilities"`
+}
+
+// connect fetches the session resource, which gives the API and download
+// URLs and the mail account to use.
+func (c *jmapClient) connect(sessionURL string) error {
+	var session jmapSession
+	if err := c.do(http.MethodGet, sessionURL, nil, &session); err != nil {
+		return fmt.Errorf("cannot get JMAP session: %w", err)
+	}
+	c.apiURL = session.APIURL
+	c.downloadURL = session.DownloadURL
+	c.accountID = session.PrimaryAccounts[jmapMail]
+	if c.apiURL == "" || c.accountID == "" {
+		return errors.New("JMAP session has no mail account")
+	}
+
+	c.maxObjects = jmapDefaultMaxObjects
+	var core struct {
+		MaxObjectsInGet int `json:"maxObjectsInGet"`
+	}
+	if err := json.Unmarshal(session.Capabilities[jmapCore], &core); err == nil && core.MaxObjectsInGet > 0 && core.MaxObjectsInGet < c.maxObjects {
+		c.maxObjects = core.MaxObjectsInGet
+	}
+	return nil
+}
+
+func (c *jmapClient) do(method, u string, body []byte, result interface{}) error {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", method, u, resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// call makes a single method call, see RFC 8620 section 3.3.
+func (c *jmapClient) call(name string, args map[string]interface{}, result interface{}) error {
+	args["accountId"] = c.accountID
+	body, err := json.Marshal(map[string]interface{}{
+		"using":       []string{jmapCore, jmapMail},
+		"methodCalls": []interface{}{[]interface{}{name, args, "0"}},
+	})
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		MethodResponses [][]json.RawMessage `json:"methodResponses"`
+	}
+	if err := c.do(http.MethodPost, c.apiURL, body, &resp); err != nil {
+		return err
+	}
+	if len(resp.MethodResponses) == 0 || len(resp.MethodResponses[0]) < 2 {
+		return fmt.Errorf("JMAP %s: no response", name)
+	}
+
+	var responseName string
+	if err := json.Unmarshal(resp.MethodResponses[0][0], &responseName); err != nil {
+		return err
+	}
+	if responseName == "error" {
+		var methodErr struct {
+			Type        string `json:"type"`
+			Description string `json:"description"`
+		}
+		_ = json.Unmarshal(resp.MethodResponses[0][1], &methodErr)
+		return fmt.Errorf("JMAP %s: %s %s", name, methodErr.Type, methodErr.Description)
+	}
+	return json.Unmarshal(resp.MethodResponses[0][1], result)
+}
+
+// download fetches the raw message, see RFC 8620 section 6.2.
+func (c *jmapClient) download(blobID string) ([]byte, error) {
+	u := strings.NewReplacer(
+		"{accountId}", url.PathEscape(c.accountID),
+		"{blobId}", url.PathEscape(blobID),
+		"{name}", "message.eml",
+		"{type}", url.QueryEscape("message/rfc822"),
+	).Replace(c.downloadURL)
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+type jmapMailbox struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	ParentID     string `json:"parentId"`
+	Role         string `json:"role"`
+	TotalEmails  uint32 `json:"totalEmails"`
+	UnreadEmails uint32 `json:"unreadEmails"`
+}
+
+type jmapAddress struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type jmapBodyPart struct {
+	Type        string          `json:"type"`
+	Charset     string          `json:"charset"`
+	Name        string          `json:"name"`
+	Disposition string          `json:"disposition"`
+	Cid         string          `json:"cid"`
+	Size        uint32          `json:"size"`
+	SubParts    []*jmapBodyPart `json:"subParts"`
+}
+
+type jmapEmail struct {
+	ID            string          `json:"id"`
+	BlobID        string          `json:"blobId"`
+	Keywords      map[string]bool `json:"keywords"`
+	ReceivedAt    time.Time       `json:"receivedAt"`
+	Size          uint32          `json:"size"`
+	SentAt        *time.Time      `json:"sentAt"`
+	Subject       string          `json:"subject"`
+	From          []jmapAddress   `json:"from"`
+	Sender        []jmapAddress   `json:"sender"`
+	ReplyTo       []jmapAddress   `json:"replyTo"`
+	To            []jmapAddress   `json:"to"`
+	Cc            []jmapAddress   `json:"cc"`
+	Bcc           []jmapAddress   `json:"bcc"`
+	MessageID     []string        `json:"messageId"`
+	InReplyTo     []string        `json:"inReplyTo"`
+	BodyStructure *jmapBodyPart   `json:"bodyStructure"`
+}
+
+type jmapUser struct {
+	client   *jmapClient
+	username string
+	loc      *time.Location
+}
+
+func (u *jmapUser) Username() string {
+	return u.username
+}
+
+// mailboxes lists the mailboxes, naming each by its path from the top level
+// mailbox, and the one with the inbox role as INBOX.
+func (u *jmapUser) mailboxes() ([]*jmapMailboxBackend, error) {
+	var result struct {
+		List []*jmapMailbox `json:"list"`
+	}
+	if err := u.client.call("Mailbox/get", map[string]interface{}{"ids": nil}, &result); err != nil {
+		return nil, err
+	}
+
+	byID := map[string]*jmapMailbox{}
+	hasChildren := map[string]bool{}
+	for _, m := range result.List {
+		byID[m.ID] = m
+		hasChildren[m.ParentID] = true
+	}
+	var mailboxes []*jmapMailboxBackend
+	for _, m := range result.List {
+		name := m.Name
+		if m.Role == "inbox" {
+			name = imap.InboxName
+		} else {
+			for p := byID[m.ParentID]; p != nil; p = byID[p.ParentID] {
+				name = p.Name + jmapDelimiter + name
+			}
+		}
+		attrs := []string{imap.HasNoChildrenAttr}
+		if hasChildren[m.ID] {
+			attrs[0] = imap.HasChildrenAttr
+		}
+		if attr, ok := jmapRoleAttributes[m.Role]; ok {
+			attrs = append(attrs, attr)
+		}
+		mailboxes = append(mailboxes, &jmapMailboxBackend{
+			client:  u.client,
+			mailbox: m,
+			info:    &imap.MailboxInfo{Attributes: attrs, Delimiter: jmapDelimiter, Name: name},
+			loc:     u.loc,
+		})
+	}
+	return mailboxes, nil
+}
+
+func (u *jmapUser) ListMailboxes(_ bool) ([]backend.Mailbox, error) {
+	list, err := u.mailboxes()
+	if err != nil {
+		return nil, err
+	}
+	mailboxes := make([]backend.Mailbox, len(list))
+	for i, m := range list {
+		mailboxes[i] = m
+	}
+	return mailboxes, nil
+}
+
+func (u *jmapUser) GetMailbox(name string) (backend.Mailbox, error) {
+	list, err := u.mailboxes()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range list {
+		if m.info.Name == name || (strings.EqualFold(name, imap.InboxName) && m.info.Name == imap.InboxName) {
+			return m, nil
+		}
+	}
+	return nil, backend.ErrNoSuchMailbox
+}
+
+func (u *jmapUser) CreateMailbox(string) error         { return errReadOnly }
+func (u *jmapUser) DeleteMailbox(string) error         { return errReadOnly }
+func (u *jmapUser) RenameMailbox(string, string) error { return errReadOnly }
+func (u *jmapUser) Logout() error                      { return nil }
+
+// jmapMailboxBackend implements the go-imap server mailbox for a JMAP
+// mailbox. JMAP identifies emails by string IDs, so UIDs are numbered in
+// order of receivedAt, and are only stable while emails are not removed.
+type jmapMailboxBackend struct {
+	client  *jmapClient
+	mailbox *jmapMailbox
+	info    *imap.MailboxInfo
+	loc     *time.Location
+
+	once sync.Once
+	ids  []string
+	uids map[string]uint32
+	err  error
+}
+
+// load lists the IDs of every email in the mailbox, to number the UIDs.
+func (mbox *jmapMailboxBackend) load() ([]string, error) {
+	mbox.once.Do(func() {
+		mbox.ids, mbox.err = mbox.query(map[string]interface{}{"inMailbox": mbox.mailbox.ID})
+		mbox.uids = make(map[string]uint32, len(mbox.ids))
+		for i, id := range mbox.ids {
+			mbox.uids[id] = uint32(i + 1)
+		}
+	})
+	return mbox.ids, mbox.err
+}
+
+// query runs Email/query, reading every page of results.
+func (mbox *jmapMailboxBackend) query(filter map[string]interface{}) ([]string, error) {
+	var ids []string
+	for {
+		var result struct {
+			IDs   []string `json:"ids"`
+			Total int      `json:"total"`
+		}
+		err := mbox.client.call("Email/query", map[string]interface{}{
+			"filter":         filter,
+			"sort":           []interface{}{map[string]interface{}{"property": "receivedAt", "isAscending": true}},
+			"position":       len(ids),
+			"calculateTotal": true,
+		}, &result)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, result.IDs...)
+		if len(result.IDs) == 0 || len(ids) >= result.Total {
+			return ids, nil
+		}
+	}
+}
+
+// get runs Email/get in batches of at most maxObjectsInGet.
+func (mbox *jmapMailboxBackend) get(ids []string) ([]*jmapEmail, error) {
+	var emails []*jmapEmail
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > mbox.client.maxObjects {
+			n = mbox.client.maxObjects
+		}
+		var result struct {
+			List []*jmapEmail `json:"list"`
+		}
+		err := mbox.client.call("Email/get", map[string]interface{}{
+			"ids":        ids[:n],
+			"properties": jmapEmailProperties,
+		}, &result)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, result.List...)
+		ids = ids[n:]
+	}
+	return emails, nil
+}
+
+func (mbox *jmapMailboxBackend) Name() string {
+	return mbox.info.Name
+}
+
+func (mbox *jmapMailboxBackend) Info() (*imap.MailboxInfo, error) {
+	return mbox.info, nil
+}
+
+func (mbox *jmapMailboxBackend) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status := imap.NewMailboxStatus(mbox.Name(), items)
+	status.ReadOnly = true
+	status.Flags = []string{imap.SeenFlag, imap.FlaggedFlag, imap.AnsweredFlag, imap.DraftFlag}
+	status.PermanentFlags = []string{}
+
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = mbox.mailbox.TotalEmails
+		case imap.StatusUnseen:
+			status.Unseen = mbox.mailbox.UnreadEmails
+		case imap.StatusUidNext:
+			ids, err := mbox.load()
+			if err != nil {
+				return nil, err
+			}
+			status.UidNext = uint32(len(ids) + 1)
+		case imap.StatusUidValidity:
+			// UIDs are positions in receivedAt order, so an email removed or
+			// received out of order renumbers the rest
+			ids, err := mbox.load()
+			if err != nil {
+				return nil, err
+			}
+			status.UidValidity = orderedUidValidity(0, ids)
+		}
+	}
+	return status, nil
+}
+
+func (mbox *jmapMailboxBackend) SetSubscribed(bool) error {
+	return errReadOnly
+}
+
+func (mbox *jmapMailboxBackend) Check() error {
+	return nil
+}
+
+func (mbox *jmapMailboxBackend) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	all, err := mbox.load()
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for i, id := range all {
+		n := uint32(i + 1)
+		if seqSet.Contains(n) {
+			ids = append(ids, id)
+		}
+	}
+	emails, err := mbox.get(ids)
+	if err != nil {
+		return err
+	}
+	sort.Slice(emails, func(i, j int) bool {
+		return mbox.uids[emails[i].ID] < mbox.uids[emails[j].ID]
+	})
+
+	for _, e := range emails {
+		n := mbox.uids[e.ID]
+		if n == 0 {
+			continue
+		}
+		m := mbox.localMessage(e, n)
+		fetched, err := m.fetch(n, localItems(items))
+		if err != nil {
+			return err
+		}
+		// The envelope and body structure are built from the JMAP properties,
+		// so the message is only downloaded if its body is fetched
+		for _, item := range items {
+			switch item {
+			case imap.FetchEnvelope:
+				fetched.Items[item] = nil
+				fetched.Envelope = e.envelope()
+			case imap.FetchBody, imap.FetchBodyStructure:
+				fetched.Items[item] = nil
+				fetched.BodyStructure = e.BodyStructure.bodyStructure(item == imap.FetchBodyStructure)
+			}
+		}
+		ch <- fetched
+	}
+	return nil
+}
+
+// localItems removes the items that are built from JMAP properties.
+func localItems(items []imap.FetchItem) []imap.FetchItem {
+	var result []imap.FetchItem
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope, imap.FetchBody, imap.FetchBodyStructure:
+		default:
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// localMessage wraps the email so it can be fetched and matched like the
+// messages of local backends. The UID is also its sequence number.
+func (mbox *jmapMailboxBackend) localMessage(e *jmapEmail, uid uint32) *localMessage {
+	flags := []string{}
+	for k, set := range e.Keywords {
+		if !set {
+			continue
+		}
+		if flag, ok := jmapKeywords[strings.ToLower(k)]; ok {
+			flags = append(flags, flag)
+		} else {
+			flags = append(flags, k)
+		}
+	}
+	sort.Strings(flags)
+	return &localMessage{
+		Uid:   uid,
+		Flags: flags,
+		// matchDay compares the day in the date's zone
+		Date: e.ReceivedAt.In(mbox.loc),
+		Size: e.Size,
+		open: func() (io.ReadCloser, error) {
+			b, err := mbox.client.download(e.BlobID)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(bytes.NewReader(b)), nil
+		},
+	}
+}
+
+// SearchMessages runs the search on the server with Email/query. Any
+// criteria that JMAP cannot express are then matched here, for just the
+// emails the server returned.
+func (mbox *jmapMailboxBackend) SearchMessages(_ bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	all, err := mbox.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// Sequence numbers and UIDs are the same, the positions of the emails in
+	// receivedAt order, so they are matched against the IDs from load
+	c := *criteria
+	seqSets := []*imap.SeqSet{c.SeqNum, c.Uid}
+	c.SeqNum, c.Uid = nil, nil
+
+	pushed, rest := splitJMAPCriteria(&c)
+	ids := all
+	if conditions := jmapConditions(pushed, mbox.loc); len(conditions) > 0 {
+		filter := map[string]interface{}{
+			"operator":   "AND",
+			"conditions": append([]interface{}{map[string]interface{}{"inMailbox": mbox.mailbox.ID}}, conditions...),
+		}
+		if ids, err = mbox.query(filter); err != nil {
+			return nil, err
+		}
+	}
+	var matched []string
+	for _, id := range ids {
+		n := mbox.uids[id]
+		if n == 0 {
+			// Delivered since the mailbox was loaded
+			continue
+		}
+		if (seqSets[0] == nil || seqSets[0].Contains(n)) && (seqSets[1] == nil || seqSets[1].Contains(n)) {
+			matched = append(matched, id)
+		}
+	}
+
+	var emails []*jmapEmail
+	if rest != nil {
+		if emails, err = mbox.get(matched); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, id := range matched {
+			emails = append(emails, &jmapEmail{ID: id})
+		}
+	}
+
+	var uids []uint32
+	for _, e := range emails {
+		n := mbox.uids[e.ID]
+		if rest != nil {
+			lm := &localMatch{message: mbox.localMessage(e, n), seqNum: n}
+			ok, err := lm.match(rest)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		uids = append(uids, n)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids, nil
+}
+
+func (mbox *jmapMailboxBackend) CreateMessage([]string, time.Time, imap.Literal) error {
+	return errReadOnly
+}
+
+func (mbox *jmapMailboxBackend) UpdateMessagesFlags(bool, *imap.SeqSet, imap.FlagsOp, []string) error {
+	return errReadOnly
+}
+
+func (mbox *jmapMailboxBackend) CopyMessages(bool, *imap.SeqSet, string) error {
+	return errReadOnly
+}
+
+func (mbox *jmapMailboxBackend) Expunge() error {
+	return errReadOnly
+}
+
+// splitJMAPCriteria splits the criteria into those that can be sent to the
+// server, and the rest (any NOT or OR containing sequence numbers, UIDs or
+// sent dates) which must be matched locally, or nil if there are none.
+func splitJMAPCriteria(c *imap.SearchCriteria) (*imap.SearchCriteria, *imap.SearchCriteria) {
+	pushed := *c
+	pushed.Not, pushed.Or = nil, nil
+
+	rest := &imap.SearchCriteria{}
+	for _, not := range c.Not {
+		if jmapExpressible(not) {
+			pushed.Not = append(pushed.Not, not)
+		} else {
+			rest.Not = append(rest.Not, not)
+		}
+	}
+	for _, or := range c.Or {
+		if jmapExpressible(or[0]) && jmapExpressible(or[1]) {
+			pushed.Or = append(pushed.Or, or)
+		} else {
+			rest.Or = append(rest.Or, or)
+		}
+	}
+
+	if len(rest.Not) == 0 && len(rest.Or) == 0 {
+		rest = nil
+	}
+	return &pushed, rest
+}
+
+// jmapExpressible reports whether the criteria can be sent to the server
+// within a NOT or OR. Sent dates are only sent as a wider receivedAt range,
+// which is not exact enough to negate.
+func jmapExpressible(c *imap.SearchCriteria) bool {
+	if c.SeqNum != nil || c.Uid != nil || !c.SentSince.IsZero() || !c.SentBefore.IsZero() {
+		return false
+	}
+	for _, not := range c.Not {
+		if !jmapExpressible(not) {
+			return false
+		}
+	}
+	for _, or := range c.Or {
+		if !jmapExpressible(or[0]) || !jmapExpressible(or[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// jmapNothing is a filter that matches no emails.
+var jmapNothing = map[string]interface{}{"operator": "NOT", "conditions": []interface{}{map[string]interface{}{}}}
+
+// jmapHeaderConditions maps the headers with their own filter condition.
+var jmapHeaderConditions = map[string]string{
+	"From":    "from",
+	"To":      "to",
+	"Cc":      "cc",
+	"Bcc":     "bcc",
+	"Subject": "subject",
+}
+
+// jmapConditions translates criteria that jmapExpressible accepts to JMAP
+// filter conditions (RFC 8621 section 4.4.1), which are all ANDed together.
+func jmapConditions(c *imap.SearchCriteria, loc *time.Location) []interface{} {
+	var conditions []interface{}
+	add := func(key string, value interface{}) {
+		conditions = append(conditions, map[string]interface{}{key: value})
+	}
+
+	for _, f := range c.WithFlags {
+		if keyword, ok := jmapKeyword(f); ok {
+			add("hasKeyword", keyword)
+		} else {
+			// \Recent and \Deleted are never set
+			conditions = append(conditions, jmapNothing)
+		}
+	}
+	for _, f := range c.WithoutFlags {
+		if keyword, ok := jmapKeyword(f); ok {
+			add("notKeyword", keyword)
+		}
+	}
+	// SINCE and BEFORE compare whole days, in the zone the table computes
+	// them in
+	if !c.Since.IsZero() {
+		add("after", jmapDate(startOfDay(c.Since, loc)))
+	}
+	if !c.Before.IsZero() {
+		add("before", jmapDate(startOfDay(c.Before, loc)))
+	}
+	// JMAP can't filter on the Date header, so sent dates are sent as a
+	// receivedAt range a day wider, and the exact dates are left to Postgres
+	if !c.SentSince.IsZero() {
+		add("after", jmapDate(startOfDay(c.SentSince, loc).AddDate(0, 0, -1)))
+	}
+	if !c.SentBefore.IsZero() {
+		add("before", jmapDate(startOfDay(c.SentBefore, loc).AddDate(0, 0, 1)))
+	}
+	if c.Larger > 0 {
+		add("minSize", c.Larger+1)
+	}
+	if c.Smaller > 0 {
+		add("maxSize", c.Smaller)
+	}
+	for key, values := range c.Header {
+		for _, value := range values {
+			if condition, ok := jmapHeaderConditions[key]; ok && value != "" {
+				add(condition, value)
+			} else if value == "" {
+				add("header", []string{key})
+			} else {
+				add("header", []string{key, value})
+			}
+		}
+	}
+	for _, value := range c.Body {
+		add("body", value)
+	}
+	for _, value := range c.Text {
+		add("text", value)
+	}
+	for _, not := range c.Not {
+		conditions = append(conditions, map[string]interface{}{
+			"operator":   "NOT",
+			"conditions": []interface{}{jmapOperator("AND", jmapConditions(not, loc))},
+		})
+	}
+	for _, or := range c.Or {
+		conditions = append(conditions, map[string]interface{}{
+			"operator": "OR",
+			"conditions": []interface{}{
+				jmapOperator("AND", jmapConditions(or[0], loc)),
+				jmapOperator("AND", jmapConditions(or[1], loc)),
+			},
+		})
+	}
+	return conditions
+}
+
+// startOfDay returns the start in loc of the day of a search date, which
+// go-imap parses as UTC midnight.
+func startOfDay(date time.Time, loc *time.Location) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, loc)
+}
+
+// jmapDate formats a time as a JMAP UTCDate.
+func jmapDate(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func jmapOperator(operator string, conditions []interface{}) map[string]interface{} {
+	if len(conditions) == 0 {
+		// An empty condition matches every email
+		return map[string]interface{}{}
+	}
+	return map[string]interface{}{"operator": operator, "conditions": conditions}
+}
+
+// jmapKeyword returns the JMAP keyword for an IMAP flag. Keywords are case
+// insensitive, and always lower case in JMAP.
+func jmapKeyword(flag string) (string, bool) {
+	for keyword, f := range jmapKeywords {
+		if strings.EqualFold(f, flag) {
+			return keyword, true
+		}
+	}
+	if strings.HasPrefix(flag, "\\") {
+		return "", false
+	}
+	return strings.ToLower(flag), true
+}
+
+func (e *jmapEmail) envelope() *imap.Envelope {
+	env := &imap.Envelope{
+		Subject: e.Subject,
+		From:    jmapAddresses(e.From),
+		Sender:  jmapAddresses(e.Sender),
+		ReplyTo: jmapAddresses(e.ReplyTo),
+		To:      jmapAddresses(e.To),
+		Cc:      jmapAddresses(e.Cc),
+		Bcc:     jmapAddresses(e.Bcc),
+	}
+	if e.SentAt != nil {
+		env.Date = *e.SentAt
+	}
+	if len(e.MessageID) > 0 {
+		env.MessageId = "<" + e.MessageID[0] + ">"
+	}
+	if len(e.InReplyTo) > 0 {
+		env.InReplyTo = "<" + strings.Join(e.InReplyTo, "> <") + ">"
+	}
+	return env
+}
+
+func jmapAddresses(list []jmapAddress) []*imap.Address {
+	var addresses []*imap.Address
+	for _, a := range list {
+		address := &imap.Address{PersonalName: a.Name}
+		if parsed, err := mail.ParseAddress(a.Email); err == nil {
+			a.Email = parsed.Address
+		}
+		if i := strings.LastIndex(a.Email, "@"); i >= 0 {
+			address.MailboxName, address.HostName = a.Email[:i], a.Email[i+1:]
+		} else {
+			address.MailboxName = a.Email
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+func (p *jmapBodyPart) bodyStructure(extended bool) *imap.BodyStructure {
+	if p == nil {
+		return &imap.BodyStructure{MIMEType: "text", MIMESubType: "plain", Extended: extended}
+	}
+	bs := &imap.BodyStructure{
+		MIMEType:    "application",
+		MIMESubType: "octet-stream",
+		Size:        p.Size,
+		Extended:    extended,
+		Disposition: p.Disposition,
+	}
+	if t, sub, ok := strings.Cut(p.Type, "/"); ok {
+		bs.MIMEType, bs.MIMESubType = t, sub
+	}
+	if p.Charset != "" || p.Name != "" {
+		bs.Params = map[string]string{}
+		if p.Charset != "" {
+			bs.Params["charset"] = p.Charset
+		}
+		if p.Name != "" {
+			bs.Params["name"] = p.Name
+		}
+	}
+	if p.Name != "" && p.Disposition != "" {
+		bs.DispositionParams = map[string]string{"filename": p.Name}
+	}
+	if p.Cid != "" {
+		bs.Id = "<" + p.Cid + ">"
+	}
+	for _, sub := range p.SubParts {
+		bs.Parts = append(bs.Parts, sub.bodyStructure(extended))
+	}
+	return bs
+}
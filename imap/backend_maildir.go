@@ -0,0 +1,318 @@
+package imap
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// maildirStore is a Maildir++ tree. The root directory is INBOX, and each
+// folder is a subdirectory named with a leading dot, using dots as the
+// hierarchy delimiter, e.g. .Archive.2023 is the mailbox Archive.2023.
+type maildirStore struct {
+	root string
+}
+
+const maildirDelimiter = "."
+
+// maildirFlags maps the flag letters of the info part of a Maildir filename,
+// see https://cr.yp.to/proto/maildir.html
+var maildirFlags = map[rune]string{
+	'D': imap.DraftFlag,
+	'F': imap.FlaggedFlag,
+	'P': "$Forwarded",
+	'R': imap.AnsweredFlag,
+	'S': imap.SeenFlag,
+	'T': imap.DeletedFlag,
+}
+
+func (s *maildirStore) folders() ([]localFolder, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var folders []*maildirFolder
+	if isMaildir(s.root) {
+		folders = append(folders, &maildirFolder{name: imap.InboxName, dir: s.root})
+	}
+	for _, e := range entries {
+		if !e.IsDir() || len(e.Name()) < 2 || !strings.HasPrefix(e.Name(), ".") || e.Name() == ".." {
+			continue
+		}
+		dir := filepath.Join(s.root, e.Name())
+		if !isMaildir(dir) {
+			continue
+		}
+		// Folder names are stored in modified UTF-7, like IMAP mailbox names
+		name := e.Name()[1:]
+		if decoded, err := utf7.Encoding.NewDecoder().String(name); err == nil {
+			name = decoded
+		}
+		folders = append(folders, &maildirFolder{name: name, dir: dir})
+	}
+
+	result := make([]localFolder, len(folders))
+	for i, f := range folders {
+		for _, other := range folders {
+			if strings.HasPrefix(other.name, f.name+maildirDelimiter) {
+				f.hasChildren = true
+				break
+			}
+		}
+		result[i] = f
+	}
+	return result, nil
+}
+
+func isMaildir(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, "cur"))
+	return err == nil && info.IsDir()
+}
+
+type maildirFolder struct {
+	name        string
+	dir         string
+	hasChildren bool
+}
+
+func (f *maildirFolder) info() *imap.MailboxInfo {
+	attr := imap.HasNoChildrenAttr
+	if f.hasChildren {
+		attr = imap.HasChildrenAttr
+	}
+	return &imap.MailboxInfo{
+		Attributes: []string{attr},
+		Delimiter:  maildirDelimiter,
+		Name:       f.name,
+	}
+}
+
+// messages reads the messages in new and cur. UIDs are taken from Dovecot's
+// dovecot-uidlist where present, so they match those of the IMAP server.
+// Otherwise, or for messages delivered since Dovecot last saw the folder,
+// UIDs are assigned in order of delivery, and UIDVALIDITY is derived from
+// the messages numbered so that it changes if they are renumbered.
+func (f *maildirFolder) messages() ([]*localMessage, uint32, error) {
+	keywords := readDovecotKeywords(filepath.Join(f.dir, "dovecot-keywords"))
+	uidValidity, uidNext, uids := readDovecotUidlist(filepath.Join(f.dir, "dovecot-uidlist"))
+
+	var list, unknown []*localMessage
+	// keys of the unknown messages, to derive UIDVALIDITY from
+	keys := map[*localMessage]string{}
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(f.dir, sub))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, 0, err
+		}
+		for _, e := range entries {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				// Moved or deleted since the directory was read
+				continue
+			}
+			key, flags := parseMaildirName(e.Name(), keywords)
+			if sub == "new" {
+				flags = append(flags, imap.RecentFlag)
+			}
+			m := &localMessage{
+				Uid:   uids[key],
+				Flags: flags,
+				Date:  info.ModTime(),
+				Size:  uint32(info.Size()),
+				open:  f.opener(filepath.Join(f.dir, sub, e.Name()), key),
+			}
+			if m.Uid == 0 {
+				unknown = append(unknown, m)
+				keys[m] = key
+				continue
+			}
+			list = append(list, m)
+		}
+	}
+
+	for _, m := range list {
+		if m.Uid >= uidNext {
+			uidNext = m.Uid + 1
+		}
+	}
+	if uidNext == 0 {
+		uidNext = 1
+	}
+	sort.SliceStable(unknown, func(i, j int) bool {
+		return unknown[i].Date.Before(unknown[j].Date)
+	})
+	if len(unknown) > 0 || uidValidity == 0 {
+		// A message with an earlier date renumbers those delivered after it
+		ordered := make([]string, len(unknown))
+		for i, m := range unknown {
+			ordered[i] = keys[m]
+		}
+		uidValidity = orderedUidValidity(uidValidity^uidNext, ordered)
+	}
+	for _, m := range unknown {
+		m.Uid = uidNext
+		uidNext++
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Uid < list[j].Uid
+	})
+	return list, uidValidity, nil
+}
+
+// opener returns a function to open the message file. The file is renamed
+// when its flags change or it moves from new to cur, so if it has gone it is
+// looked for again by its unique name.
+func (f *maildirFolder) opener(path, key string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		file, err := os.Open(path)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return file, err
+		}
+		for _, sub := range []string{"cur", "new"} {
+			entries, _ := os.ReadDir(filepath.Join(f.dir, sub))
+			for _, e := range entries {
+				if k, _ := parseMaildirName(e.Name(), nil); k == key {
+					return os.Open(filepath.Join(f.dir, sub, e.Name()))
+				}
+			}
+		}
+		return nil, err
+	}
+}
+
+// parseMaildirName splits a Maildir filename into the unique name of the
+// message and its flags. Lowercase flag letters are Dovecot keywords.
+func parseMaildirName(name string, keywords []string) (string, []string) {
+	key, info := name, ""
+	// The separator is ':' but some systems use ';' or '!' instead
+	for _, sep := range []string{":2,", ";2,", "!2,"} {
+		if i := strings.LastIndex(name, sep); i >= 0 {
+			key, info = name[:i], name[i+len(sep):]
+			break
+		}
+	}
+
+	flags := []string{}
+	for _, r := range info {
+		if flag, ok := maildirFlags[r]; ok {
+			flags = append(flags, flag)
+		} else if r >= 'a' && r <= 'z' {
+			if i := int(r - 'a'); i < len(keywords) && keywords[i] != "" {
+				flags = append(flags, keywords[i])
+			}
+		}
+	}
+	return key, flags
+}
+
+// readDovecotKeywords reads the keyword names for the flag letters a-z, from
+// lines such as "0 $Label1".
+func readDovecotKeywords(path string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	keywords := make([]string, 26)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if i, err := strconv.Atoi(fields[0]); err == nil && i >= 0 && i < len(keywords) {
+			keywords[i] = fields[1]
+		}
+	}
+	return keywords
+}
+
+// readDovecotUidlist reads the UIDVALIDITY, next UID and the UIDs by unique
+// name from a dovecot-uidlist file, in either the version 1 or 3 format, see
+// https://doc.dovecot.org/admin_manual/mailbox_formats/maildir/
+func readDovecotUidlist(path string) (uint32, uint32, map[string]uint32) {
+	uids := map[string]uint32{}
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, uids
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return 0, 0, uids
+	}
+
+	// Version 1: "1 <uidvalidity> <nextuid>"
+	// Version 3: "3 V<uidvalidity> N<nextuid> G<guid>"
+	var uidValidity, uidNext uint32
+	header := strings.Fields(scanner.Text())
+	if len(header) == 0 {
+		return 0, 0, uids
+	}
+	version := header[0]
+	switch version {
+	case "1":
+		if len(header) >= 3 {
+			uidValidity = parseUint32(header[1])
+			uidNext = parseUint32(header[2])
+		}
+	case "3":
+		for _, h := range header[1:] {
+			switch h[0] {
+			case 'V':
+				uidValidity = parseUint32(h[1:])
+			case 'N':
+				uidNext = parseUint32(h[1:])
+			}
+		}
+	default:
+		return 0, 0, uids
+	}
+
+	// Version 1: "<uid> <filename>"
+	// Version 3: "<uid> [<extension> ...] :<filename>"
+	for scanner.Scan() {
+		line := scanner.Text()
+		uid, rest, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		name := strings.TrimSpace(rest)
+		if version == "3" {
+			i := strings.Index(rest, ":")
+			if i < 0 {
+				continue
+			}
+			name = rest[i+1:]
+		}
+		key, _ := parseMaildirName(name, nil)
+		if n := parseUint32(uid); n > 0 {
+			uids[key] = n
+		}
+	}
+	return uidValidity, uidNext, uids
+}
+
+func parseUint32(s string) uint32 {
+	n, _ := strconv.ParseUint(s, 10, 32)
+	return uint32(n)
+}
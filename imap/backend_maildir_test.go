@@ -0,0 +1,283 @@
+package imap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestParseMaildirName(t *testing.T) {
+	keywords := []string{"$Label1", "", "Work"}
+	tests := []struct {
+		name      string
+		wantKey   string
+		wantFlags []string
+	}{
+		{"1700000000.M1P2.host:2,FS", "1700000000.M1P2.host", []string{imap.FlaggedFlag, imap.SeenFlag}},
+		{"1700000000.M1P2.host:2,", "1700000000.M1P2.host", []string{}},
+		{"1700000000.M1P2.host", "1700000000.M1P2.host", []string{}},
+		{"1700000000.M1P2.host;2,RT", "1700000000.M1P2.host", []string{imap.AnsweredFlag, imap.DeletedFlag}},
+		{"1700000000.M1P2.host!2,DP", "1700000000.M1P2.host", []string{imap.DraftFlag, "$Forwarded"}},
+		{"1700000000.M1P2.host:2,Sabc", "1700000000.M1P2.host", []string{imap.SeenFlag, "$Label1", "Work"}},
+	}
+	for _, tt := range tests {
+		key, flags := parseMaildirName(tt.name, keywords)
+		if key != tt.wantKey || fmt.Sprint(flags) != fmt.Sprint(tt.wantFlags) {
+			t.Errorf("parseMaildirName(%q) = %q, %v, want %q, %v", tt.name, key, flags, tt.wantKey, tt.wantFlags)
+		}
+	}
+}
+
+func TestReadDovecotUidlist(t *testing.T) {
+	tests := []struct {
+		name            string
+		uidlist         string
+		wantUidValidity uint32
+		wantUidNext     uint32
+		wantUids        map[string]uint32
+	}{
+		{
+			name:            "version 1",
+			uidlist:         "1 1700000000 4\n1 one:2,S\n3 three\n",
+			wantUidValidity: 1700000000,
+			wantUidNext:     4,
+			wantUids:        map[string]uint32{"one": 1, "three": 3},
+		},
+		{
+			name:            "version 3",
+			uidlist:         "3 V1700000000 N12 G0123456789abcdef\n10 :ten:2,S\n11 W1234 S1200 :eleven\n",
+			wantUidValidity: 1700000000,
+			wantUidNext:     12,
+			wantUids:        map[string]uint32{"ten": 10, "eleven": 11},
+		},
+		{
+			name:     "unknown version",
+			uidlist:  "2 1700000000 4\n1 one\n",
+			wantUids: map[string]uint32{},
+		},
+		{
+			name:     "empty",
+			uidlist:  "",
+			wantUids: map[string]uint32{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dovecot-uidlist")
+			if err := os.WriteFile(path, []byte(tt.uidlist), 0600); err != nil {
+				t.Fatal(err)
+			}
+			uidValidity, uidNext, uids := readDovecotUidlist(path)
+			if uidValidity != tt.wantUidValidity || uidNext != tt.wantUidNext {
+				t.Errorf("got UIDVALIDITY %d and UIDNEXT %d, want %d and %d", uidValidity, uidNext, tt.wantUidValidity, tt.wantUidNext)
+			}
+			if fmt.Sprint(uids) != fmt.Sprint(tt.wantUids) {
+				t.Errorf("got UIDs %v, want %v", uids, tt.wantUids)
+			}
+		})
+	}
+}
+
+func TestMaildirMessages(t *testing.T) {
+	base := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	type file struct {
+		path    string
+		modTime time.Time
+	}
+	tests := []struct {
+		name    string
+		uidlist string
+		files   []file
+		// wantUids are the UIDs of the files, in the order of files
+		wantUids        []uint32
+		wantUidValidity uint32
+	}{
+		{
+			name: "numbered by delivery",
+			files: []file{
+				{"cur/b:2,S", base.Add(2 * time.Hour)},
+				{"new/c", base.Add(3 * time.Hour)},
+				{"cur/a:2,", base.Add(time.Hour)},
+			},
+			wantUids: []uint32{2, 3, 1},
+		},
+		{
+			name:    "from dovecot-uidlist",
+			uidlist: "3 V1700000000 N8 G0123456789abcdef\n5 :a\n7 :b\n",
+			files: []file{
+				{"cur/a:2,S", base.Add(2 * time.Hour)},
+				{"cur/b:2,", base.Add(time.Hour)},
+			},
+			wantUids:        []uint32{5, 7},
+			wantUidValidity: 1700000000,
+		},
+		{
+			name:    "delivered since dovecot-uidlist was written",
+			uidlist: "3 V1700000000 N8 G0123456789abcdef\n5 :a\n",
+			files: []file{
+				{"new/d", base.Add(4 * time.Hour)},
+				{"cur/a:2,S", base.Add(2 * time.Hour)},
+				{"new/c", base.Add(3 * time.Hour)},
+			},
+			wantUids: []uint32{9, 5, 8},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := writeTestMaildir(t, tt.uidlist)
+			for _, file := range tt.files {
+				writeTestMaildirFile(t, f, file.path, file.modTime)
+			}
+			messages, uidValidity, err := f.messages()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != len(tt.files) {
+				t.Fatalf("got %d messages, want %d", len(messages), len(tt.files))
+			}
+			byPath := map[string]uint32{}
+			for _, m := range messages {
+				byPath[readTestMessage(t, m)] = m.Uid
+			}
+			for i, file := range tt.files {
+				if uid := byPath[file.path]; uid != tt.wantUids[i] {
+					t.Errorf("%s has UID %d, want %d", file.path, uid, tt.wantUids[i])
+				}
+			}
+			if !sort.SliceIsSorted(messages, func(i, j int) bool { return messages[i].Uid < messages[j].Uid }) {
+				t.Error("messages are not in UID order")
+			}
+			if uidValidity == 0 {
+				t.Error("UIDVALIDITY is 0")
+			}
+			if tt.wantUidValidity != 0 && uidValidity != tt.wantUidValidity {
+				t.Errorf("UIDVALIDITY is %d, want %d", uidValidity, tt.wantUidValidity)
+			}
+		})
+	}
+}
+
+func TestMaildirFlags(t *testing.T) {
+	f := writeTestMaildir(t, "")
+	if err := os.WriteFile(filepath.Join(f.dir, "dovecot-keywords"), []byte("0 $Label1\n1 Work\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeTestMaildirFile(t, f, "cur/a:2,RSb", base)
+	writeTestMaildirFile(t, f, "new/b", base.Add(time.Hour))
+	messages, _, err := f.messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{imap.AnsweredFlag, imap.SeenFlag, "Work"},
+		{imap.RecentFlag},
+	}
+	for i, m := range messages {
+		if fmt.Sprint(m.Flags) != fmt.Sprint(want[i]) {
+			t.Errorf("message %d has flags %v, want %v", i, m.Flags, want[i])
+		}
+		if !m.Date.Equal(base.Add(time.Duration(i) * time.Hour)) {
+			t.Errorf("message %d has date %v", i, m.Date)
+		}
+	}
+}
+
+func TestMaildirUidValidity(t *testing.T) {
+	base := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := writeTestMaildir(t, "")
+	writeTestMaildirFile(t, f, "cur/b:2,S", base.Add(2*time.Hour))
+	writeTestMaildirFile(t, f, "cur/c:2,S", base.Add(3*time.Hour))
+	uidValidity := testMaildirUidValidity(t, f)
+	if v := testMaildirUidValidity(t, f); v != uidValidity {
+		t.Errorf("UIDVALIDITY changed from %d to %d when the folder was read again", uidValidity, v)
+	}
+
+	// A message with an earlier date renumbers those delivered after it
+	writeTestMaildirFile(t, f, "cur/a:2,S", base.Add(time.Hour))
+	renumbered := testMaildirUidValidity(t, f)
+	if renumbered == uidValidity {
+		t.Errorf("UIDVALIDITY stayed %d when messages were renumbered", uidValidity)
+	}
+
+	// As does removing a message
+	if err := os.Remove(filepath.Join(f.dir, "cur", "b:2,S")); err != nil {
+		t.Fatal(err)
+	}
+	if v := testMaildirUidValidity(t, f); v == renumbered {
+		t.Errorf("UIDVALIDITY stayed %d when a message was removed", v)
+	}
+}
+
+func TestMaildirFolders(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"cur", ".Archive/cur", ".Archive.2023/cur", ".Caf&AOk-/cur", ".NotAMaildir", "plain/cur"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	folders, err := (&maildirStore{root: root}).folders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range folders {
+		info := f.info()
+		got = append(got, fmt.Sprintf("%s %v", info.Name, info.Attributes))
+	}
+	sort.Strings(got)
+	want := []string{
+		"Archive [\\HasChildren]",
+		"Archive.2023 [\\HasNoChildren]",
+		"Café [\\HasNoChildren]",
+		"INBOX [\\HasNoChildren]",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got folders %q, want %q", got, want)
+	}
+}
+
+// writeTestMaildir creates a Maildir folder in a temporary directory, with
+// a dovecot-uidlist unless uidlist is empty.
+func writeTestMaildir(t *testing.T, uidlist string) *maildirFolder {
+	t.Helper()
+	dir := t.TempDir()
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if uidlist != "" {
+		if err := os.WriteFile(filepath.Join(dir, "dovecot-uidlist"), []byte(uidlist), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &maildirFolder{name: imap.InboxName, dir: dir}
+}
+
+// writeTestMaildirFile writes a message whose content is its path, so
+// tests can tell which file a message was read from.
+func writeTestMaildirFile(t *testing.T, f *maildirFolder, path string, modTime time.Time) {
+	t.Helper()
+	full := filepath.Join(f.dir, filepath.FromSlash(path))
+	if err := os.WriteFile(full, []byte(path), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(full, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testMaildirUidValidity(t *testing.T, f *maildirFolder) uint32 {
+	t.Helper()
+	_, uidValidity, err := f.messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uidValidity
+}
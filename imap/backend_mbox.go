@@ -0,0 +1,461 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/utf7"
+	"github.com/emersion/go-message/textproto"
+)
+
+// mbox variants, see https://www.loc.gov/preservation/digital/formats/fdd/fdd000383.shtml
+// They differ in how lines starting with "From " in the message are quoted,
+// and whether a Content-Length header gives the length of the body.
+const (
+	mboxo   = "mboxo"   // ">From " quoted, which is lost when reading
+	mboxrd  = "mboxrd"  // ">From " and ">>From " etc. quoted, reversibly
+	mboxcl  = "mboxcl"  // quoted as mboxo, with Content-Length
+	mboxcl2 = "mboxcl2" // not quoted, with Content-Length
+)
+
+// mboxMaxHeaderSize limits the header read from each message while indexing.
+const mboxMaxHeaderSize = 256 << 10
+
+// mboxStore is a set of mbox files matching a glob pattern, each served as a
+// mailbox. Mailboxes are named by their path relative to the directory of
+// the pattern, without any .mbox extension, e.g. "Takeout/Mail/*.mbox"
+// gives a mailbox "All mail Including Spam and Trash".
+type mboxStore struct {
+	pattern string
+	format  string
+}
+
+const mboxDelimiter = "/"
+
+func (s *mboxStore) folders() ([]localFolder, error) {
+	paths, err := filepath.Glob(s.pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("no mbox files match path")
+	}
+
+	base := globBase(s.pattern)
+	var folders []localFolder
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		// Skip directories, and Thunderbird's summary files
+		if err != nil || info.IsDir() || strings.HasSuffix(path, ".msf") {
+			continue
+		}
+		name, err := filepath.Rel(base, path)
+		if err != nil || name == "." {
+			name = filepath.Base(path)
+		}
+		name = filepath.ToSlash(name)
+		for _, ext := range []string{".mbox", ".mbx"} {
+			name = strings.TrimSuffix(name, ext)
+		}
+		if strings.EqualFold(name, imap.InboxName) {
+			name = imap.InboxName
+		}
+		folders = append(folders, &mboxFolder{name: name, path: path, format: s.format})
+	}
+	return folders, nil
+}
+
+// globBase returns the directory of the pattern up to the first element
+// containing a wildcard.
+func globBase(pattern string) string {
+	dir := filepath.Dir(pattern)
+	for strings.ContainsAny(dir, "*?[\\") && dir != filepath.Dir(dir) {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+type mboxFolder struct {
+	name   string
+	path   string
+	format string
+}
+
+func (f *mboxFolder) info() *imap.MailboxInfo {
+	return &imap.MailboxInfo{
+		Attributes: []string{imap.HasNoChildrenAttr},
+		Delimiter:  mboxDelimiter,
+		Name:       f.name,
+	}
+}
+
+// messages returns the messages of the file in order, numbering UIDs from 1.
+// UIDs are stable as long as messages are only appended to the file, and
+// UIDVALIDITY is derived from the positions of the messages, so that it
+// changes when a message is removed or edited and the rest are renumbered.
+func (f *mboxFolder) messages() ([]*localMessage, uint32, error) {
+	entries, err := f.index()
+	if err != nil {
+		return nil, 0, err
+	}
+	list := make([]*localMessage, len(entries))
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		e := e
+		keys[i] = strconv.FormatInt(e.offset, 10) + "+" + strconv.FormatInt(e.length, 10)
+		list[i] = &localMessage{
+			Uid:   uint32(i + 1),
+			Flags: e.flags,
+			Date:  e.date,
+			Size:  e.size,
+			Items: e.items,
+			open: func() (io.ReadCloser, error) {
+				return f.open(e)
+			},
+		}
+	}
+	return list, orderedUidValidity(0, keys), nil
+}
+
+// mboxEntry is the position and metadata of a message in an mbox file.
+type mboxEntry struct {
+	offset int64 // start of the message, after the From line
+	length int64 // length of the message in the file, still quoted
+	size   uint32
+	date   time.Time
+	flags  []string
+	items  map[imap.FetchItem]interface{}
+}
+
+type mboxIndex struct {
+	size    int64
+	modTime time.Time
+	entries []*mboxEntry
+}
+
+// mboxIndexes holds the index of each file, so large files are only read in
+// full again once they change.
+var mboxIndexes sync.Map
+
+func (f *mboxFolder) index() ([]*mboxEntry, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	key := f.format + "\x00" + f.path
+	if v, ok := mboxIndexes.Load(key); ok {
+		idx := v.(*mboxIndex)
+		if idx.size == info.Size() && idx.modTime.Equal(info.ModTime()) {
+			return idx.entries, nil
+		}
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries, err := indexMbox(file, f.format, info.ModTime())
+	if err != nil {
+		return nil, err
+	}
+	mboxIndexes.Store(key, &mboxIndex{size: info.Size(), modTime: info.ModTime(), entries: entries})
+	return entries, nil
+}
+
+// indexMbox streams through the file, recording where each message starts
+// and ends along with the metadata in its header. Only the header of each
+// message is held in memory.
+func indexMbox(r io.Reader, format string, modTime time.Time) ([]*mboxEntry, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	var entries []*mboxEntry
+	var cur *mboxEntry
+	var header bytes.Buffer
+	var offset, end, quoted int64
+	var inHeader bool
+	lineStart := true
+	blank := 0 // length of the preceding line if it was blank
+
+	finish := func(at int64) {
+		if cur == nil {
+			return
+		}
+		if inHeader {
+			parseMboxHeader(cur, header.Bytes(), format)
+		}
+		if end > 0 && end <= at {
+			// The length was given by Content-Length
+			cur.length = end - cur.offset
+		} else {
+			// The blank line before the next From line is not part of the message
+			cur.length = at - cur.offset - int64(blank)
+		}
+		if cur.length < 0 {
+			cur.length = 0
+		}
+		cur.size = uint32(cur.length - quoted)
+		if cur.date.IsZero() {
+			cur.date = modTime
+		}
+		entries = append(entries, cur)
+	}
+
+	for {
+		line, err := br.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+			return nil, err
+		}
+		atStart := lineStart
+		lineStart = err == nil
+
+		if len(line) > 0 {
+			// A From line starts a message at the start of the file, after a
+			// blank line, or where the Content-Length says the last one ended
+			separator := atStart && bytes.HasPrefix(line, []byte("From ")) &&
+				(cur == nil || blank > 0 || offset == end) && (end == 0 || offset >= end)
+			switch {
+			case separator:
+				finish(offset)
+				cur = &mboxEntry{offset: offset + int64(len(line)), date: parseFromLineDate(line)}
+				header.Reset()
+				inHeader, end, quoted = true, 0, 0
+			case cur == nil:
+				// Anything before the first From line is not a message
+			case inHeader && atStart && isBlankLine(line):
+				inHeader = false
+				length := parseMboxHeader(cur, header.Bytes(), format)
+				if length >= 0 {
+					end = offset + int64(len(line)) + length
+				}
+			case inHeader:
+				if header.Len() < mboxMaxHeaderSize {
+					header.Write(line)
+				}
+			}
+			if cur != nil && atStart && !separator && isQuotedFromLine(line, format) {
+				quoted++
+			}
+
+			blank = 0
+			if atStart && err == nil && isBlankLine(line) {
+				blank = len(line)
+			}
+			offset += int64(len(line))
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	finish(offset)
+	return entries, nil
+}
+
+func isBlankLine(line []byte) bool {
+	return len(bytes.TrimRight(line, "\r\n")) == 0
+}
+
+// isQuotedFromLine reports whether the line is a From line quoted by the
+// format, which is unquoted by removing the first '>'.
+func isQuotedFromLine(line []byte, format string) bool {
+	switch format {
+	case mboxrd:
+		return bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) && line[0] == '>'
+	case mboxo, mboxcl:
+		return bytes.HasPrefix(line, []byte(">From "))
+	}
+	return false
+}
+
+// fromLineLayouts are the date formats used after the sender in From lines,
+// e.g. "From MAILER-DAEMON Fri Jul  8 12:08:34 2011" or, in Google Takeout,
+// "From 1234@xxx Sat Jan 01 00:00:00 +0000 2022".
+var fromLineLayouts = []string{
+	"Mon Jan 2 15:04:05 2006",
+	"Mon Jan 2 15:04:05 -0700 2006",
+	"Mon Jan 2 15:04:05 MST 2006",
+	"Mon Jan 2 15:04:05 2006 -0700",
+}
+
+func parseFromLineDate(line []byte) time.Time {
+	fields := strings.Fields(string(line))
+	if len(fields) < 3 {
+		return time.Time{}
+	}
+	date := strings.Join(fields[2:], " ")
+	for _, layout := range fromLineLayouts {
+		if t, err := time.ParseInLocation(layout, date, time.Local); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// parseMboxHeader sets the flags, Gmail items and, if the From line had no
+// date, the date of the message from its header. It returns the
+// Content-Length for formats that use it, or -1.
+func parseMboxHeader(e *mboxEntry, raw []byte, format string) int64 {
+	hdr, _ := textproto.ReadHeader(bufio.NewReader(io.MultiReader(bytes.NewReader(raw), strings.NewReader("\r\n"))))
+
+	flags := map[string]bool{}
+	// Status and X-Status are written by mutt, pine and others
+	for _, r := range hdr.Get("Status") + hdr.Get("X-Status") {
+		switch r {
+		case 'R':
+			flags[imap.SeenFlag] = true
+		case 'A':
+			flags[imap.AnsweredFlag] = true
+		case 'F':
+			flags[imap.FlaggedFlag] = true
+		case 'T':
+			flags[imap.DraftFlag] = true
+		case 'D':
+			flags[imap.DeletedFlag] = true
+		}
+	}
+	// X-Mozilla-Status is written by Thunderbird
+	if v, err := strconv.ParseUint(strings.TrimSpace(hdr.Get("X-Mozilla-Status")), 16, 32); err == nil {
+		for bit, flag := range map[uint64]string{0x1: imap.SeenFlag, 0x2: imap.AnsweredFlag, 0x4: imap.FlaggedFlag, 0x8: imap.DeletedFlag} {
+			if v&bit != 0 {
+				flags[flag] = true
+			}
+		}
+	}
+	// X-Gmail-Labels and X-GM-THRID are written by Google Takeout
+	if labels := hdr.Get("X-Gmail-Labels"); labels != "" {
+		e.items = map[imap.FetchItem]interface{}{gmailLabels: takeoutLabels(labels, flags)}
+	}
+	if thrid := strings.TrimSpace(hdr.Get("X-GM-THRID")); thrid != "" {
+		if e.items == nil {
+			e.items = map[imap.FetchItem]interface{}{}
+		}
+		e.items[gmailThreadID] = thrid
+	}
+
+	e.flags = []string{}
+	for f := range flags {
+		e.flags = append(e.flags, f)
+	}
+
+	if e.date.IsZero() {
+		e.date, _ = mail.ParseDate(hdr.Get("Date"))
+	}
+
+	if format == mboxcl || format == mboxcl2 {
+		if n, err := strconv.ParseInt(strings.TrimSpace(hdr.Get("Content-Length")), 10, 64); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return -1
+}
+
+// takeoutSystemLabels maps the names Google Takeout uses for system labels
+// to the labels used in X-GM-LABELS.
+var takeoutSystemLabels = map[string]string{
+	"Inbox":     "\\Inbox",
+	"Sent":      "\\Sent",
+	"Starred":   "\\Starred",
+	"Important": "\\Important",
+	"Drafts":    "\\Draft",
+	"Spam":      "\\Spam",
+	"Trash":     "\\Trash",
+}
+
+// takeoutLabels converts an X-Gmail-Labels header to the X-GM-LABELS fetch
+// item, setting the flags that Takeout records as labels.
+func takeoutLabels(header string, flags map[string]bool) []interface{} {
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(header); err == nil {
+		header = decoded
+	}
+	labels := []interface{}{}
+	for _, label := range splitLabels(header) {
+		switch label {
+		case "Opened":
+			flags[imap.SeenFlag] = true
+			continue
+		case "Unread":
+			continue
+		case "Starred":
+			flags[imap.FlaggedFlag] = true
+		case "Drafts":
+			flags[imap.DraftFlag] = true
+		}
+		if system, ok := takeoutSystemLabels[label]; ok {
+			label = system
+		} else if encoded, err := utf7.Encoding.NewEncoder().String(label); err == nil {
+			// Labels are encoded like mailbox names
+			label = encoded
+		}
+		labels = append(labels, label)
+	}
+	return labels
+}
+
+// splitLabels splits a comma separated list of labels, where labels
+// containing commas are quoted.
+func splitLabels(s string) []string {
+	var labels []string
+	var label strings.Builder
+	quoted := false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			if l := strings.TrimSpace(label.String()); l != "" {
+				labels = append(labels, l)
+			}
+			label.Reset()
+		default:
+			label.WriteRune(r)
+		}
+	}
+	if l := strings.TrimSpace(label.String()); l != "" {
+		labels = append(labels, l)
+	}
+	return labels
+}
+
+// open reads the message from the file, removing any From line quoting.
+func (f *mboxFolder) open(e *mboxEntry) (io.ReadCloser, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	raw := make([]byte, e.length)
+	if _, err := file.ReadAt(raw, e.offset); err != nil {
+		return nil, err
+	}
+	if f.format == mboxcl2 {
+		return io.NopCloser(bytes.NewReader(raw)), nil
+	}
+
+	var b bytes.Buffer
+	b.Grow(len(raw))
+	for len(raw) > 0 {
+		i := bytes.IndexByte(raw, '\n') + 1
+		if i == 0 {
+			i = len(raw)
+		}
+		line := raw[:i]
+		if isQuotedFromLine(line, f.format) {
+			line = line[1:]
+		}
+		b.Write(line)
+		raw = raw[i:]
+	}
+	return io.NopCloser(&b), nil
+}
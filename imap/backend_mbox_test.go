@@ -0,0 +1,245 @@
+package imap
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestIndexMbox(t *testing.T) {
+	modTime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		format string
+		mbox   string
+		// wantBodies are the messages as read by open, after unquoting
+		wantBodies []string
+		wantFlags  [][]string
+		wantDates  []time.Time
+	}{
+		{
+			name:   "mboxrd",
+			format: mboxrd,
+			mbox: "From a@example.org Sat Jan  1 10:00:00 2022\n" +
+				"Subject: one\n\nHi\n>From here\n>>From there\n\n" +
+				"From b@example.org Sun Jan  2 10:00:00 2022\n" +
+				"Subject: two\n\nBye\n",
+			wantBodies: []string{
+				"Subject: one\n\nHi\nFrom here\n>From there\n",
+				"Subject: two\n\nBye\n",
+			},
+			wantFlags: [][]string{{}, {}},
+			wantDates: []time.Time{
+				time.Date(2022, 1, 1, 10, 0, 0, 0, time.Local),
+				time.Date(2022, 1, 2, 10, 0, 0, 0, time.Local),
+			},
+		},
+		{
+			name:   "mboxo",
+			format: mboxo,
+			mbox: "From a@example.org Sat Jan  1 10:00:00 2022\n" +
+				"Subject: one\n\n>From here\n>>From there\n",
+			wantBodies: []string{"Subject: one\n\nFrom here\n>>From there\n"},
+			wantFlags:  [][]string{{}},
+			wantDates:  []time.Time{time.Date(2022, 1, 1, 10, 0, 0, 0, time.Local)},
+		},
+		{
+			name:   "mboxcl2 with an unquoted From line in the body",
+			format: mboxcl2,
+			mbox: "From a@example.org Sat Jan  1 10:00:00 2022\n" +
+				"Subject: one\nContent-Length: 19\n\nHi\n\nFrom the start\n\n" +
+				"From b@example.org Sun Jan  2 10:00:00 2022\n" +
+				"Subject: two\nContent-Length: 4\n\nBye\n",
+			wantBodies: []string{
+				"Subject: one\nContent-Length: 19\n\nHi\n\nFrom the start\n",
+				"Subject: two\nContent-Length: 4\n\nBye\n",
+			},
+			wantFlags: [][]string{{}, {}},
+			wantDates: []time.Time{
+				time.Date(2022, 1, 1, 10, 0, 0, 0, time.Local),
+				time.Date(2022, 1, 2, 10, 0, 0, 0, time.Local),
+			},
+		},
+		{
+			name:   "flags and dates from the header",
+			format: mboxrd,
+			mbox: "Text before the first From line is skipped\n\n" +
+				"From a@example.org\n" +
+				"Date: Mon, 3 Jan 2022 10:00:00 +0000\nStatus: RO\nX-Status: AF\n\nHi\n\n" +
+				"From b@example.org\n" +
+				"X-Mozilla-Status: 0009\n\nBye\n\n" +
+				"From c@example.org\n\nNo date\n",
+			wantBodies: []string{
+				"Date: Mon, 3 Jan 2022 10:00:00 +0000\nStatus: RO\nX-Status: AF\n\nHi\n",
+				"X-Mozilla-Status: 0009\n\nBye\n",
+				"\nNo date\n",
+			},
+			wantFlags: [][]string{
+				{imap.AnsweredFlag, imap.FlaggedFlag, imap.SeenFlag},
+				{imap.DeletedFlag, imap.SeenFlag},
+				{},
+			},
+			wantDates: []time.Time{time.Date(2022, 1, 3, 10, 0, 0, 0, time.UTC), modTime, modTime},
+		},
+		{
+			name:       "empty",
+			format:     mboxrd,
+			mbox:       "",
+			wantBodies: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := writeTestMbox(t, tt.format, tt.mbox)
+			if err := os.Chtimes(f.path, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+			messages, _, err := f.messages()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != len(tt.wantBodies) {
+				t.Fatalf("got %d messages, want %d", len(messages), len(tt.wantBodies))
+			}
+			for i, m := range messages {
+				if m.Uid != uint32(i+1) {
+					t.Errorf("message %d has UID %d", i, m.Uid)
+				}
+				body := readTestMessage(t, m)
+				if body != tt.wantBodies[i] {
+					t.Errorf("message %d = %q, want %q", i, body, tt.wantBodies[i])
+				}
+				if m.Size != uint32(len(body)) {
+					t.Errorf("message %d has size %d, want %d", i, m.Size, len(body))
+				}
+				flags := append([]string{}, m.Flags...)
+				sort.Strings(flags)
+				if fmt.Sprint(flags) != fmt.Sprint(tt.wantFlags[i]) {
+					t.Errorf("message %d has flags %v, want %v", i, flags, tt.wantFlags[i])
+				}
+				if !m.Date.Equal(tt.wantDates[i]) {
+					t.Errorf("message %d has date %v, want %v", i, m.Date, tt.wantDates[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMboxTakeoutLabels(t *testing.T) {
+	f := writeTestMbox(t, mboxrd, "From 1234@xxx Sat Jan 01 00:00:00 +0000 2022\n"+
+		"X-GM-THRID: 1700000000000000001\n"+
+		"X-Gmail-Labels: Inbox,Opened,Starred,\"Work, Projects\",=?UTF-8?Q?Caf=C3=A9?=\n\nHi\n")
+	messages, _, err := f.messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	m := messages[0]
+	wantLabels := []interface{}{"\\Inbox", "\\Starred", "Work, Projects", "Caf&AOk-"}
+	if fmt.Sprint(m.Items[gmailLabels]) != fmt.Sprint(wantLabels) {
+		t.Errorf("labels = %v, want %v", m.Items[gmailLabels], wantLabels)
+	}
+	if m.Items[gmailThreadID] != "1700000000000000001" {
+		t.Errorf("thread ID = %v", m.Items[gmailThreadID])
+	}
+	flags := append([]string{}, m.Flags...)
+	sort.Strings(flags)
+	if want := []string{imap.FlaggedFlag, imap.SeenFlag}; fmt.Sprint(flags) != fmt.Sprint(want) {
+		t.Errorf("flags = %v, want %v", flags, want)
+	}
+}
+
+func TestMboxUidValidity(t *testing.T) {
+	one := "From a@example.org Sat Jan  1 10:00:00 2022\nSubject: one\n\nHi\n\n"
+	two := "From b@example.org Sun Jan  2 10:00:00 2022\nSubject: two\n\nBye\n\n"
+	three := "From c@example.org Mon Jan  3 10:00:00 2022\nSubject: three\n\nAgain\n\n"
+
+	f := writeTestMbox(t, mboxrd, one+two)
+	uidValidity := testMboxUidValidity(t, f)
+	if uidValidity == 0 {
+		t.Fatal("UIDVALIDITY is 0")
+	}
+	if v := testMboxUidValidity(t, f); v != uidValidity {
+		t.Errorf("UIDVALIDITY changed from %d to %d when the file was read again", uidValidity, v)
+	}
+
+	// Removing a message renumbers the rest
+	if err := os.WriteFile(f.path, []byte(two+three), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if v := testMboxUidValidity(t, f); v == uidValidity {
+		t.Errorf("UIDVALIDITY stayed %d when a message was removed", v)
+	}
+}
+
+// writeTestMbox writes an mbox file to a temporary directory.
+func writeTestMbox(t *testing.T, format, content string) *mboxFolder {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.mbox")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &mboxFolder{name: "test", path: path, format: format}
+}
+
+func testMboxUidValidity(t *testing.T, f *mboxFolder) uint32 {
+	t.Helper()
+	_, uidValidity, err := f.messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uidValidity
+}
+
+func readTestMessage(t *testing.T, m *localMessage) string {
+	t.Helper()
+	r, err := m.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestSplitLabels(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"Inbox,Important", []string{"Inbox", "Important"}},
+		{` Inbox , "a, b" ,,`, []string{"Inbox", "a, b"}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := splitLabels(tt.in); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("splitLabels(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestGlobBase(t *testing.T) {
+	tests := []struct {
+		pattern, want string
+	}{
+		{"/mail/Takeout/*.mbox", "/mail/Takeout"},
+		{"/mail/*/Inbox", "/mail"},
+		{"/mail/inbox.mbox", "/mail"},
+	}
+	for _, tt := range tests {
+		if got := globBase(filepath.FromSlash(tt.pattern)); got != filepath.FromSlash(tt.want) {
+			t.Errorf("globBase(%q) = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-imap/client"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+)
+
+const backendReplay = "replay"
+
+// replayTranscript holds the server responses of a recorded transcript,
+// keyed by the command they answered without its tag.
+type replayTranscript struct {
+	greeting  []byte
+	responses map[string][]replayResponse
+}
+
+// replayResponse is the untagged responses to a command, and its tagged
+// completion, which is recorded with the tag of the original command.
+type replayResponse struct {
+	tag   string
+	lines [][]byte
+}
+
+// replayWithin matches the YOUNGER and OLDER search keys, whose intervals are
+// counted back from the time of the query.
+var replayWithin = regexp.MustCompile(`(?i)\b(YOUNGER|OLDER) [0-9]+\b`)
+
+// replayKey returns the key of a command without its tag. LOGIN and
+// AUTHENTICATE are redacted in transcripts, so match whatever arguments.
+// YOUNGER and OLDER intervals also match whatever number of seconds, as the
+// same query sends different ones each time it is run.
+func replayKey(command string) string {
+	command = strings.TrimRight(command, "\r\n")
+	name, _, _ := strings.Cut(command, " ")
+	if name = strings.ToUpper(name); name == "LOGIN" || name == "AUTHENTICATE" {
+		return name
+	}
+	return replayWithin.ReplaceAllString(command, "$1 *")
+}
+
+// readReplayTranscript parses a transcript recorded by a transcriptConn.
+func readReplayTranscript(path string) (*replayTranscript, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read replay path: %w", err)
+	}
+	defer f.Close()
+
+	// Separate the two sides of each connection
+	type connection struct{ client, server bytes.Buffer }
+	connections := map[string]*connection{}
+	var order []string
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			id, rest, ok := bytes.Cut(line, []byte(" "))
+			if !ok || len(rest) < 3 {
+				return nil, fmt.Errorf("%s is not a transcript", path)
+			}
+			c := connections[string(id)]
+			if c == nil {
+				c = &connection{}
+				connections[string(id)] = c
+				order = append(order, string(id))
+			}
+			switch string(rest[:3]) {
+			case "C: ":
+				c.client.Write(rest[3:])
+			case "S: ":
+				c.server.Write(rest[3:])
+			default:
+				return nil, fmt.Errorf("%s is not a transcript", path)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t := &replayTranscript{responses: map[string][]replayResponse{}}
+	for _, id := range order {
+		c := connections[id]
+
+		// Group the server responses by the tag of the command they complete
+		byTag := map[string]replayResponse{}
+		var untagged [][]byte
+		server := bufio.NewReader(&c.server)
+		for first := true; ; first = false {
+			line, err := readTranscriptLine(server, nil)
+			if len(line) > 0 {
+				tag, _, _ := strings.Cut(string(line), " ")
+				switch {
+				case first:
+					if t.greeting == nil {
+						t.greeting = line
+					}
+				case tag == "+":
+					// Continuation requests are made afresh when replaying
+				case tag == "*":
+					untagged = append(untagged, line)
+				default:
+					byTag[tag] = replayResponse{tag: tag, lines: append(untagged, line)}
+					untagged = nil
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+
+		commands := bufio.NewReader(&c.client)
+		for {
+			line, err := readTranscriptLine(commands, nil)
+			if tag, command, ok := strings.Cut(string(line), " "); ok {
+				if response, ok := byTag[tag]; ok {
+					key := replayKey(command)
+					t.responses[key] = append(t.responses[key], response)
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	if t.greeting == nil {
+		return nil, fmt.Errorf("%s has no recorded connections", path)
+	}
+	return t, nil
+}
+
+// serve answers the commands of a connection from the transcript. When a
+// command was recorded more than once, the responses are replayed in order,
+// and the last is repeated.
+func (t *replayTranscript) serve(conn net.Conn) {
+	defer conn.Close()
+	if _, err := conn.Write(t.greeting); err != nil {
+		return
+	}
+	replayed := map[string]int{}
+	r := bufio.NewReader(conn)
+	for {
+		line, err := readTranscriptLine(r, func() error {
+			_, err := io.WriteString(conn, "+ Ready for literal data\r\n")
+			return err
+		})
+		if err != nil {
+			return
+		}
+		tag, command, _ := strings.Cut(string(line), " ")
+		key := replayKey(command)
+		responses := t.responses[key]
+		if len(responses) == 0 {
+			_, err = fmt.Fprintf(conn, "%s NO Command not in transcript: %s\r\n", tag, strings.TrimRight(command, "\r\n"))
+			if err != nil {
+				return
+			}
+			continue
+		}
+		i := replayed[key]
+		if i >= len(responses) {
+			i = len(responses) - 1
+		}
+		replayed[key]++
+
+		response := responses[i]
+		for j, l := range response.lines {
+			if j == len(response.lines)-1 {
+				l = append([]byte(tag), l[len(response.tag):]...)
+			}
+			if _, err := conn.Write(l); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// connectReplay returns a client whose commands are answered from the
+// transcript at the configured path, without any network access.
+func connectReplay(ctx context.Context, d *plugin.QueryData) (*client.Client, error) {
+	imapConfig := GetConfig(d.Connection)
+	if imapConfig.Path == nil || *imapConfig.Path == "" {
+		return nil, errors.New("path must be configured for the replay backend")
+	}
+	path, err := expandHome(*imapConfig.Path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readReplayTranscript(path)
+	if err != nil {
+		return nil, err
+	}
+
+	clientConn, serverConn := net.Pipe()
+	go t.serve(serverConn)
+
+	c, err := client.New(clientConn)
+	if err != nil {
+		clientConn.Close()
+		return nil, err
+	}
+	_, login := hostAndLogin(d)
+	if err := c.Login(login, ""); err != nil {
+		plugin.Logger(ctx).Error("connection_error", "backend", backendReplay, "err", err)
+		c.Terminate()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,426 @@
+package imap
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// Formats of bounce messages, for the format column of imap_bounce
+const (
+	bounceRFC3464  = "rfc3464"
+	bounceExchange = "exchange"
+	bounceGmail    = "gmail"
+	bounceQmail    = "qmail"
+)
+
+// bounce is a delivery status notification, either a standard report (RFC
+// 3464) or one of the plain text formats that some servers still send.
+type bounce struct {
+	Format            string
+	ReportingMTA      string
+	OriginalMessageID string
+	Recipients        []bounceRecipient
+}
+
+type bounceRecipient struct {
+	OriginalRecipient string
+	FinalRecipient    string
+	Action            string
+	Status            string
+	DiagnosticCode    string
+	RemoteMTA         string
+	LastAttemptDate   time.Time
+}
+
+var (
+	// Enhanced status codes, see RFC 3463
+	bounceStatus  = regexp.MustCompile(`\b[245]\.[0-9]{1,3}\.[0-9]{1,3}\b`)
+	bounceAddress = regexp.MustCompile(`[A-Za-z0-9.!#$%&'*+/=?^_{|}~-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)+`)
+	blankLine     = regexp.MustCompile(`\n[ \t]*\n`)
+
+	// Subjects of bounces, lower case
+	bounceSubjects = []string{"undeliverable", "undelivered mail", "delivery status notification", "failure notice", "mail delivery failed", "delivery failure", "returned mail", "delivery delayed"}
+
+	// Lines that precede a copy of the original message or its header
+	originalMessageMarkers = []string{qmailCopy, "----- Original message -----", "Original message headers:"}
+)
+
+// parseBounce returns the bounce in a message, or nil if it isn't one.
+func parseBounce(env *enmime.Envelope) *bounce {
+	if env == nil || env.Root == nil {
+		return nil
+	}
+	parts := env.Root.DepthMatchAll(func(p *enmime.Part) bool { return p.FirstChild == nil })
+	var b *bounce
+	for _, p := range parts {
+		switch strings.ToLower(p.ContentType) {
+		case "message/delivery-status", "message/global-delivery-status":
+			b = parseDeliveryStatus(p.Content)
+		}
+		if b != nil {
+			break
+		}
+	}
+	if b == nil {
+		// Plain text formats are only looked for in messages that look like
+		// bounces, so that mail quoting one isn't mistaken for it
+		if !looksLikeBounce(env) {
+			return nil
+		}
+		text := strings.ReplaceAll(env.Text, "\r\n", "\n")
+		for _, parse := range []func(string) *bounce{parseQmailBounce, parseExchangeBounce, parseGmailBounce} {
+			if b = parse(text); b != nil {
+				break
+			}
+		}
+		if b == nil {
+			return nil
+		}
+	}
+	b.OriginalMessageID = originalMessageID(parts, env.Text)
+	return b
+}
+
+// looksLikeBounce says whether a message was sent by a mail server about
+// another message, from its null sender, sender or subject.
+func looksLikeBounce(env *enmime.Envelope) bool {
+	if strings.TrimSpace(env.GetHeader("Return-Path")) == "<>" || env.GetHeader("X-Failed-Recipients") != "" {
+		return true
+	}
+	if from, err := env.AddressList("From"); err == nil && len(from) > 0 {
+		local, _, _ := strings.Cut(strings.ToLower(from[0].Address), "@")
+		if local == "mailer-daemon" || local == "postmaster" || strings.HasPrefix(local, "microsoftexchange") {
+			return true
+		}
+	}
+	subject := strings.ToLower(strings.TrimSpace(env.GetHeader("Subject")))
+	for _, s := range bounceSubjects {
+		if strings.HasPrefix(subject, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDeliveryStatus parses a message/delivery-status part, which has a
+// group of fields about the message, then a group for each recipient, e.g.
+//
+//	Reporting-MTA: dns; mx.example.com
+//
+//	Final-Recipient: rfc822; bob@example.org
+//	Action: failed
+//	Status: 5.1.1
+//	Remote-MTA: dns; mx.example.org
+//	Diagnostic-Code: smtp; 550 5.1.1 User unknown
+func parseDeliveryStatus(data []byte) *bounce {
+	b := &bounce{Format: bounceRFC3464}
+	for _, fields := range fieldGroups(string(data)) {
+		if b.ReportingMTA == "" {
+			b.ReportingMTA = dsnValue(headerValue(fields, "Reporting-MTA"))
+		}
+		r := bounceRecipient{
+			OriginalRecipient: dsnAddress(headerValue(fields, "Original-Recipient")),
+			FinalRecipient:    dsnAddress(headerValue(fields, "Final-Recipient")),
+			Action:            strings.ToLower(strings.TrimSpace(stripComments(headerValue(fields, "Action")))),
+			Status:            bounceStatus.FindString(headerValue(fields, "Status")),
+			DiagnosticCode:    dsnValue(headerValue(fields, "Diagnostic-Code")),
+			RemoteMTA:         dsnValue(headerValue(fields, "Remote-MTA")),
+			LastAttemptDate:   parseReceivedDate(headerValue(fields, "Last-Attempt-Date")),
+		}
+		if r.FinalRecipient == "" && r.OriginalRecipient == "" {
+			continue
+		}
+		if r.Status == "" {
+			r.Status = bounceStatus.FindString(r.DiagnosticCode)
+		}
+		b.Recipients = append(b.Recipients, r)
+	}
+	if len(b.Recipients) == 0 {
+		return nil
+	}
+	return b
+}
+
+// fieldGroups splits text into groups of header fields at blank lines.
+func fieldGroups(s string) [][]headerField {
+	var groups [][]headerField
+	for _, group := range blankLine.Split(strings.ReplaceAll(s, "\r\n", "\n"), -1) {
+		if fields := readHeaderFields([]byte(strings.TrimLeft(group, "\n"))); len(fields) > 0 {
+			groups = append(groups, fields)
+		}
+	}
+	return groups
+}
+
+// dsnValue removes the type from a typed field, e.g. "dns; mx.example.com"
+// or "smtp; 550 5.1.1 User unknown", and the spaces left by unfolding it.
+func dsnValue(s string) string {
+	if _, value, ok := strings.Cut(s, ";"); ok {
+		s = value
+	}
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// dsnAddress returns the address of a recipient field, e.g.
+// "rfc822; <bob@example.org>".
+func dsnAddress(s string) string {
+	return strings.Trim(dsnValue(s), "<>")
+}
+
+// qmailCopy precedes the copy of the message in a qmail bounce
+const qmailCopy = "--- Below this line is a copy of the message."
+
+var (
+	qmailMarker    = regexp.MustCompile(`(?i)this is the qmail-send program|I'm afraid I wasn't able to deliver your message`)
+	qmailHost      = regexp.MustCompile(`qmail-send program at ([A-Za-z0-9.-]+[A-Za-z0-9])`)
+	qmailRecipient = regexp.MustCompile(`(?m)^<([^<>\s]+@[^<>\s]+)>:[ \t]*$`)
+	qmailRemote    = regexp.MustCompile(`(?i)(?:Giving up on|Connected to) ([0-9A-Fa-f.:]*[0-9A-Fa-f])`)
+	qmailSaid      = regexp.MustCompile(`(?i)Remote host said: (.*?)(?: Giving up on \S+)?$`)
+)
+
+// parseQmailBounce parses a qmail bounce, which has a paragraph for each
+// recipient, e.g.
+//
+//	<bob@example.org>:
+//	203.0.113.5 does not like recipient.
+//	Remote host said: 550 5.1.1 User unknown
+//	Giving up on 203.0.113.5.
+func parseQmailBounce(text string) *bounce {
+	if !qmailMarker.MatchString(text) {
+		return nil
+	}
+	text, _, _ = strings.Cut(text, qmailCopy)
+	b := &bounce{Format: bounceQmail}
+	if m := qmailHost.FindStringSubmatch(text); m != nil {
+		b.ReportingMTA = m[1]
+	}
+	locs := qmailRecipient.FindAllStringSubmatchIndex(text, -1)
+	for i, loc := range locs {
+		end := len(text)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		r := bounceRecipient{
+			FinalRecipient: text[loc[2]:loc[3]],
+			Action:         "failed",
+			DiagnosticCode: firstParagraph(text[loc[1]:end]),
+		}
+		if m := qmailRemote.FindStringSubmatch(r.DiagnosticCode); m != nil {
+			r.RemoteMTA = m[1]
+		}
+		if m := qmailSaid.FindStringSubmatch(r.DiagnosticCode); m != nil {
+			r.DiagnosticCode = m[1]
+		}
+		r.Status = bounceStatus.FindString(r.DiagnosticCode)
+		b.Recipients = append(b.Recipients, r)
+	}
+	if len(b.Recipients) == 0 {
+		return nil
+	}
+	return b
+}
+
+var (
+	exchangeFailed   = regexp.MustCompile(`(?i)Delivery has failed to these recipients or groups:`)
+	exchangeDelayed  = regexp.MustCompile(`(?i)Delivery is delayed to these recipients or groups:`)
+	exchangeDiagnose = regexp.MustCompile(`(?i)Diagnostic information for administrators:`)
+	exchangeServer   = regexp.MustCompile(`(?i)Generating server:\s*(\S+)`)
+	exchangeReturned = regexp.MustCompile(`(?i)Remote Server (?:at (\S+)(?: \([^)]*\))? )?returned '(.*)'`)
+	exchangeHashes   = regexp.MustCompile(`^(?:(\S+\.\S+) )?#(.+?)(?: ##.*)?$`)
+	// Exchange 2003: <mx.example.org #5.1.1 smtp;550 5.1.1 User unknown>
+	exchangeLegacy          = regexp.MustCompile(`(?i)The following recipient\(s\) (?:cannot|could not) be reached:`)
+	exchangeLegacyRecipient = regexp.MustCompile(`(?m)^[ \t]*'?([^\s']+@[^\s']+?)'? on .*$`)
+	exchangeLegacyDiagnose  = regexp.MustCompile(`<(\S+) #([245]\.[0-9]{1,3}\.[0-9]{1,3})(?: ([^>]*))?>`)
+)
+
+// parseExchangeBounce parses the text of an Exchange non-delivery report,
+// e.g.
+//
+//	Delivery has failed to these recipients or groups:
+//
+//	Bob (bob@example.org)
+//	The email address you entered couldn't be found.
+//
+//	Diagnostic information for administrators:
+//
+//	Generating server: EX01.example.com
+//
+//	bob@example.org
+//	Remote Server returned '550 5.1.1 User unknown'
+func parseExchangeBounce(text string) *bounce {
+	if loc := exchangeLegacy.FindStringIndex(text); loc != nil {
+		return parseLegacyExchangeBounce(text[loc[1]:])
+	}
+	action := "failed"
+	loc := exchangeFailed.FindStringIndex(text)
+	if loc == nil {
+		if loc = exchangeDelayed.FindStringIndex(text); loc == nil {
+			return nil
+		}
+		action = "delayed"
+	}
+	text = text[loc[1]:]
+	for _, marker := range originalMessageMarkers {
+		text, _, _ = strings.Cut(text, marker)
+	}
+	recipients, diagnostics := text, ""
+	if loc := exchangeDiagnose.FindStringIndex(text); loc != nil {
+		recipients, diagnostics = text[:loc[0]], text[loc[1]:]
+	}
+
+	b := &bounce{Format: bounceExchange}
+	if m := exchangeServer.FindStringSubmatch(diagnostics); m != nil {
+		b.ReportingMTA = m[1]
+	}
+	for _, addr := range uniqueAddresses(recipients) {
+		r := bounceRecipient{FinalRecipient: addr, Action: action}
+		// The diagnostic follows the address in its own paragraph
+		for _, para := range blankLine.Split(diagnostics, -1) {
+			first, rest, _ := strings.Cut(strings.TrimSpace(para), "\n")
+			if !strings.EqualFold(strings.TrimSpace(first), addr) {
+				continue
+			}
+			diag := firstParagraph(rest)
+			if m := exchangeReturned.FindStringSubmatch(diag); m != nil {
+				r.RemoteMTA, diag = m[1], m[2]
+			} else if m := exchangeHashes.FindStringSubmatch(diag); m != nil {
+				r.RemoteMTA, diag = m[1], m[2]
+			}
+			r.DiagnosticCode = diag
+			r.Status = bounceStatus.FindString(diag)
+			break
+		}
+		b.Recipients = append(b.Recipients, r)
+	}
+	if len(b.Recipients) == 0 {
+		return nil
+	}
+	return b
+}
+
+// parseLegacyExchangeBounce parses the recipients of an Exchange 2003
+// report, e.g.
+//
+//	bob@example.org on 1/2/2010 10:00 AM
+//	    The e-mail account does not exist at the organization this message was sent to.
+//	    <mx.example.org #5.1.1 smtp;550 5.1.1 User unknown>
+func parseLegacyExchangeBounce(text string) *bounce {
+	b := &bounce{Format: bounceExchange}
+	locs := exchangeLegacyRecipient.FindAllStringSubmatchIndex(text, -1)
+	for i, loc := range locs {
+		end := len(text)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		r := bounceRecipient{FinalRecipient: text[loc[2]:loc[3]], Action: "failed"}
+		block := strings.Join(strings.Fields(text[loc[1]:end]), " ")
+		if m := exchangeLegacyDiagnose.FindStringSubmatch(block); m != nil {
+			r.RemoteMTA, r.Status, r.DiagnosticCode = m[1], m[2], dsnValue(m[3])
+		} else {
+			r.DiagnosticCode = block
+		}
+		b.Recipients = append(b.Recipients, r)
+	}
+	if len(b.Recipients) == 0 {
+		return nil
+	}
+	return b
+}
+
+var (
+	gmailFailed       = regexp.MustCompile(`(?i)Delivery to the following recipients? failed permanently:`)
+	gmailDelayed      = regexp.MustCompile(`(?i)Delivery to the following recipients? (?:has|have) been delayed:`)
+	gmailNotDelivered = regexp.MustCompile(`(?i)Your message wasn't delivered to (\S+@\S+?) because`)
+	gmailProblem      = regexp.MustCompile(`(?i)There was a (temporary )?problem delivering your message to (\S+@[A-Za-z0-9.-]*[A-Za-z0-9])`)
+	gmailResponse     = regexp.MustCompile(`(?i)The (?:response from the remote server|response|error that the other server returned) was:[ \t]*\n`)
+	gmailServer       = regexp.MustCompile(`by ([A-Za-z0-9.-]*[A-Za-z0-9])\.? \[([0-9A-Fa-f.:]+)\]`)
+)
+
+// parseGmailBounce parses the text of a Gmail bounce, in the current form,
+//
+//	Your message wasn't delivered to bob@example.org because the address
+//	couldn't be found, or is unable to receive mail.
+//
+//	The response from the remote server was:
+//	550 5.1.1 User unknown
+//
+// or the older form, which lists the recipients after "Delivery to the
+// following recipient failed permanently:".
+func parseGmailBounce(text string) *bounce {
+	var addrs []string
+	action := "failed"
+	if m := gmailNotDelivered.FindStringSubmatch(text); m != nil {
+		addrs = []string{strings.TrimRight(m[1], ".,")}
+	} else if m := gmailProblem.FindStringSubmatch(text); m != nil {
+		addrs = []string{m[2]}
+		if m[1] != "" {
+			action = "delayed"
+		}
+	} else if loc := gmailFailed.FindStringIndex(text); loc != nil {
+		addrs = uniqueAddresses(firstParagraph(text[loc[1]:]))
+	} else if loc := gmailDelayed.FindStringIndex(text); loc != nil {
+		addrs = uniqueAddresses(firstParagraph(text[loc[1]:]))
+		action = "delayed"
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	r := bounceRecipient{Action: action}
+	if loc := gmailResponse.FindStringIndex(text); loc != nil {
+		r.DiagnosticCode = firstParagraph(text[loc[1]:])
+		r.Status = bounceStatus.FindString(r.DiagnosticCode)
+	}
+	if m := gmailServer.FindStringSubmatch(text); m != nil {
+		r.RemoteMTA = m[1]
+	}
+	b := &bounce{Format: bounceGmail}
+	for _, addr := range addrs {
+		r.FinalRecipient = addr
+		b.Recipients = append(b.Recipients, r)
+	}
+	return b
+}
+
+// firstParagraph returns the text up to the first blank line, on one line.
+func firstParagraph(s string) string {
+	para := blankLine.Split(strings.TrimLeft(s, " \t\n"), 2)[0]
+	return strings.Join(strings.Fields(para), " ")
+}
+
+// uniqueAddresses returns the email addresses in text, without duplicates.
+func uniqueAddresses(s string) []string {
+	var addrs []string
+	for _, addr := range bounceAddress.FindAllString(s, -1) {
+		addr = strings.TrimRight(addr, ".")
+		if !hasFoldedString(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// originalMessageID returns the Message-ID of the message that bounced, from
+// the copy of it or its header attached to the bounce, or quoted in the text.
+func originalMessageID(parts []*enmime.Part, text string) string {
+	for _, p := range parts {
+		switch strings.ToLower(p.ContentType) {
+		case "message/rfc822", "message/global", "text/rfc822-headers", "message/global-headers":
+			if id := headerValue(readHeaderFields(p.Content), "Message-Id"); id != "" {
+				return id
+			}
+		}
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	for _, marker := range originalMessageMarkers {
+		if _, rest, ok := strings.Cut(text, marker); ok {
+			if id := headerValue(readHeaderFields([]byte(strings.TrimLeft(rest, " \t\n"))), "Message-Id"); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
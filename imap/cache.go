@@ -0,0 +1,701 @@
+package imap
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"golang.org/x/crypto/argon2"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+)
+
+// messageCache is an opt-in on-disk cache of message metadata (flags,
+// envelope, size and internal date) and, optionally, message bodies. Each
+// mailbox is cached in its own file keyed by host, login and mailbox, and is
+// brought up to date incrementally with CONDSTORE and QRESYNC (RFC 7162)
+// where the server supports them. The cache for a mailbox is discarded when
+// its UIDVALIDITY changes.
+type messageCache struct {
+	dir     string
+	bodies  bool
+	maxSize int64
+	aead    cipher.AEAD
+
+	key         string
+	lock        *sync.Mutex
+	qresync     bool
+	condstore   bool
+	modSeq      uint64
+	uidValidity uint32
+}
+
+// cachedMailbox is the cached state of a single mailbox.
+type cachedMailbox struct {
+	UIDValidity   uint32
+	HighestModSeq uint64
+	Messages      map[uint32]*cachedMessage
+
+	// Sequence numbers by UID, calculated after each sync
+	seqNums map[uint32]uint32
+}
+
+// cachedMessage is everything fetched for a message except its body.
+type cachedMessage struct {
+	Uid          uint32
+	Flags        []string
+	InternalDate time.Time
+	Size         uint32
+	Envelope     *imap.Envelope
+	Items        map[imap.FetchItem]interface{} `json:",omitempty"`
+}
+
+// cacheLocks serializes access to each cached mailbox within the plugin.
+var cacheLocks sync.Map
+
+// cacheMetadataItems are the items cached for each message, other than any
+// Gmail extension items.
+var cacheMetadataItems = []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchEnvelope}
+
+const statusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+
+// newMessageCache returns the message cache for the connection, or nil if
+// cache_path is not configured or the connection uses a local backend.
+func newMessageCache(d *plugin.QueryData) (*messageCache, error) {
+	imapConfig := GetConfig(d.Connection)
+	if imapConfig.CachePath == nil || *imapConfig.CachePath == "" {
+		return nil, nil
+	}
+	// Local backends are read directly, so there is nothing to gain
+	if backendName(imapConfig) != backendIMAP {
+		return nil, nil
+	}
+
+	dir, err := expandHome(*imapConfig.CachePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create cache_path: %w", err)
+	}
+
+	mc := &messageCache{dir: dir}
+	if imapConfig.CacheBodies != nil {
+		mc.bodies = *imapConfig.CacheBodies
+	}
+	if imapConfig.CacheMaxSizeMB != nil {
+		mc.maxSize = int64(*imapConfig.CacheMaxSizeMB) << 20
+	}
+	if imapConfig.CacheEncryptionKey != nil && *imapConfig.CacheEncryptionKey != "" {
+		key, err := cacheEncryptionKey(dir, *imapConfig.CacheEncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if mc.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return mc, nil
+}
+
+// cacheSaltFile holds the random salt the encryption key of the cache is
+// derived with.
+const cacheSaltFile = "salt"
+
+// cacheKeys holds the keys derived for each cache directory and passphrase,
+// as deriving them is deliberately slow.
+var cacheKeys sync.Map
+
+// cacheEncryptionKey derives the AES-256 key of the cache from the
+// passphrase with Argon2id, and the salt of the cache directory, which is
+// created with the cache. Files encrypted with a key derived differently
+// fail to decrypt, and are discarded and fetched again.
+func cacheEncryptionKey(dir, passphrase string) ([]byte, error) {
+	salt, err := cacheSalt(dir)
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256([]byte(dir + "\x00" + string(salt) + "\x00" + passphrase))
+	if key, ok := cacheKeys.Load(id); ok {
+		return key.([]byte), nil
+	}
+	key := argon2.IDKey([]byte(passphrase), salt, 1, 64*1024, 4, 32)
+	cacheKeys.Store(id, key)
+	return key, nil
+}
+
+// cacheSalt returns the salt of the cache directory, creating it if needed.
+func cacheSalt(dir string) ([]byte, error) {
+	path := filepath.Join(dir, cacheSaltFile)
+	salt, err := os.ReadFile(path)
+	if err == nil && len(salt) >= 16 {
+		return salt, nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("cannot read cache salt: %w", err)
+	}
+	salt = make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	// Another query may create the salt at the same time, in which case
+	// theirs is used
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		for i := 0; i < 10; i++ {
+			if existing, err := os.ReadFile(path); err == nil && len(existing) >= 16 {
+				return existing, nil
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil, errors.New("cannot read cache salt")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cache salt: %w", err)
+	}
+	_, err = f.Write(salt)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cache salt: %w", err)
+	}
+	return salt, nil
+}
+
+// prepare must be called before the mailbox is selected. It enables QRESYNC
+// and reads the mailbox's current UIDVALIDITY and HIGHESTMODSEQ.
+func (mc *messageCache) prepare(d *plugin.QueryData, c *client.Client, mailbox string) error {
+	host, login := hostAndLogin(d)
+	sum := sha256.Sum256([]byte(host + "\x00" + login + "\x00" + mailbox))
+	mc.key = hex.EncodeToString(sum[:16])
+
+	if ok, _ := c.Support("QRESYNC"); ok {
+		if enabled, err := c.Enable([]string{"QRESYNC"}); err == nil {
+			for _, e := range enabled {
+				mc.qresync = mc.qresync || strings.EqualFold(e, "QRESYNC")
+			}
+		}
+	}
+	mc.condstore, _ = c.Support("CONDSTORE")
+	mc.condstore = mc.condstore || mc.qresync
+
+	items := []imap.StatusItem{imap.StatusUidValidity}
+	if mc.condstore {
+		items = append(items, statusHighestModSeq)
+	}
+	status, err := c.Status(mailbox, items)
+	if err != nil {
+		return err
+	}
+	mc.uidValidity = status.UidValidity
+	if v, err := imap.ParseString(status.Items[statusHighestModSeq]); err == nil {
+		mc.modSeq, _ = strconv.ParseUint(v, 10, 64)
+	}
+
+	lock, _ := cacheLocks.LoadOrStore(mc.key, &sync.Mutex{})
+	mc.lock = lock.(*sync.Mutex)
+	return nil
+}
+
+// sync brings the cached mailbox up to date with the selected mailbox, and
+// saves it. New messages have their metadata fetched, while for cached
+// messages only the flags that changed and the messages that were expunged
+// are fetched. The cached mailbox is only locked while it is synced, not
+// while the messages are streamed, so that a query may scan the same mailbox
+// more than once, e.g. in a join.
+func (mc *messageCache) sync(ctx context.Context, c *client.Client, mbox *imap.MailboxStatus, gmail bool) (*cachedMailbox, error) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	state, err := mc.load()
+	if err != nil || state.UIDValidity != mc.uidValidity {
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			plugin.Logger(ctx).Warn("imap.messageCache.sync", "discarding_cache", err)
+		}
+		state = &cachedMailbox{UIDValidity: mc.uidValidity, Messages: map[uint32]*cachedMessage{}}
+	}
+	// Bodies are kept by UIDVALIDITY, so a body written by a query that
+	// synced before UIDVALIDITY changed is never read for another message
+	if err := mc.removeStaleBodies(); err != nil {
+		return nil, err
+	}
+
+	// Some servers reject a fetch of 1:* on an empty mailbox
+	if mbox.Messages == 0 {
+		state.Messages = map[uint32]*cachedMessage{}
+		state.HighestModSeq = mc.modSeq
+		state.calculateSeqNums()
+		mc.save(ctx, state)
+		return state, nil
+	}
+
+	flagItems := []imap.FetchItem{imap.FetchUid, imap.FetchFlags}
+	metadataItems := append([]imap.FetchItem{}, cacheMetadataItems...)
+	if gmail {
+		// Label changes update the modification sequence, so they are synced
+		// along with the flags
+		flagItems = append(flagItems, gmailLabels)
+		metadataItems = append(metadataItems, gmailLabels, gmailThreadID, gmailMessageID)
+	}
+
+	var maxUid uint32
+	for uid := range state.Messages {
+		if uid > maxUid {
+			maxUid = uid
+		}
+	}
+
+	all := new(imap.SeqSet)
+	all.AddRange(1, 0)
+	if len(state.Messages) > 0 {
+		changes := &changedSinceFetch{Fetch: commands.Fetch{SeqSet: all, Items: flagItems}}
+		if mc.condstore && state.HighestModSeq > 0 {
+			changes.ModSeq = state.HighestModSeq
+			changes.Vanished = mc.qresync
+		}
+		updated, vanishedSet, err := changes.execute(c)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range updated {
+			if cm, ok := state.Messages[msg.Uid]; ok {
+				cm.Flags = msg.Flags
+				if labels, ok := msg.Items[gmailLabels]; ok {
+					if cm.Items == nil {
+						cm.Items = map[imap.FetchItem]interface{}{}
+					}
+					cm.Items[gmailLabels] = cacheableItem(labels)
+				}
+			}
+		}
+
+		// With QRESYNC the server reports expunged messages as VANISHED.
+		// Without it, find them by comparing every UID in the mailbox. A full
+		// flag fetch already returned them all.
+		var vanished []uint32
+		if changes.Vanished {
+			vanished = vanishedUids(state, vanishedSet)
+		} else if changes.ModSeq > 0 {
+			uids, err := newMessageSearch().search(c)
+			if err != nil {
+				return nil, err
+			}
+			vanished = missingUids(state, uids)
+		} else {
+			uids := make([]uint32, len(updated))
+			for i, msg := range updated {
+				uids[i] = msg.Uid
+			}
+			vanished = missingUids(state, uids)
+		}
+		for _, uid := range vanished {
+			delete(state.Messages, uid)
+			os.Remove(mc.bodyPath(uid))
+		}
+	}
+
+	// Fetch the metadata for new messages. A UID range of n:* always includes
+	// the last message, even if it is below n, so filter on the UID.
+	added := new(imap.SeqSet)
+	added.AddRange(maxUid+1, 0)
+	newMessages, _, err := (&changedSinceFetch{Fetch: commands.Fetch{SeqSet: added, Items: metadataItems}}).execute(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range newMessages {
+		if msg.Uid > maxUid {
+			state.Messages[msg.Uid] = newCachedMessage(msg)
+		}
+	}
+
+	state.HighestModSeq = mc.modSeq
+	state.calculateSeqNums()
+	mc.save(ctx, state)
+	return state, nil
+}
+
+// save writes the cached mailbox to disk.
+func (mc *messageCache) save(ctx context.Context, state *cachedMailbox) {
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = mc.writeFile(mc.statePath(), data)
+	}
+	if err != nil {
+		plugin.Logger(ctx).Error("imap.messageCache.save", "cache_error", err)
+	}
+}
+
+// finish enforces the size limit once the messages have been fetched, and
+// any bodies cached.
+func (mc *messageCache) finish(ctx context.Context) {
+	if err := mc.enforceMaxSize(); err != nil {
+		plugin.Logger(ctx).Error("imap.messageCache.finish", "cache_error", err)
+	}
+}
+
+// removeStaleBodies removes the cached bodies of the mailbox from before its
+// UIDVALIDITY changed.
+func (mc *messageCache) removeStaleBodies() error {
+	entries, err := os.ReadDir(mc.mailboxDir())
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	current := filepath.Base(mc.bodyDir())
+	for _, e := range entries {
+		if e.Name() != current {
+			if err := os.RemoveAll(filepath.Join(mc.mailboxDir(), e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (mc *messageCache) load() (*cachedMailbox, error) {
+	data, err := mc.readFile(mc.statePath())
+	if err != nil {
+		return nil, err
+	}
+	state := &cachedMailbox{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Messages == nil {
+		state.Messages = map[uint32]*cachedMessage{}
+	}
+	return state, nil
+}
+
+// body returns the cached body of the message, if there is one.
+func (mc *messageCache) body(uid uint32) ([]byte, bool) {
+	if !mc.bodies {
+		return nil, false
+	}
+	data, err := mc.readFile(mc.bodyPath(uid))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// putBody caches the body of the message if bodies are being cached.
+func (mc *messageCache) putBody(uid uint32, body []byte) error {
+	if !mc.bodies {
+		return nil
+	}
+	if err := os.MkdirAll(mc.bodyDir(), 0700); err != nil {
+		return err
+	}
+	return mc.writeFile(mc.bodyPath(uid), body)
+}
+
+func (mc *messageCache) statePath() string {
+	return filepath.Join(mc.dir, mc.key+".json")
+}
+
+// mailboxDir holds the cached bodies of the mailbox, in a directory for
+// each UIDVALIDITY.
+func (mc *messageCache) mailboxDir() string {
+	return filepath.Join(mc.dir, mc.key)
+}
+
+func (mc *messageCache) bodyDir() string {
+	return filepath.Join(mc.mailboxDir(), strconv.FormatUint(uint64(mc.uidValidity), 10))
+}
+
+func (mc *messageCache) bodyPath(uid uint32) string {
+	return filepath.Join(mc.bodyDir(), strconv.FormatUint(uint64(uid), 10)+".eml")
+}
+
+// readFile reads a cache file, decrypting it if cache_encryption_key is set.
+func (mc *messageCache) readFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil || mc.aead == nil {
+		return data, err
+	}
+	size := mc.aead.NonceSize()
+	if len(data) < size {
+		return nil, errors.New("cache file is too short to be encrypted")
+	}
+	return mc.aead.Open(nil, data[:size], data[size:], nil)
+}
+
+// writeFile atomically writes a cache file, encrypting it if
+// cache_encryption_key is set. Each write has its own temporary file, as
+// queries of the same mailbox may write at the same time.
+func (mc *messageCache) writeFile(path string, data []byte) error {
+	if mc.aead != nil {
+		nonce := make([]byte, mc.aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return err
+		}
+		data = mc.aead.Seal(nonce, nonce, data, nil)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// enforceMaxSize removes the least recently written cache files until the
+// cache is within cache_max_size_mb. Bodies are removed before any mailbox
+// metadata.
+func (mc *messageCache) enforceMaxSize() error {
+	if mc.maxSize <= 0 {
+		return nil
+	}
+	type cacheFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+		body    bool
+	}
+	var files []cacheFile
+	var total int64
+	err := filepath.WalkDir(mc.dir, func(path string, e fs.DirEntry, err error) error {
+		// Files being written, and the salt, are skipped
+		if err != nil || e.IsDir() || strings.HasSuffix(path, ".tmp") || path == filepath.Join(mc.dir, cacheSaltFile) {
+			return err
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, cacheFile{path, info.Size(), info.ModTime(), strings.HasSuffix(path, ".eml")})
+		total += info.Size()
+		return nil
+	})
+	if err != nil || total <= mc.maxSize {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].body != files[j].body {
+			return files[i].body
+		}
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, f := range files {
+		// Never remove the mailbox currently in use
+		if f.path == mc.statePath() {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			return err
+		}
+		total -= f.size
+		if total <= mc.maxSize {
+			break
+		}
+	}
+	return nil
+}
+
+func newCachedMessage(msg *imap.Message) *cachedMessage {
+	cm := &cachedMessage{
+		Uid:          msg.Uid,
+		Flags:        msg.Flags,
+		InternalDate: msg.InternalDate,
+		Size:         msg.Size,
+		Envelope:     msg.Envelope,
+		Items:        map[imap.FetchItem]interface{}{},
+	}
+	for _, item := range []imap.FetchItem{gmailLabels, gmailThreadID, gmailMessageID} {
+		if v, ok := msg.Items[item]; ok {
+			cm.Items[item] = cacheableItem(v)
+		}
+	}
+	return cm
+}
+
+// cacheableItem converts a fetched item to plain strings, since it may
+// contain literals that cannot be stored as JSON.
+func cacheableItem(v interface{}) interface{} {
+	if fields, ok := v.([]interface{}); ok {
+		items := make([]interface{}, len(fields))
+		for i, f := range fields {
+			items[i] = cacheableItem(f)
+		}
+		return items
+	}
+	if s, err := imap.ParseString(v); err == nil {
+		return s
+	}
+	return nil
+}
+
+// message rebuilds the fetched message, without its body.
+func (state *cachedMailbox) message(uid uint32) (*imap.Message, bool) {
+	cm, ok := state.Messages[uid]
+	if !ok {
+		return nil, false
+	}
+	msg := &imap.Message{
+		SeqNum:       state.seqNums[uid],
+		Uid:          cm.Uid,
+		Flags:        cm.Flags,
+		InternalDate: cm.InternalDate,
+		Size:         cm.Size,
+		Envelope:     cm.Envelope,
+		Items:        cm.Items,
+	}
+	return msg, true
+}
+
+// calculateSeqNums numbers the cached messages in UID order, which matches
+// the mailbox once it has been synced.
+func (state *cachedMailbox) calculateSeqNums() {
+	uids := make([]uint32, 0, len(state.Messages))
+	for uid := range state.Messages {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	state.seqNums = make(map[uint32]uint32, len(uids))
+	for i, uid := range uids {
+		state.seqNums[uid] = uint32(i + 1)
+	}
+}
+
+func missingUids(state *cachedMailbox, uids []uint32) []uint32 {
+	present := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		present[uid] = true
+	}
+	var missing []uint32
+	for uid := range state.Messages {
+		if !present[uid] {
+			missing = append(missing, uid)
+		}
+	}
+	return missing
+}
+
+// vanishedUids returns the UIDs of the cached messages in a VANISHED set.
+// Servers may report ranges as wide as 1:4294967295, so the set is only
+// tested against the cached UIDs.
+func vanishedUids(state *cachedMailbox, set *imap.SeqSet) []uint32 {
+	if set == nil {
+		return nil
+	}
+	var vanished []uint32
+	for uid := range state.Messages {
+		if set.Contains(uid) {
+			vanished = append(vanished, uid)
+		}
+	}
+	return vanished
+}
+
+// changedSinceFetch is a UID FETCH command, with the CHANGEDSINCE and
+// VANISHED modifiers from RFC 7162 if ModSeq is set.
+type changedSinceFetch struct {
+	commands.Fetch
+	ModSeq   uint64
+	Vanished bool
+}
+
+func (cmd *changedSinceFetch) Command() *imap.Command {
+	fetch := cmd.Fetch.Command()
+	if cmd.ModSeq > 0 {
+		modifiers := []interface{}{imap.RawString("CHANGEDSINCE"), imap.RawString(strconv.FormatUint(cmd.ModSeq, 10))}
+		if cmd.Vanished {
+			modifiers = append(modifiers, imap.RawString("VANISHED"))
+		}
+		fetch.Arguments = append(fetch.Arguments, modifiers)
+	}
+	return fetch
+}
+
+// execute runs the fetch, returning the fetched messages and the UIDs
+// reported as VANISHED, or nil if there were none.
+func (cmd *changedSinceFetch) execute(c *client.Client) ([]*imap.Message, *imap.SeqSet, error) {
+	messages := make(chan *imap.Message)
+	res := &vanishedResponse{Fetch: responses.Fetch{Messages: messages, SeqSet: cmd.SeqSet, Uid: true}}
+	var list []*imap.Message
+	done := make(chan struct{})
+	go func() {
+		for msg := range messages {
+			list = append(list, msg)
+		}
+		close(done)
+	}()
+	status, err := c.Execute(&commands.Uid{Cmd: cmd}, res)
+	close(messages)
+	<-done
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, nil, err
+	}
+	return list, res.Vanished, nil
+}
+
+// vanishedResponse handles FETCH responses along with the VANISHED responses
+// from RFC 7162, e.g. * VANISHED (EARLIER) 41,43:116.
+type vanishedResponse struct {
+	responses.Fetch
+	Vanished *imap.SeqSet
+}
+
+func (r *vanishedResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "VANISHED" {
+		return r.Fetch.Handle(resp)
+	}
+	if len(fields) > 0 {
+		if _, earlier := fields[0].([]interface{}); earlier {
+			fields = fields[1:]
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	set, _ := fields[0].(string)
+	seqset, err := imap.ParseSeqSet(set)
+	if err != nil {
+		return err
+	}
+	if r.Vanished == nil {
+		r.Vanished = new(imap.SeqSet)
+	}
+	r.Vanished.AddSet(seqset)
+	return nil
+}
@@ -0,0 +1,39 @@
+package imap
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestVanishedUids(t *testing.T) {
+	state := &cachedMailbox{Messages: map[uint32]*cachedMessage{}}
+	for _, uid := range []uint32{3, 41, 43, 100, 4294967295} {
+		state.Messages[uid] = &cachedMessage{}
+	}
+	tests := []struct {
+		set  string
+		want []uint32
+	}{
+		{"41,43:116", []uint32{41, 43, 100}},
+		{"1:4294967295", []uint32{3, 41, 43, 100, 4294967295}},
+		{"200:*", []uint32{4294967295}},
+		{"1,2,42", nil},
+	}
+	for _, tt := range tests {
+		set, err := imap.ParseSeqSet(tt.set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := vanishedUids(state, set)
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("vanishedUids(%s) = %v, want %v", tt.set, got, tt.want)
+		}
+	}
+	if got := vanishedUids(state, nil); got != nil {
+		t.Errorf("vanishedUids(nil) = %v, want nil", got)
+	}
+}
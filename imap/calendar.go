@@ -0,0 +1,507 @@
+package imap
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// icalProperty is a content line of an iCalendar object, see RFC 5545
+// section 3.1, e.g. DTSTART;TZID=Europe/Berlin:20240301T100000.
+type icalProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// icalComponent is a block between BEGIN and END lines, e.g. VEVENT.
+type icalComponent struct {
+	Name       string
+	Properties []icalProperty
+	Components []*icalComponent
+}
+
+// property returns the first property with the name, or nil.
+func (c *icalComponent) property(name string) *icalProperty {
+	for i := range c.Properties {
+		if c.Properties[i].Name == name {
+			return &c.Properties[i]
+		}
+	}
+	return nil
+}
+
+// value returns the raw value of the first property with the name.
+func (c *icalComponent) value(name string) string {
+	if p := c.property(name); p != nil {
+		return p.Value
+	}
+	return ""
+}
+
+// text returns the value of a TEXT property, without its escapes.
+func (c *icalComponent) text(name string) string {
+	return unescapeICalText(c.value(name))
+}
+
+// parseICalendar returns the top level components, usually a single
+// VCALENDAR, of an iCalendar object. Lines that can't be parsed are skipped.
+func parseICalendar(data string) []*icalComponent {
+	var top []*icalComponent
+	var stack []*icalComponent
+	for _, line := range unfoldICalLines(data) {
+		p, ok := parseICalLine(line)
+		if !ok {
+			continue
+		}
+		switch p.Name {
+		case "BEGIN":
+			c := &icalComponent{Name: strings.ToUpper(p.Value)}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Components = append(parent.Components, c)
+			} else {
+				top = append(top, c)
+			}
+			stack = append(stack, c)
+		case "END":
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		default:
+			if len(stack) > 0 {
+				c := stack[len(stack)-1]
+				c.Properties = append(c.Properties, p)
+			}
+		}
+	}
+	return top
+}
+
+// unfoldICalLines splits an iCalendar object into lines, joining the lines
+// that continue with a space or tab.
+func unfoldICalLines(data string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// parseICalLine parses a content line, name *(";" param) ":" value, where
+// parameter values may be quoted.
+func parseICalLine(line string) (icalProperty, bool) {
+	p := icalProperty{Params: map[string]string{}}
+	i := strings.IndexAny(line, ";:")
+	if i <= 0 {
+		return p, false
+	}
+	p.Name = strings.ToUpper(line[:i])
+	for line[i] == ';' {
+		line = line[i+1:]
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return p, false
+		}
+		name := strings.ToUpper(line[:eq])
+		// The parameter value ends at the first ; or : outside quotes
+		j, quoted := eq+1, false
+		for ; j < len(line); j++ {
+			if line[j] == '"' {
+				quoted = !quoted
+			} else if !quoted && (line[j] == ';' || line[j] == ':') {
+				break
+			}
+		}
+		if j == len(line) {
+			return p, false
+		}
+		p.Params[name] = strings.ReplaceAll(line[eq+1:j], `"`, "")
+		i = j
+		if line[i] == ':' {
+			break
+		}
+		line = line[i:]
+		i = 0
+	}
+	p.Value = line[i+1:]
+	return p, true
+}
+
+// unescapeICalText removes the backslash escapes of a TEXT value.
+func unescapeICalText(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 'n', 'N':
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// calendarEvent is a VEVENT of an invitation, reply or cancellation, see
+// iTIP (RFC 5546).
+type calendarEvent struct {
+	Method        string
+	UID           string
+	Sequence      int64
+	Summary       string
+	Description   string
+	Location      string
+	Status        string
+	Start         time.Time
+	StartTimeZone string
+	End           time.Time
+	EndTimeZone   string
+	AllDay        bool
+	RRule         string
+	RecurrenceID  time.Time
+	Organizer     string
+	OrganizerName string
+	Attendees     []calendarAttendee
+	// PartStat is the answer of the attendee sending a REPLY
+	PartStat string
+}
+
+type calendarAttendee struct {
+	Email    string `json:"email"`
+	Name     string `json:"name,omitempty"`
+	Role     string `json:"role,omitempty"`
+	PartStat string `json:"partstat,omitempty"`
+	RSVP     bool   `json:"rsvp,omitempty"`
+}
+
+// calendarEvents returns the events of the text/calendar parts and .ics
+// attachments of a message. Clients often attach the same invitation both
+// inline and as a file, so duplicates are skipped.
+func calendarEvents(env *enmime.Envelope) []calendarEvent {
+	if env == nil || env.Root == nil {
+		return nil
+	}
+	var events []calendarEvent
+	seen := map[string]bool{}
+	for _, part := range env.Root.DepthMatchAll(func(p *enmime.Part) bool { return p.FirstChild == nil }) {
+		contentType := strings.ToLower(part.ContentType)
+		if contentType != "text/calendar" && contentType != "application/ics" && !strings.HasSuffix(strings.ToLower(part.FileName), ".ics") {
+			continue
+		}
+		for _, cal := range parseICalendar(string(part.Content)) {
+			if cal.Name != "VCALENDAR" {
+				continue
+			}
+			for _, e := range parseCalendar(cal) {
+				key := strings.Join([]string{e.Method, e.UID, strconv.FormatInt(e.Sequence, 10), e.RecurrenceID.String(), e.Start.String()}, "\x00")
+				if !seen[key] {
+					seen[key] = true
+					events = append(events, e)
+				}
+			}
+		}
+	}
+	return events
+}
+
+// parseCalendar returns the events of a VCALENDAR.
+func parseCalendar(cal *icalComponent) []calendarEvent {
+	zones := map[string]*icalComponent{}
+	for _, c := range cal.Components {
+		if c.Name == "VTIMEZONE" {
+			zones[c.value("TZID")] = c
+		}
+	}
+	method := strings.ToUpper(cal.value("METHOD"))
+
+	var events []calendarEvent
+	for _, c := range cal.Components {
+		if c.Name != "VEVENT" {
+			continue
+		}
+		e := calendarEvent{
+			Method:      method,
+			UID:         c.value("UID"),
+			Summary:     c.text("SUMMARY"),
+			Description: c.text("DESCRIPTION"),
+			Location:    c.text("LOCATION"),
+			Status:      strings.ToUpper(c.value("STATUS")),
+			RRule:       c.value("RRULE"),
+		}
+		e.Sequence, _ = strconv.ParseInt(strings.TrimSpace(c.value("SEQUENCE")), 10, 64)
+		if p := c.property("DTSTART"); p != nil {
+			e.Start, e.AllDay = icalTime(p, zones)
+			e.StartTimeZone = p.Params["TZID"]
+		}
+		if p := c.property("DTEND"); p != nil {
+			e.End, _ = icalTime(p, zones)
+			e.EndTimeZone = p.Params["TZID"]
+		} else if d, ok := parseICalDuration(c.value("DURATION")); ok && !e.Start.IsZero() {
+			e.End, e.EndTimeZone = e.Start.Add(d), e.StartTimeZone
+		}
+		if p := c.property("RECURRENCE-ID"); p != nil {
+			e.RecurrenceID, _ = icalTime(p, zones)
+		}
+		if p := c.property("ORGANIZER"); p != nil {
+			e.Organizer, e.OrganizerName = calendarAddress(p.Value), p.Params["CN"]
+		}
+		for _, p := range c.Properties {
+			if p.Name != "ATTENDEE" {
+				continue
+			}
+			e.Attendees = append(e.Attendees, calendarAttendee{
+				Email:    calendarAddress(p.Value),
+				Name:     p.Params["CN"],
+				Role:     strings.ToUpper(p.Params["ROLE"]),
+				PartStat: strings.ToUpper(p.Params["PARTSTAT"]),
+				RSVP:     strings.EqualFold(p.Params["RSVP"], "TRUE"),
+			})
+		}
+		if method == "REPLY" && len(e.Attendees) > 0 {
+			e.PartStat = e.Attendees[0].PartStat
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// calendarAddress returns the email address of a CAL-ADDRESS value, e.g.
+// mailto:bob@example.org.
+func calendarAddress(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > 7 && strings.EqualFold(s[:7], "mailto:") {
+		s = s[7:]
+	}
+	return strings.ToLower(s)
+}
+
+// icalTime parses a DATE or DATE-TIME property, in UTC, in its TZID time
+// zone, or else as floating time in UTC. It returns true for a DATE.
+func icalTime(p *icalProperty, zones map[string]*icalComponent) (time.Time, bool) {
+	value := strings.TrimSpace(p.Value)
+	if len(value) == 8 {
+		t, err := time.Parse("20060102", value)
+		return t, err == nil
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, _ := time.Parse("20060102T150405Z", value)
+		return t, false
+	}
+	wall, err := time.Parse("20060102T150405", value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	tzid := p.Params["TZID"]
+	if tzid == "" {
+		return wall, false
+	}
+	if loc, err := time.LoadLocation(tzid); err == nil {
+		t, _ := time.ParseInLocation("20060102T150405", value, loc)
+		return t, false
+	}
+	// e.g. Outlook's "W. Europe Standard Time", defined by a VTIMEZONE
+	if zone := zones[tzid]; zone != nil {
+		return wall.Add(-vtimezoneOffset(zone, wall)), false
+	}
+	return wall, false
+}
+
+// vtimezoneOffset returns the UTC offset of a VTIMEZONE at a wall clock time,
+// from its STANDARD or DAYLIGHT observance with the latest onset before it.
+func vtimezoneOffset(zone *icalComponent, wall time.Time) time.Duration {
+	var latest time.Time
+	var offset time.Duration
+	for _, obs := range zone.Components {
+		if obs.Name != "STANDARD" && obs.Name != "DAYLIGHT" {
+			continue
+		}
+		to, ok := parseUTCOffset(obs.value("TZOFFSETTO"))
+		if !ok {
+			continue
+		}
+		start, err := time.Parse("20060102T150405", obs.value("DTSTART"))
+		if err != nil {
+			continue
+		}
+		onset := observanceOnset(start, obs.value("RRULE"), wall)
+		if onset.IsZero() || onset.After(wall) {
+			continue
+		}
+		if latest.IsZero() || onset.After(latest) {
+			latest, offset = onset, to
+		}
+	}
+	return offset
+}
+
+// observanceOnset returns the last onset of an observance at or before a
+// wall clock time. Only the yearly rules used for daylight saving time are
+// supported, e.g. FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU.
+func observanceOnset(start time.Time, rrule string, wall time.Time) time.Time {
+	if start.After(wall) {
+		return time.Time{}
+	}
+	rule := map[string]string{}
+	for _, part := range strings.Split(rrule, ";") {
+		if name, value, ok := strings.Cut(part, "="); ok {
+			rule[strings.ToUpper(name)] = strings.ToUpper(value)
+		}
+	}
+	month, err := strconv.Atoi(rule["BYMONTH"])
+	if rule["FREQ"] != "YEARLY" || err != nil || month < 1 || month > 12 {
+		return start
+	}
+	year := wall.Year()
+	if until, ok := rule["UNTIL"]; ok {
+		if t, err := time.Parse("20060102T150405Z", until); err == nil && t.Year() < year {
+			year = t.Year()
+		}
+	}
+	for ; year >= start.Year(); year-- {
+		onset := yearlyOnset(year, time.Month(month), rule["BYDAY"], rule["BYMONTHDAY"], start)
+		if !onset.IsZero() && !onset.After(wall) {
+			return onset
+		}
+	}
+	return start
+}
+
+// yearlyOnset returns the day of the month that a rule's BYDAY, e.g. -1SU
+// for the last Sunday, or BYMONTHDAY picks, at the time of day of start.
+func yearlyOnset(year int, month time.Month, byDay, byMonthDay string, start time.Time) time.Time {
+	at := func(day int) time.Time {
+		return time.Date(year, month, day, start.Hour(), start.Minute(), start.Second(), 0, time.UTC)
+	}
+	days := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	if byDay == "" {
+		if d, err := strconv.Atoi(byMonthDay); err == nil && d >= 1 && d <= days {
+			return at(d)
+		}
+		return at(start.Day())
+	}
+	if len(byDay) < 2 {
+		return time.Time{}
+	}
+	weekday, ok := icalWeekdays[byDay[len(byDay)-2:]]
+	if !ok {
+		return time.Time{}
+	}
+	n, _ := strconv.Atoi(byDay[:len(byDay)-2])
+	switch {
+	case n > 0:
+		first := 1 + (int(weekday)-int(at(1).Weekday())+7)%7
+		if d := first + (n-1)*7; d <= days {
+			return at(d)
+		}
+	case n < 0:
+		last := days - (int(at(days).Weekday())-int(weekday)+7)%7
+		if d := last + (n+1)*7; d >= 1 {
+			return at(d)
+		}
+	default:
+		// e.g. BYMONTHDAY=8,9,10,11,12,13,14;BYDAY=SU for the second Sunday
+		for _, s := range strings.Split(byMonthDay, ",") {
+			if d, err := strconv.Atoi(s); err == nil && d >= 1 && d <= days && at(d).Weekday() == weekday {
+				return at(d)
+			}
+		}
+	}
+	return time.Time{}
+}
+
+var icalWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// parseUTCOffset parses a UTC-OFFSET value, e.g. +0100 or -043000.
+func parseUTCOffset(s string) (time.Duration, bool) {
+	s = strings.TrimSpace(s)
+	if len(s) != 5 && len(s) != 7 || (s[0] != '+' && s[0] != '-') {
+		return 0, false
+	}
+	h, err1 := strconv.Atoi(s[1:3])
+	m, err2 := strconv.Atoi(s[3:5])
+	sec := 0
+	var err3 error
+	if len(s) == 7 {
+		sec, err3 = strconv.Atoi(s[5:7])
+	}
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, false
+	}
+	d := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second
+	if s[0] == '-' {
+		d = -d
+	}
+	return d, true
+}
+
+// parseICalDuration parses a DURATION value, e.g. PT1H30M or P1D.
+func parseICalDuration(s string) (time.Duration, bool) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	sign := time.Duration(1)
+	if s != "" && (s[0] == '+' || s[0] == '-') {
+		if s[0] == '-' {
+			sign = -1
+		}
+		s = s[1:]
+	}
+	if !strings.HasPrefix(s, "P") || len(s) < 3 {
+		return 0, false
+	}
+	var d time.Duration
+	inTime := false
+	n := 0
+	digits := false
+	for _, c := range s[1:] {
+		switch {
+		case c >= '0' && c <= '9':
+			n = n*10 + int(c-'0')
+			digits = true
+			continue
+		case c == 'T':
+			inTime = true
+			continue
+		}
+		if !digits {
+			return 0, false
+		}
+		switch {
+		case c == 'W' && !inTime:
+			d += time.Duration(n) * 7 * 24 * time.Hour
+		case c == 'D' && !inTime:
+			d += time.Duration(n) * 24 * time.Hour
+		case c == 'H' && inTime:
+			d += time.Duration(n) * time.Hour
+		case c == 'M' && inTime:
+			d += time.Duration(n) * time.Minute
+		case c == 'S' && inTime:
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, false
+		}
+		n, digits = 0, false
+	}
+	if digits {
+		return 0, false
+	}
+	return sign * d, true
+}
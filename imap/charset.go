@@ -0,0 +1,175 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gogs/chardet"
+	"github.com/jhillyerd/enmime"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// minDetectConfidence is the chardet confidence needed to try a detected
+// charset. Confidence is low for short strings such as subjects, so detected
+// charsets are only used if they decode with fewer errors, and the declared
+// charset is always tried first.
+const minDetectConfidence = 10
+
+// textDecoder converts the text of a message to UTF-8. enmime already
+// converts body parts from their declared charset, but text is left as it
+// was when the declared charset is wrong or unsupported, or when headers
+// hold raw 8-bit text rather than RFC 2047 encoded words.
+type textDecoder struct {
+	// declared is the charset declared by the first text part
+	declared string
+	// charset is the charset the text was decoded from
+	charset string
+	errors  []string
+}
+
+func newTextDecoder(env *enmime.Envelope) *textDecoder {
+	td := &textDecoder{}
+	if env.Root == nil {
+		return td
+	}
+	p := env.Root.BreadthMatchFirst(func(p *enmime.Part) bool {
+		return strings.HasPrefix(p.ContentType, "text/") && p.Charset != ""
+	})
+	if p != nil {
+		td.declared = strings.ToLower(p.Charset)
+		td.charset = td.declared
+		// enmime switches to a detected charset if the declared one is wrong
+		if p.OrigCharset != "" {
+			td.declared = strings.ToLower(p.OrigCharset)
+		}
+	}
+	return td
+}
+
+// decode returns s as valid UTF-8. Text declared as UTF-8 or US-ASCII, or
+// with no declared charset, keeps its valid UTF-8 and has just the invalid
+// bytes replaced, unless most of it is invalid. Otherwise it is decoded from
+// the declared charset, or else a detected one, keeping whichever replaces
+// the fewest bytes. Bytes that are invalid in every charset are replaced
+// with U+FFFD, and recorded as errors against the field.
+func (td *textDecoder) decode(field, s string) string {
+	// 7-bit charsets such as ISO-2022-JP are valid UTF-8, but switch
+	// character sets with escape sequences
+	escapes := strings.Count(s, "\x1b")
+	if utf8.ValidString(s) && escapes == 0 {
+		return s
+	}
+
+	best, bestCharset, bestErrors := replaceInvalidUTF8(s)
+	if escapes > 0 || !td.declaresUTF8() || mostlyInvalid(s, bestErrors) {
+		// Escape sequences left in the text count against a charset
+		score := bestErrors + escapes
+		for _, name := range td.candidates(s) {
+			enc, canonical := lookupCharset(name)
+			if enc == nil {
+				continue
+			}
+			decoded, err := enc.NewDecoder().String(s)
+			if err != nil || !utf8.ValidString(decoded) {
+				continue
+			}
+			// Decoders replace invalid sequences with U+FFFD
+			n := strings.Count(decoded, string(utf8.RuneError)) - strings.Count(strings.ToValidUTF8(s, ""), string(utf8.RuneError))
+			if n+strings.Count(decoded, "\x1b") < score {
+				best, bestCharset, bestErrors = decoded, canonical, n
+				score = n + strings.Count(decoded, "\x1b")
+			}
+			if score == 0 {
+				break
+			}
+		}
+	}
+
+	if bestCharset != "utf-8" && (td.charset == "" || td.charset == "utf-8" || td.charset == "us-ascii") {
+		td.charset = bestCharset
+	}
+	if bestErrors > 0 {
+		td.errors = append(td.errors, fmt.Sprintf("%s: replaced %d invalid %s sequences", field, bestErrors, bestCharset))
+	}
+	return best
+}
+
+// declaresUTF8 reports whether the message declares its text as UTF-8 or
+// US-ASCII, or declares no charset.
+func (td *textDecoder) declaresUTF8() bool {
+	switch td.declared {
+	case "", "utf-8", "utf8", "us-ascii":
+		return true
+	}
+	return false
+}
+
+// mostlyInvalid reports whether at least half of the non-ASCII bytes of s
+// are invalid UTF-8, given the number of invalid bytes.
+func mostlyInvalid(s string, invalid int) bool {
+	nonASCII := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			nonASCII++
+		}
+	}
+	return invalid*2 >= nonASCII
+}
+
+// candidates returns the charsets to try decoding s from.
+func (td *textDecoder) candidates(s string) []string {
+	var names []string
+	if td.declared != "" {
+		names = append(names, td.declared)
+	}
+	if td.charset != "" && td.charset != td.declared {
+		names = append(names, td.charset)
+	}
+	results, _ := chardet.NewTextDetector().DetectAll([]byte(s))
+	for _, r := range results {
+		if r.Confidence >= minDetectConfidence {
+			names = append(names, r.Charset)
+		}
+	}
+	return names
+}
+
+// lookupCharset returns the encoding for a charset name or alias, and its
+// canonical name. UTF-8 is not returned, as text that is not valid UTF-8
+// cannot be decoded from it. US-ASCII is an alias of windows-1252.
+func lookupCharset(name string) (encoding.Encoding, string) {
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		// e.g. chardet's GB-18030
+		if enc, err = ianaindex.IANA.Encoding(strings.ReplaceAll(name, "-", "")); err != nil || enc == nil {
+			return nil, ""
+		}
+	}
+	canonical, err := htmlindex.Name(enc)
+	if err != nil {
+		canonical = strings.ToLower(name)
+	}
+	if canonical == "utf-8" {
+		return nil, ""
+	}
+	return enc, canonical
+}
+
+// replaceInvalidUTF8 replaces each invalid byte of s with U+FFFD, and
+// returns the result as decoded from utf-8, and the number replaced.
+func replaceInvalidUTF8(s string) (string, string, int) {
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			n++
+		}
+		b.WriteRune(r)
+		i += size
+	}
+	return b.String(), "utf-8", n
+}
@@ -0,0 +1,77 @@
+package imap
+
+import "testing"
+
+func TestTextDecoderDecode(t *testing.T) {
+	tests := []struct {
+		name        string
+		declared    string
+		in          string
+		want        string
+		wantCharset string
+		wantErrors  int
+	}{
+		{
+			name:        "valid UTF-8",
+			declared:    "utf-8",
+			in:          "Grüße",
+			want:        "Grüße",
+			wantCharset: "utf-8",
+		},
+		{
+			name:        "windows-1252",
+			declared:    "windows-1252",
+			in:          "Caf\xe9 \x93menu\x94",
+			want:        "Café “menu”",
+			wantCharset: "windows-1252",
+		},
+		{
+			name:        "GB2312",
+			declared:    "gb2312",
+			in:          "\xd6\xd0\xce\xc4",
+			want:        "中文",
+			wantCharset: "gb2312",
+		},
+		{
+			name:        "ISO-2022-JP",
+			declared:    "iso-2022-jp",
+			in:          "\x1b$B$3$s$K$A$O\x1b(B",
+			want:        "こんにちは",
+			wantCharset: "iso-2022-jp",
+		},
+		{
+			name:        "undeclared ISO-2022-JP",
+			in:          "\x1b$B$3$s$K$A$O\x1b(B",
+			want:        "こんにちは",
+			wantCharset: "iso-2022-jp",
+		},
+		{
+			name:        "UTF-8 plus one bad byte",
+			declared:    "utf-8",
+			in:          "Grüße \xff aus München",
+			want:        "Grüße � aus München",
+			wantCharset: "utf-8",
+			wantErrors:  1,
+		},
+		{
+			name:       "undeclared UTF-8 plus one bad byte",
+			in:         "Grüße \xff aus München",
+			want:       "Grüße � aus München",
+			wantErrors: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			td := &textDecoder{declared: tt.declared, charset: tt.declared}
+			if got := td.decode("subject", tt.in); got != tt.want {
+				t.Errorf("decode(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if td.charset != tt.wantCharset {
+				t.Errorf("charset = %q, want %q", td.charset, tt.wantCharset)
+			}
+			if len(td.errors) != tt.wantErrors {
+				t.Errorf("errors = %q, want %d", td.errors, tt.wantErrors)
+			}
+		})
+	}
+}
@@ -5,13 +5,35 @@ import (
 )
 
 type imapConfig struct {
-	Host               *string `hcl:"host"`
-	Port               *int    `hcl:"port"`
-	Login              *string `hcl:"login"`
-	Password           *string `hcl:"password"`
-	TLSEnabled         *bool   `hcl:"tls_enabled"`
-	InsecureSkipVerify *bool   `hcl:"insecure_skip_verify"`
-	Mailbox            *string `hcl:"mailbox"`
+	Host                *string `hcl:"host"`
+	Port                *int    `hcl:"port"`
+	Login               *string `hcl:"login"`
+	Password            *string `hcl:"password"`
+	TLSEnabled          *bool   `hcl:"tls_enabled"`
+	InsecureSkipVerify  *bool   `hcl:"insecure_skip_verify"`
+	Mailbox             *string `hcl:"mailbox"`
+	SearchTimezone      *string `hcl:"search_timezone"`
+	CachePath           *string `hcl:"cache_path"`
+	CacheBodies         *bool   `hcl:"cache_bodies"`
+	CacheMaxSizeMB      *int    `hcl:"cache_max_size_mb"`
+	CacheEncryptionKey  *string `hcl:"cache_encryption_key"`
+	Backend             *string `hcl:"backend"`
+	Path                *string `hcl:"path"`
+	MboxFormat          *string `hcl:"mbox_format"`
+	EmlPath             *string `hcl:"eml_path"`
+	JMAPSessionURL      *string `hcl:"jmap_session_url"`
+	JMAPToken           *string `hcl:"jmap_token"`
+	TranscriptPath      *string `hcl:"transcript_path"`
+	MIMEParsing         *string `hcl:"mime_parsing"`
+	RawMessageMaxSizeMB *int    `hcl:"raw_message_max_size_mb"`
+	AuthservID          *string `hcl:"authserv_id"`
+	DKIMResolver        *string `hcl:"dkim_resolver"`
+	DKIMKeyFile         *string `hcl:"dkim_key_file"`
+	SMIMECAFile         *string `hcl:"smime_ca_file"`
+	PGPKeyringFile      *string `hcl:"pgp_keyring_file"`
+	DMARCReportMailbox  *string `hcl:"dmarc_report_mailbox"`
+	TLSReportMailbox    *string `hcl:"tls_report_mailbox"`
+	BounceMailbox       *string `hcl:"bounce_mailbox"`
 }
 
 func ConfigInstance() interface{} {
@@ -0,0 +1,777 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+)
+
+// DKIM signatures (RFC 6376) and ARC chains (RFC 8617) are verified here,
+// rather than trusting the Authentication-Results of the receiving server.
+// ARC signatures are DKIM signatures with different header fields, so both
+// share the canonicalization and public key lookup.
+
+// Header fields of DKIM signatures and ARC sets
+const (
+	dkimSignatureHeader = "DKIM-Signature"
+	arcSealHeader       = "ARC-Seal"
+	arcMessageSigHeader = "ARC-Message-Signature"
+)
+
+const (
+	// maxDKIMSignatures limits the signatures verified for each message
+	maxDKIMSignatures = 10
+	// maxARCInstances is the longest ARC chain allowed by RFC 8617
+	maxARCInstances = 50
+	// dkimLookupTimeout limits each DNS lookup of a public key
+	dkimLookupTimeout = 10 * time.Second
+	// dkimKeyCacheTTL is how long public keys from DNS are reused
+	dkimKeyCacheTTL = 10 * time.Minute
+)
+
+// dkimKeyResolver returns the TXT records published for a public key, e.g.
+// for selector._domainkey.example.com.
+type dkimKeyResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+var dkimKeyResolvers sync.Map // dkim_key_file or dkim_resolver -> dkimKeyResolver
+
+// newDKIMKeyResolver returns the key resolver of the connection: the static
+// dkim_key_file if configured, or else DNS through dkim_resolver or the
+// system resolver. Resolvers are shared, so keys are only read once.
+func newDKIMKeyResolver(d *plugin.QueryData) (dkimKeyResolver, error) {
+	imapConfig := GetConfig(d.Connection)
+	if imapConfig.DKIMKeyFile != nil && *imapConfig.DKIMKeyFile != "" {
+		path, err := expandHome(*imapConfig.DKIMKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if r, ok := dkimKeyResolvers.Load("file:" + path); ok {
+			return r.(dkimKeyResolver), nil
+		}
+		r, err := readDKIMKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		v, _ := dkimKeyResolvers.LoadOrStore("file:"+path, r)
+		return v.(dkimKeyResolver), nil
+	}
+
+	address := ""
+	if imapConfig.DKIMResolver != nil {
+		address = *imapConfig.DKIMResolver
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, "53")
+		}
+	}
+	v, _ := dkimKeyResolvers.LoadOrStore("dns:"+address, newDNSKeyResolver(address))
+	return v.(dkimKeyResolver), nil
+}
+
+// dnsKeyResolver looks up public keys in DNS, caching the results.
+type dnsKeyResolver struct {
+	resolver *net.Resolver
+	cache    sync.Map // name -> dnsKeyResult
+}
+
+type dnsKeyResult struct {
+	records []string
+	err     error
+	expires time.Time
+}
+
+func newDNSKeyResolver(address string) *dnsKeyResolver {
+	r := &dnsKeyResolver{resolver: net.DefaultResolver}
+	if address != "" {
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, address)
+			},
+		}
+	}
+	return r
+}
+
+func (r *dnsKeyResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if v, ok := r.cache.Load(name); ok && time.Now().Before(v.(dnsKeyResult).expires) {
+		return v.(dnsKeyResult).records, v.(dnsKeyResult).err
+	}
+	ctx, cancel := context.WithTimeout(ctx, dkimLookupTimeout)
+	defer cancel()
+	records, err := r.resolver.LookupTXT(ctx, name)
+	var dnsErr *net.DNSError
+	if err != nil && (!errors.As(err, &dnsErr) || !dnsErr.IsNotFound) {
+		// Don't cache temporary failures
+		return nil, err
+	}
+	r.cache.Store(name, dnsKeyResult{records: records, err: err, expires: time.Now().Add(dkimKeyCacheTTL)})
+	return records, err
+}
+
+// fileKeyResolver returns the public keys of a static key file, which has a
+// line for each key record, as either
+//
+//	selector._domainkey.example.com v=DKIM1; k=rsa; p=MIIBIjANBg...
+//	selector._domainkey.example.com. 3600 IN TXT "v=DKIM1; k=rsa; " "p=MIIBIjANBg..."
+//
+// Blank lines, and lines starting with # or ;, are ignored.
+type fileKeyResolver struct {
+	records map[string][]string
+}
+
+func readDKIMKeyFile(path string) (*fileKeyResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read dkim_key_file: %w", err)
+	}
+	defer f.Close()
+
+	r := &fileKeyResolver{records: map[string][]string{}}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		name, record, ok := strings.Cut(line, " ")
+		if !ok {
+			name, record, ok = strings.Cut(line, "\t")
+		}
+		if !ok {
+			return nil, fmt.Errorf("dkim_key_file line %d: expected a name and a record", n)
+		}
+		// Skip the TTL, class and type of zone file records
+		fields := strings.Fields(record)
+		for len(fields) > 1 {
+			if _, err := strconv.Atoi(fields[0]); err == nil || strings.EqualFold(fields[0], "IN") || strings.EqualFold(fields[0], "TXT") {
+				record = strings.TrimSpace(record[strings.Index(record, fields[0])+len(fields[0]):])
+				fields = fields[1:]
+				continue
+			}
+			break
+		}
+		// Quoted character strings are joined, as in DNS
+		if strings.HasPrefix(record, `"`) {
+			var b strings.Builder
+			for _, s := range splitAuthResults(record, isSpace) {
+				b.WriteString(unquote(s))
+			}
+			record = b.String()
+		}
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		r.records[name] = append(r.records[name], record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read dkim_key_file: %w", err)
+	}
+	return r, nil
+}
+
+func (r *fileKeyResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	records, ok := r.records[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("no key for %s in dkim_key_file", name)
+	}
+	return records, nil
+}
+
+// messageSignatures holds the results of verifying the signatures of a
+// message. Results are nil if the message has no signatures to verify.
+type messageSignatures struct {
+	DKIMVerified  *bool
+	DKIMDomains   []string
+	ARCChainValid *bool
+	// Errors explain why signatures did not verify
+	Errors []string
+}
+
+// dkimVerifier verifies the signatures of a message.
+type dkimVerifier struct {
+	resolver dkimKeyResolver
+	// at is the time the message was received, which signatures must not
+	// have expired by
+	at     time.Time
+	fields []rawHeaderField
+	body   []byte
+	// bodies caches the canonical bodies, by whether they are relaxed
+	bodies map[bool][]byte
+	// bodyHashes caches the body hashes by canonicalization and length
+	bodyHashes map[string][]byte
+}
+
+// rawHeaderField is a header field as sent, including its folding and the
+// CRLF that ends it.
+type rawHeaderField struct {
+	Name string
+	Raw  string
+}
+
+// verifySignatures verifies the DKIM signatures and ARC chain of a message.
+func verifySignatures(ctx context.Context, resolver dkimKeyResolver, raw []byte, at time.Time) messageSignatures {
+	header, body := splitMessage(toCRLF(raw))
+	v := &dkimVerifier{
+		resolver:   resolver,
+		at:         at,
+		fields:     readRawHeaderFields(header),
+		body:       body,
+		bodies:     map[bool][]byte{},
+		bodyHashes: map[string][]byte{},
+	}
+
+	var result messageSignatures
+	n := 0
+	for _, f := range v.fields {
+		if !strings.EqualFold(f.Name, dkimSignatureHeader) {
+			continue
+		}
+		if n++; n > maxDKIMSignatures {
+			break
+		}
+		verified := false
+		domain, err := v.verifyDKIM(ctx, f)
+		if err == nil {
+			verified = true
+			if !containsString(result.DKIMDomains, domain) {
+				result.DKIMDomains = append(result.DKIMDomains, domain)
+			}
+		} else {
+			result.Errors = append(result.Errors, fmt.Sprintf("dkim: %s", err))
+		}
+		if result.DKIMVerified == nil || verified {
+			result.DKIMVerified = &verified
+		}
+	}
+
+	valid, err := v.verifyARC(ctx)
+	if err != nil {
+		result.Errors = append(result.Errors, fmt.Sprintf("arc: %s", err))
+	}
+	result.ARCChainValid = valid
+	return result
+}
+
+// verifyDKIM verifies a DKIM-Signature field, returning its signing domain.
+func (v *dkimVerifier) verifyDKIM(ctx context.Context, sig rawHeaderField) (string, error) {
+	tags, err := parseTagList(fieldValue(sig.Raw))
+	if err != nil {
+		return "", err
+	}
+	domain := strings.ToLower(stripSpace(tags["d"]))
+	if tags["v"] != "1" {
+		return domain, errors.New("unsupported version")
+	}
+	for _, tag := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[tag]; !ok {
+			return domain, fmt.Errorf("missing %s= tag", tag)
+		}
+	}
+	if i, ok := tags["i"]; ok {
+		auid := strings.ToLower(stripSpace(i))
+		if !strings.HasSuffix(auid, "@"+domain) && !strings.HasSuffix(auid, "."+domain) {
+			return domain, errors.New("i= is not in the d= domain")
+		}
+	}
+	if !hasFoldedString(signedHeaderNames(tags["h"]), "from") {
+		return domain, errors.New("From is not signed")
+	}
+	if x, ok := tags["x"]; ok {
+		expires, err := strconv.ParseInt(stripSpace(x), 10, 64)
+		if err != nil {
+			return domain, errors.New("malformed x= tag")
+		}
+		if v.at.After(time.Unix(expires, 0)) {
+			return domain, errors.New("signature had expired when the message was received")
+		}
+	}
+	return domain, v.verifySignature(ctx, sig, tags)
+}
+
+// verifySignature verifies a DKIM-Signature or ARC-Message-Signature: the
+// body hash, then the signature of the signed header fields.
+func (v *dkimVerifier) verifySignature(ctx context.Context, sig rawHeaderField, tags map[string]string) error {
+	headerCanon, bodyCanon, err := parseCanonicalization(tags["c"])
+	if err != nil {
+		return err
+	}
+	length := -1
+	if l, ok := tags["l"]; ok {
+		if length, err = strconv.Atoi(stripSpace(l)); err != nil || length < 0 {
+			return errors.New("malformed l= tag")
+		}
+	}
+	bh, err := base64.StdEncoding.DecodeString(stripSpace(tags["bh"]))
+	if err != nil {
+		return errors.New("malformed bh= tag")
+	}
+	if !bytes.Equal(v.bodyHash(bodyCanon, length), bh) {
+		return errors.New("body hash did not verify")
+	}
+	// Content added after the l= length isn't covered by the signature, and
+	// could be anything, so the message is not treated as verified
+	if length >= 0 && length < len(v.canonicalBody(bodyCanon)) {
+		return fmt.Errorf("body has %d bytes after the l= length", len(v.canonicalBody(bodyCanon))-length)
+	}
+
+	var data bytes.Buffer
+	for _, f := range v.selectFields(signedHeaderNames(tags["h"])) {
+		data.WriteString(canonicalHeader(f.Raw, headerCanon))
+	}
+	data.WriteString(strings.TrimSuffix(canonicalHeader(removeSignatureValue(sig.Raw), headerCanon), "\r\n"))
+	return v.checkSignature(ctx, tags, data.Bytes())
+}
+
+// selectFields returns the header fields for the signed names, taking each
+// name's fields from the bottom up. Names without a field are skipped.
+func (v *dkimVerifier) selectFields(names []string) []rawHeaderField {
+	used := map[int]bool{}
+	var selected []rawHeaderField
+	for _, name := range names {
+		for i := len(v.fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(v.fields[i].Name, name) {
+				used[i] = true
+				selected = append(selected, v.fields[i])
+				break
+			}
+		}
+	}
+	return selected
+}
+
+func (v *dkimVerifier) bodyHash(relaxed bool, length int) []byte {
+	key := fmt.Sprintf("%t/%d", relaxed, length)
+	if h, ok := v.bodyHashes[key]; ok {
+		return h
+	}
+	body := v.canonicalBody(relaxed)
+	if length >= 0 && length < len(body) {
+		body = body[:length]
+	}
+	sum := sha256.Sum256(body)
+	v.bodyHashes[key] = sum[:]
+	return sum[:]
+}
+
+func (v *dkimVerifier) canonicalBody(relaxed bool) []byte {
+	if body, ok := v.bodies[relaxed]; ok {
+		return body
+	}
+	body := canonicalBody(v.body, relaxed)
+	v.bodies[relaxed] = body
+	return body
+}
+
+// checkSignature checks the b= signature of data with the public key of the
+// d= domain and s= selector.
+func (v *dkimVerifier) checkSignature(ctx context.Context, tags map[string]string, data []byte) error {
+	keyAlgo, hashAlgo, _ := strings.Cut(strings.ToLower(stripSpace(tags["a"])), "-")
+	if hashAlgo != "sha256" {
+		// rsa-sha1 must not be used for verifying, see RFC 8301
+		return fmt.Errorf("unsupported algorithm %s", tags["a"])
+	}
+	signature, err := base64.StdEncoding.DecodeString(stripSpace(tags["b"]))
+	if err != nil {
+		return errors.New("malformed b= tag")
+	}
+
+	name := stripSpace(tags["s"]) + "._domainkey." + stripSpace(tags["d"])
+	records, err := v.resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return fmt.Errorf("no key for %s: %w", name, err)
+	}
+	key, err := parseDKIMKey(records, keyAlgo, hashAlgo)
+	if err != nil {
+		return fmt.Errorf("key for %s: %w", name, err)
+	}
+
+	hashed := sha256.Sum256(data)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature); err != nil {
+			return errors.New("signature did not verify")
+		}
+	case ed25519.PublicKey:
+		// Ed25519 signs the SHA-256 hash, see RFC 8463
+		if !ed25519.Verify(key, hashed[:], signature) {
+			return errors.New("signature did not verify")
+		}
+	}
+	return nil
+}
+
+// parseDKIMKey returns the public key of the first usable key record.
+func parseDKIMKey(records []string, keyAlgo, hashAlgo string) (crypto.PublicKey, error) {
+	err := errors.New("no key record")
+	for _, record := range records {
+		tags, tagErr := parseTagList(record)
+		if tagErr != nil {
+			err = tagErr
+			continue
+		}
+		if version, ok := tags["v"]; ok && version != "DKIM1" {
+			err = errors.New("unsupported key version")
+			continue
+		}
+		if h, ok := tags["h"]; ok && !hasFoldedString(signedHeaderNames(h), hashAlgo) {
+			err = fmt.Errorf("key does not allow %s", hashAlgo)
+			continue
+		}
+		k := "rsa"
+		if kt, ok := tags["k"]; ok {
+			k = strings.ToLower(stripSpace(kt))
+		}
+		if k != keyAlgo {
+			err = fmt.Errorf("key is %s, not %s", k, keyAlgo)
+			continue
+		}
+		p := stripSpace(tags["p"])
+		if p == "" {
+			err = errors.New("key has been revoked")
+			continue
+		}
+		der, decodeErr := base64.StdEncoding.DecodeString(p)
+		if decodeErr != nil {
+			err = errors.New("malformed p= tag")
+			continue
+		}
+		switch keyAlgo {
+		case "rsa":
+			pub, parseErr := x509.ParsePKIXPublicKey(der)
+			if parseErr != nil {
+				pub, parseErr = x509.ParsePKCS1PublicKey(der)
+			}
+			rsaKey, ok := pub.(*rsa.PublicKey)
+			if parseErr != nil || !ok {
+				err = errors.New("malformed RSA key")
+				continue
+			}
+			if rsaKey.N.BitLen() < 1024 {
+				err = errors.New("RSA key is shorter than 1024 bits")
+				continue
+			}
+			return rsaKey, nil
+		case "ed25519":
+			if len(der) != ed25519.PublicKeySize {
+				err = errors.New("malformed Ed25519 key")
+				continue
+			}
+			return ed25519.PublicKey(der), nil
+		default:
+			err = fmt.Errorf("unsupported key type %s", keyAlgo)
+		}
+	}
+	return nil, err
+}
+
+// verifyARC validates the ARC chain of a message, see RFC 8617 section 5.2.
+// The result is nil if the message has no ARC sets.
+func (v *dkimVerifier) verifyARC(ctx context.Context) (*bool, error) {
+	type arcSet struct {
+		seal, signature, results *rawHeaderField
+		sealTags                 map[string]string
+	}
+	sets := map[int]*arcSet{}
+	last := 0
+	for i := range v.fields {
+		f := &v.fields[i]
+		var instance string
+		switch {
+		case strings.EqualFold(f.Name, arcSealHeader), strings.EqualFold(f.Name, arcMessageSigHeader):
+			tags, _ := parseTagList(fieldValue(f.Raw))
+			instance = tags["i"]
+		case strings.EqualFold(f.Name, arcAuthResultsHeader):
+			instance, _, _ = strings.Cut(fieldValue(f.Raw), ";")
+			if tag, value, ok := strings.Cut(instance, "="); ok && strings.TrimSpace(tag) == "i" {
+				instance = value
+			}
+		default:
+			continue
+		}
+		n, err := strconv.Atoi(stripSpace(instance))
+		if err != nil || n < 1 || n > maxARCInstances {
+			return failed(), fmt.Errorf("malformed instance in %s", f.Name)
+		}
+		if sets[n] == nil {
+			sets[n] = &arcSet{}
+		}
+		s := sets[n]
+		var slot **rawHeaderField
+		switch {
+		case strings.EqualFold(f.Name, arcSealHeader):
+			slot = &s.seal
+		case strings.EqualFold(f.Name, arcMessageSigHeader):
+			slot = &s.signature
+		default:
+			slot = &s.results
+		}
+		if *slot != nil {
+			return failed(), fmt.Errorf("more than one %s for i=%d", f.Name, n)
+		}
+		*slot = f
+		if n > last {
+			last = n
+		}
+	}
+	if len(sets) == 0 {
+		return nil, nil
+	}
+
+	// Every instance up to the last must have a complete set, sealed with
+	// cv=none for the first and cv=pass for the rest
+	for i := 1; i <= last; i++ {
+		s := sets[i]
+		if s == nil || s.seal == nil || s.signature == nil || s.results == nil {
+			return failed(), fmt.Errorf("incomplete set for i=%d", i)
+		}
+		tags, err := parseTagList(fieldValue(s.seal.Raw))
+		if err != nil {
+			return failed(), fmt.Errorf("seal i=%d: %w", i, err)
+		}
+		s.sealTags = tags
+		want := "pass"
+		if i == 1 {
+			want = "none"
+		}
+		if cv := strings.ToLower(stripSpace(tags["cv"])); cv != want {
+			return failed(), fmt.Errorf("seal i=%d has cv=%s", i, cv)
+		}
+	}
+
+	// Only the latest message signature needs to verify
+	s := sets[last]
+	tags, err := parseTagList(fieldValue(s.signature.Raw))
+	if err != nil {
+		return failed(), fmt.Errorf("message signature i=%d: %w", last, err)
+	}
+	for _, tag := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[tag]; !ok {
+			return failed(), fmt.Errorf("message signature i=%d is missing %s= tag", last, tag)
+		}
+	}
+	if err := v.verifySignature(ctx, *s.signature, tags); err != nil {
+		return failed(), fmt.Errorf("message signature i=%d: %w", last, err)
+	}
+
+	// Each seal signs the sets up to its own, with relaxed canonicalization
+	for i := last; i >= 1; i-- {
+		var data bytes.Buffer
+		for j := 1; j <= i; j++ {
+			data.WriteString(canonicalHeader(sets[j].results.Raw, true))
+			data.WriteString(canonicalHeader(sets[j].signature.Raw, true))
+			if j < i {
+				data.WriteString(canonicalHeader(sets[j].seal.Raw, true))
+			}
+		}
+		data.WriteString(strings.TrimSuffix(canonicalHeader(removeSignatureValue(sets[i].seal.Raw), true), "\r\n"))
+		if err := v.checkSignature(ctx, sets[i].sealTags, data.Bytes()); err != nil {
+			return failed(), fmt.Errorf("seal i=%d: %w", i, err)
+		}
+	}
+	valid := true
+	return &valid, nil
+}
+
+func failed() *bool {
+	valid := false
+	return &valid
+}
+
+// readRawHeaderFields returns the fields of a header section as sent.
+func readRawHeaderFields(header []byte) []rawHeaderField {
+	var fields []rawHeaderField
+	for _, line := range bytes.SplitAfter(header, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].Raw += string(line)
+			continue
+		}
+		name, _, _ := bytes.Cut(line, []byte(":"))
+		fields = append(fields, rawHeaderField{Name: string(bytes.TrimRight(name, " \t")), Raw: string(line)})
+	}
+	return fields
+}
+
+// fieldValue returns the value of a raw header field.
+func fieldValue(raw string) string {
+	_, value, _ := strings.Cut(raw, ":")
+	return value
+}
+
+// parseTagList parses a DKIM tag list, e.g. "v=1; a=rsa-sha256; d=example.com".
+func parseTagList(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(spec, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("malformed tag %q", strings.TrimSpace(spec))
+		}
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicate %s= tag", name)
+		}
+		tags[name] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+func parseCanonicalization(c string) (bool, bool, error) {
+	header, body, _ := strings.Cut(strings.ToLower(stripSpace(c)), "/")
+	relaxed := func(s string) (bool, error) {
+		switch s {
+		case "", "simple":
+			return false, nil
+		case "relaxed":
+			return true, nil
+		}
+		return false, fmt.Errorf("unsupported canonicalization %s", s)
+	}
+	headerRelaxed, err := relaxed(header)
+	if err != nil {
+		return false, false, err
+	}
+	bodyRelaxed, err := relaxed(body)
+	return headerRelaxed, bodyRelaxed, err
+}
+
+// signedHeaderNames splits a colon separated list, e.g. the h= tag.
+func signedHeaderNames(h string) []string {
+	var names []string
+	for _, name := range strings.Split(h, ":") {
+		if name = stripSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// canonicalHeader returns a header field in the simple or relaxed header
+// canonicalization of RFC 6376 section 3.4.
+func canonicalHeader(raw string, relaxed bool) string {
+	if !relaxed {
+		return raw
+	}
+	name, value, _ := strings.Cut(raw, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + strings.Trim(collapseSpace(value), " ") + "\r\n"
+}
+
+// canonicalBody returns a body in the simple or relaxed body
+// canonicalization of RFC 6376 section 3.4.
+func canonicalBody(body []byte, relaxed bool) []byte {
+	if relaxed {
+		lines := strings.Split(string(body), "\r\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(collapseSpace(line), " ")
+		}
+		for len(lines) > 0 && lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		if len(lines) == 0 {
+			return nil
+		}
+		return []byte(strings.Join(lines, "\r\n") + "\r\n")
+	}
+	for bytes.HasSuffix(body, []byte("\r\n\r\n")) {
+		body = body[:len(body)-2]
+	}
+	if !bytes.HasSuffix(body, []byte("\r\n")) {
+		body = append(append([]byte{}, body...), "\r\n"...)
+	}
+	return body
+}
+
+// removeSignatureValue removes the value of the b= tag from a signature
+// field, which is how it was signed.
+func removeSignatureValue(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	specs := strings.Split(value, ";")
+	for i, spec := range specs {
+		tag, _, ok := strings.Cut(spec, "=")
+		if ok && strings.TrimSpace(tag) == "b" {
+			specs[i] = spec[:strings.Index(spec, "=")+1]
+		}
+	}
+	return name + ":" + strings.Join(specs, ";")
+}
+
+// collapseSpace replaces each run of spaces and tabs with a single space.
+func collapseSpace(s string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(s[i])
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// stripSpace removes all whitespace, e.g. the folding of b= values.
+func stripSpace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// toCRLF converts the line endings of a message to CRLF, as local mail
+// files often use LF.
+func toCRLF(b []byte) []byte {
+	if !bytes.Contains(b, []byte("\n")) {
+		return b
+	}
+	return bytes.ReplaceAll(bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+}
+
+func hasFoldedString(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
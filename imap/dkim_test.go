@@ -0,0 +1,340 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// crlf converts the LF line endings of a test message to CRLF.
+func crlf(s string) string {
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+// Keys of the examples in RFC 6376 appendix C and RFC 8463 appendix A. The
+// key of the RFC 8463 RSA signature is left out, so only its Ed25519
+// signature verifies.
+var testDKIMKeys = &fileKeyResolver{records: map[string][]string{
+	"brisbane._domainkey.example.com": {"v=DKIM1; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQ" +
+		"KBgQDwIRP/UC3SBsEmGqZ9ZJW3/DkMoGeLnQg1fWn7/zYt" +
+		"IxN2SnFCjxOCKG9v3b4jYfcTNh5ijSsq631uBItLa7od+v" +
+		"/RtdC2UzJ1lWT947qR+Rcac2gbto/NMqJ0fzfVjH4OuKhi" +
+		"tdY9tf6mcwGjaNBcWToIMmPSPDdQPNUYckcQ2QIDAQAB"},
+	"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+}}
+
+// The signed message of RFC 6376 appendix A.2
+const rfc6376Message = `DKIM-Signature: v=1; a=rsa-sha256; s=brisbane; d=example.com;
+      c=simple/simple; q=dns/txt; i=joe@football.example.com;
+      h=Received : From : To : Subject : Date : Message-ID;
+      bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+      b=AuUoFEfDxTDkHlLXSZEpZj79LICEps6eda7W3deTVFOk4yAUoqOB
+      4nujc7YopdG5dWLSdNg6xNAZpOPr+kHxt1IrE+NahM6L/LbvaHut
+      KVdkLLkpVaVVQPzeRDI009SO2Il5Lu7rDNH6mZckBdrIx0orEtZV
+      4bmp/YzhwvcubU4=;
+Received: from client1.football.example.com  [192.0.2.1]
+      by submitserver.example.com with SUBMISSION;
+      Fri, 11 Jul 2003 21:01:54 -0700 (PDT)
+From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@shopping.example.net>
+Subject: Is dinner ready?
+Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)
+Message-ID: <20030712040037.46341.5F8J@football.example.com>
+
+Hi.
+
+We lost the game. Are you hungry yet?
+
+Joe.
+`
+
+// The message of RFC 8463 appendix A.3, signed with both Ed25519 and RSA
+const rfc8463Message = `DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;
+ d=football.example.com; i=@football.example.com;
+ q=dns/txt; s=brisbane; t=1528637909; h=from : to :
+ subject : date : message-id : from : subject : date;
+ bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+ b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus
+ Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==
+DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed;
+ d=football.example.com; i=@football.example.com;
+ q=dns/txt; s=test; t=1528637909; h=from : to : subject :
+ date : message-id : from : subject : date;
+ bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+ b=F45dVWDfMbQDGHJFlXUNB2HKfbCeLRyhDXgFpEL8GwpsRe0IeIixNTe3
+ DhCVlUrSjV4BwcVcOF6+FF3Zo9Rpo1tFOeS9mPYQTnGdaSGsgeefOsk2Jz
+ dA+L10TeYt9BgDfQNZtKdN1WO//KgIqXP7OdEFE4LjFYNcUxZQ4FADY+8=
+From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@shopping.example.net>
+Subject: Is dinner ready?
+Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)
+Message-ID: <20030712040037.46341.5F8J@football.example.com>
+
+Hi.
+
+We lost the game.  Are you hungry yet?
+
+Joe.`
+
+func TestCanonicalHeader(t *testing.T) {
+	// The example of RFC 6376 section 3.4.6
+	tests := []struct {
+		raw     string
+		relaxed bool
+		want    string
+	}{
+		{"A: X\r\n", false, "A: X\r\n"},
+		{"A: X\r\n", true, "a:X\r\n"},
+		{"B : Y\t\r\n\tZ  \r\n", false, "B : Y\t\r\n\tZ  \r\n"},
+		{"B : Y\t\r\n\tZ  \r\n", true, "b:Y Z\r\n"},
+	}
+	for _, tt := range tests {
+		if got := canonicalHeader(tt.raw, tt.relaxed); got != tt.want {
+			t.Errorf("canonicalHeader(%q, %t) = %q, want %q", tt.raw, tt.relaxed, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		relaxed bool
+		want    string
+	}{
+		// The example of RFC 6376 section 3.4.6
+		{"rfc simple", " C \r\nD \t E\r\n\r\n\r\n", false, " C \r\nD \t E\r\n"},
+		{"rfc relaxed", " C \r\nD \t E\r\n\r\n\r\n", true, " C\r\nD E\r\n"},
+		// An empty body is a CRLF in simple, and empty in relaxed (section 3.4.3)
+		{"empty simple", "", false, "\r\n"},
+		{"empty relaxed", "", true, ""},
+		{"blank lines relaxed", "\r\n\r\n", true, ""},
+		{"no final CRLF simple", "Joe.", false, "Joe.\r\n"},
+		{"no final CRLF relaxed", "Joe.  ", true, "Joe.\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(canonicalBody([]byte(tt.body), tt.relaxed)); got != tt.want {
+				t.Errorf("canonicalBody(%q, %t) = %q, want %q", tt.body, tt.relaxed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalBodyHash(t *testing.T) {
+	// The hashes of an empty body given in RFC 6376 section 3.4.3 and 3.4.4
+	tests := []struct {
+		relaxed bool
+		want    string
+	}{
+		{false, "frcCV1k9oG9oKj3dpUqdJg1PxRT2RSN/XKdLCPjaYaY="},
+		{true, "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+	}
+	for _, tt := range tests {
+		sum := sha256.Sum256(canonicalBody(nil, tt.relaxed))
+		if got := base64.StdEncoding.EncodeToString(sum[:]); got != tt.want {
+			t.Errorf("empty body hash with relaxed %t = %s, want %s", tt.relaxed, got, tt.want)
+		}
+	}
+}
+
+func TestParseTagList(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"v=1; a=rsa-sha256; d=example.net", map[string]string{"v": "1", "a": "rsa-sha256", "d": "example.net"}, false},
+		{" v = 1 ;\r\n\tb= ab\r\n cd ;", map[string]string{"v": "1", "b": "ab\r\n cd"}, false},
+		{"", map[string]string{}, false},
+		{"v=1; v=2", nil, true},
+		{"v=1; novalue", nil, true},
+		{"=1", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTagList(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTagList(%q) error = %v, want error %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("parseTagList(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestVerifySignatures(t *testing.T) {
+	received := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		message      string
+		wantVerified *bool
+		wantDomains  []string
+	}{
+		{"rfc 6376", rfc6376Message, boolPtr(true), []string{"example.com"}},
+		{"rfc 8463", rfc8463Message, boolPtr(true), []string{"football.example.com"}},
+		{"changed body", strings.Replace(rfc6376Message, "hungry", "thirsty", 1), boolPtr(false), nil},
+		{"changed header", strings.Replace(rfc8463Message, "Is dinner ready?", "Is lunch ready?", 1), boolPtr(false), nil},
+		{"unknown key", strings.Replace(rfc6376Message, "s=brisbane", "s=perth", 1), boolPtr(false), nil},
+		{"unsigned", rfc6376Message[strings.Index(rfc6376Message, "Received:"):], nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := verifySignatures(context.Background(), testDKIMKeys, []byte(crlf(tt.message)), received)
+			if !equalBoolPtr(got.DKIMVerified, tt.wantVerified) {
+				t.Errorf("DKIMVerified = %v, want %v (errors %v)", fmtBoolPtr(got.DKIMVerified), fmtBoolPtr(tt.wantVerified), got.Errors)
+			}
+			if fmt.Sprint(got.DKIMDomains) != fmt.Sprint(tt.wantDomains) {
+				t.Errorf("DKIMDomains = %v, want %v", got.DKIMDomains, tt.wantDomains)
+			}
+			if got.ARCChainValid != nil {
+				t.Errorf("ARCChainValid = %v, want nil", *got.ARCChainValid)
+			}
+		})
+	}
+}
+
+func TestVerifySignaturesBodyLength(t *testing.T) {
+	key := testSigningKey()
+	header := "From: joe@example.org\r\nSubject: Lunch\r\n"
+	body := "Hi.\r\n\r\nAre you hungry yet?\r\n"
+	sig := signTestField(t, key, "DKIM-Signature", fmt.Sprintf("v=1; a=ed25519-sha256; c=relaxed/relaxed; d=example.org; s=test; h=from:subject; l=%d; bh=%s;", len(body), testBodyHash(body, -1)), header)
+	tests := []struct {
+		name string
+		body string
+		want bool
+	}{
+		{"whole body signed", body, true},
+		{"trailing blank lines", body + "\r\n\r\n", true},
+		{"content after l=", body + "Visit https://evil.example/\r\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := verifySignatures(context.Background(), testSigningKeys, []byte(sig+header+"\r\n"+tt.body), time.Now())
+			if got.DKIMVerified == nil || *got.DKIMVerified != tt.want {
+				t.Errorf("DKIMVerified = %v, want %t (errors %v)", fmtBoolPtr(got.DKIMVerified), tt.want, got.Errors)
+			}
+		})
+	}
+}
+
+func TestVerifyARC(t *testing.T) {
+	header := "From: joe@example.org\r\nSubject: Lunch\r\n"
+	body := "Are you hungry yet?\r\n"
+	tests := []struct {
+		name    string
+		message string
+		want    *bool
+	}{
+		{"no sets", header + "\r\n" + body, nil},
+		{"one set", arcSealed(t, header, body, 1, nil) + "\r\n" + body, boolPtr(true)},
+		{"two sets", arcSealed(t, header, body, 2, nil) + "\r\n" + body, boolPtr(true)},
+		{"changed body", arcSealed(t, header, body, 2, nil) + "\r\n" + "Are you thirsty yet?\r\n", boolPtr(false)},
+		{"first set with cv=pass", arcSealed(t, header, body, 1, []string{"pass"}) + "\r\n" + body, boolPtr(false)},
+		{"second set with cv=fail", arcSealed(t, header, body, 2, []string{"none", "fail"}) + "\r\n" + body, boolPtr(false)},
+		{"missing first set", removeFields(arcSealed(t, header, body, 2, nil), "i=1") + "\r\n" + body, boolPtr(false)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := verifySignatures(context.Background(), testSigningKeys, []byte(tt.message), time.Now())
+			if !equalBoolPtr(got.ARCChainValid, tt.want) {
+				t.Errorf("ARCChainValid = %v, want %v (errors %v)", fmtBoolPtr(got.ARCChainValid), fmtBoolPtr(tt.want), got.Errors)
+			}
+		})
+	}
+}
+
+// testSigningKey is the key of test._domainkey.example.org, to sign
+// messages in tests that have no published example.
+func testSigningKey() ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x42}, ed25519.SeedSize))
+}
+
+var testSigningKeys = &fileKeyResolver{records: map[string][]string{
+	"test._domainkey.example.org": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(testSigningKey().Public().(ed25519.PublicKey))},
+}}
+
+// testBodyHash returns the bh= value of a body with relaxed
+// canonicalization, of its first length bytes if length is not -1.
+func testBodyHash(body string, length int) string {
+	canonical := canonicalBody([]byte(body), true)
+	if length >= 0 {
+		canonical = canonical[:length]
+	}
+	sum := sha256.Sum256(canonical)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// signTestField returns a signature field with relaxed canonicalization of
+// the tags, which must end with a semicolon, over the signed header data.
+func signTestField(t *testing.T, key ed25519.PrivateKey, name, tags, signed string) string {
+	t.Helper()
+	var data strings.Builder
+	for _, f := range readRawHeaderFields([]byte(signed)) {
+		data.WriteString(canonicalHeader(f.Raw, true))
+	}
+	data.WriteString(strings.TrimSuffix(canonicalHeader(name+": "+tags+" b=\r\n", true), "\r\n"))
+	hashed := sha256.Sum256([]byte(data.String()))
+	return name + ": " + tags + " b=" + base64.StdEncoding.EncodeToString(ed25519.Sign(key, hashed[:])) + "\r\n"
+}
+
+// arcSealed returns the header with n ARC sets added, newest first, as
+// RFC 8617 section 5.1 has them added. cvs overrides the cv= of each seal.
+func arcSealed(t *testing.T, header, body string, n int, cvs []string) string {
+	t.Helper()
+	key := testSigningKey()
+	var sets, chain string
+	for i := 1; i <= n; i++ {
+		cv := "pass"
+		if i == 1 {
+			cv = "none"
+		}
+		if i <= len(cvs) {
+			cv = cvs[i-1]
+		}
+		results := fmt.Sprintf("ARC-Authentication-Results: i=%d; mx%d.example.net; dkim=pass\r\n", i, i)
+		signature := signTestField(t, key, "ARC-Message-Signature", fmt.Sprintf("i=%d; a=ed25519-sha256; c=relaxed/relaxed; d=example.org; s=test; h=from:subject; bh=%s;", i, testBodyHash(body, -1)), header)
+		// The seal signs the earlier sets and this one's results and
+		// message signature
+		chain += results + signature
+		seal := signTestField(t, key, "ARC-Seal", fmt.Sprintf("i=%d; a=ed25519-sha256; cv=%s; d=example.org; s=test;", i, cv), chain)
+		chain += seal
+		sets = seal + signature + results + sets
+	}
+	return sets + header
+}
+
+// removeFields removes the header fields containing s.
+func removeFields(header, s string) string {
+	var kept strings.Builder
+	for _, f := range readRawHeaderFields([]byte(header)) {
+		if !strings.Contains(f.Raw, s) {
+			kept.WriteString(f.Raw)
+		}
+	}
+	return kept.String()
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func equalBoolPtr(a, b *bool) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+func fmtBoolPtr(b *bool) string {
+	if b == nil {
+		return "nil"
+	}
+	return fmt.Sprint(*b)
+}
@@ -0,0 +1,97 @@
+package imap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+)
+
+// dmarcReportFormat is the attachments of DMARC aggregate reports, which
+// are usually zipped or gzipped.
+var dmarcReportFormat = reportFormat{
+	Extensions:   []string{".xml"},
+	ContentTypes: []string{"text/xml", "application/xml"},
+}
+
+// dmarcFeedback is a DMARC aggregate report, see RFC 7489 appendix C.
+type dmarcFeedback struct {
+	Version        string `xml:"version"`
+	ReportMetadata struct {
+		OrgName          string `xml:"org_name"`
+		Email            string `xml:"email"`
+		ExtraContactInfo string `xml:"extra_contact_info"`
+		ReportID         string `xml:"report_id"`
+		DateRange        struct {
+			Begin int64 `xml:"begin"`
+			End   int64 `xml:"end"`
+		} `xml:"date_range"`
+		Errors []string `xml:"error"`
+	} `xml:"report_metadata"`
+	PolicyPublished dmarcPolicyPublished `xml:"policy_published"`
+	Records         []dmarcRecord        `xml:"record"`
+}
+
+type dmarcPolicyPublished struct {
+	Domain string `xml:"domain" json:"domain"`
+	ADKIM  string `xml:"adkim" json:"adkim,omitempty"`
+	ASPF   string `xml:"aspf" json:"aspf,omitempty"`
+	P      string `xml:"p" json:"p"`
+	SP     string `xml:"sp" json:"sp,omitempty"`
+	PCT    *int   `xml:"pct" json:"pct,omitempty"`
+	FO     string `xml:"fo" json:"fo,omitempty"`
+}
+
+type dmarcRecord struct {
+	Row struct {
+		SourceIP        string `xml:"source_ip"`
+		Count           int64  `xml:"count"`
+		PolicyEvaluated struct {
+			Disposition string `xml:"disposition"`
+			DKIM        string `xml:"dkim"`
+			SPF         string `xml:"spf"`
+			Reasons     []struct {
+				Type    string `xml:"type" json:"type"`
+				Comment string `xml:"comment" json:"comment,omitempty"`
+			} `xml:"reason"`
+		} `xml:"policy_evaluated"`
+	} `xml:"row"`
+	Identifiers struct {
+		EnvelopeTo   string `xml:"envelope_to"`
+		EnvelopeFrom string `xml:"envelope_from"`
+		HeaderFrom   string `xml:"header_from"`
+	} `xml:"identifiers"`
+	AuthResults struct {
+		DKIM []struct {
+			Domain      string `xml:"domain" json:"domain"`
+			Selector    string `xml:"selector" json:"selector,omitempty"`
+			Result      string `xml:"result" json:"result"`
+			HumanResult string `xml:"human_result" json:"human_result,omitempty"`
+		} `xml:"dkim"`
+		SPF []struct {
+			Domain string `xml:"domain" json:"domain"`
+			Scope  string `xml:"scope" json:"scope,omitempty"`
+			Result string `xml:"result" json:"result"`
+		} `xml:"spf"`
+	} `xml:"auth_results"`
+}
+
+// parseDMARCReport parses the XML of an aggregate report.
+func parseDMARCReport(data []byte) (*dmarcFeedback, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.CharsetReader = xmlCharsetReader
+	var feedback dmarcFeedback
+	if err := decoder.Decode(&feedback); err != nil {
+		return nil, err
+	}
+	// Reporters pad values with whitespace
+	feedback.ReportMetadata.OrgName = strings.TrimSpace(feedback.ReportMetadata.OrgName)
+	feedback.ReportMetadata.ReportID = strings.TrimSpace(feedback.ReportMetadata.ReportID)
+	for i := range feedback.Records {
+		r := &feedback.Records[i]
+		r.Row.SourceIP = strings.TrimSpace(r.Row.SourceIP)
+		r.Row.PolicyEvaluated.Disposition = strings.ToLower(strings.TrimSpace(r.Row.PolicyEvaluated.Disposition))
+		r.Row.PolicyEvaluated.DKIM = strings.ToLower(strings.TrimSpace(r.Row.PolicyEvaluated.DKIM))
+		r.Row.PolicyEvaluated.SPF = strings.ToLower(strings.TrimSpace(r.Row.PolicyEvaluated.SPF))
+	}
+	return &feedback, nil
+}
@@ -0,0 +1,104 @@
+package imap
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/utf7"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin/transform"
+)
+
+// Gmail IMAP extensions, see https://developers.google.com/gmail/imap/imap-extensions
+const (
+	gmailExtension = "X-GM-EXT-1"
+
+	gmailLabels    imap.FetchItem = "X-GM-LABELS"
+	gmailThreadID  imap.FetchItem = "X-GM-THRID"
+	gmailMessageID imap.FetchItem = "X-GM-MSGID"
+)
+
+// gmailSystemLabels maps the special-use attributes of Gmail's system
+// mailboxes to the label used for them in X-GM-LABELS.
+var gmailSystemLabels = map[string]string{
+	imap.ImportantAttr: "\\Important",
+	imap.FlaggedAttr:   "\\Starred",
+	imap.SentAttr:      "\\Sent",
+	imap.DraftsAttr:    "\\Draft",
+	imap.JunkAttr:      "\\Spam",
+	imap.TrashAttr:     "\\Trash",
+}
+
+func gmailSupported(c *client.Client) bool {
+	ok, _ := c.Support(gmailExtension)
+	return ok
+}
+
+// gmailItemsSupported returns true if the Gmail fetch items can be fetched:
+// from Gmail, or from the mbox backend, which serves the labels of Google
+// Takeout exports without supporting the rest of the Gmail extensions.
+func gmailItemsSupported(d *plugin.QueryData, c *client.Client) bool {
+	return gmailSupported(c) || backendName(GetConfig(d.Connection)) == backendMbox
+}
+
+// gmailLabel returns the label Gmail uses for the mailbox in X-GM-LABELS, or
+// an empty string for mailboxes that are not labels, e.g. All Mail.
+func gmailLabel(m *imap.MailboxInfo) string {
+	if m.Name == "INBOX" {
+		return "\\Inbox"
+	}
+	for _, attr := range m.Attributes {
+		if attr == imap.AllAttr {
+			return ""
+		}
+		if label, ok := gmailSystemLabels[attr]; ok {
+			return label
+		}
+	}
+	return m.Name
+}
+
+func getGmailLabels(_ context.Context, d *transform.TransformData) (interface{}, error) {
+	items, ok := d.Value.(map[imap.FetchItem]interface{})
+	if !ok {
+		return nil, nil
+	}
+	fields, ok := items[gmailLabels].([]interface{})
+	if !ok {
+		return nil, nil
+	}
+	labels := []string{}
+	for _, f := range fields {
+		label, err := imap.ParseString(f)
+		if err != nil {
+			continue
+		}
+		// Labels are encoded like mailbox names
+		if decoded, err := utf7.Encoding.NewDecoder().String(label); err == nil {
+			label = decoded
+		}
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+// getGmailID returns an X-GM-MSGID or X-GM-THRID as a decimal string, as
+// they are unsigned 64-bit numbers which may not fit in an INT column.
+func getGmailID(_ context.Context, d *transform.TransformData) (interface{}, error) {
+	items, ok := d.Value.(map[imap.FetchItem]interface{})
+	if !ok {
+		return nil, nil
+	}
+	s, err := imap.ParseString(items[d.Param.(imap.FetchItem)])
+	if err != nil {
+		return nil, nil
+	}
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+	return strconv.FormatUint(id, 10), nil
+}
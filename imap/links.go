@@ -0,0 +1,180 @@
+package imap
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Where links were found, for the source column of imap_message_link
+const (
+	linkSourceText   = "text"
+	linkSourceAnchor = "anchor"
+	linkSourceImage  = "image"
+	linkSourceForm   = "form"
+)
+
+// messageLink is a URL in the body of a message.
+type messageLink struct {
+	Source string
+	Href   string
+	// Text is the visible text of an anchor, or the alt text of an image
+	Text               string
+	Scheme             string
+	Domain             string
+	TextDomainMismatch bool
+	TrackingPixel      bool
+}
+
+var (
+	// URLs in plain text end at whitespace, quotes and brackets
+	textURL = regexp.MustCompile(`(?i)\b(?:https?|ftp)://[^\s<>"'()\[\]{}]+`)
+	// Anchor text that may show a domain, e.g. www.example.com or
+	// https://example.com/login. Without a scheme it may just as well be a
+	// file name such as report.pdf, see shownDomain.
+	textDomain = regexp.MustCompile(`(?i)^([a-z][a-z0-9+.-]*://)?([a-z0-9-]+(?:\.[a-z0-9-]+)*\.[a-z]{2,})(?:[:/?#]\S*)?$`)
+	// Inline styles that hide an element or size it to a pixel
+	hiddenStyle = regexp.MustCompile(`(?i)display\s*:\s*none|visibility\s*:\s*hidden|opacity\s*:\s*0(?:\.0*)?\s*(?:;|$)|(?:^|[;\s])(?:max-)?(?:width|height)\s*:\s*[01](?:px)?\s*(?:;|$)`)
+)
+
+// messageLinks returns the links in the HTML body of a message, then the
+// URLs in its text body that aren't also in the HTML, as the text may have
+// been converted from it.
+func messageLinks(text, htmlBody string) []messageLink {
+	links := htmlLinks(htmlBody)
+	inHTML := map[string]bool{}
+	for _, l := range links {
+		inHTML[l.Href] = true
+	}
+	for _, href := range textURL.FindAllString(text, -1) {
+		href = strings.TrimRight(href, ".,;:!?")
+		if inHTML[href] {
+			continue
+		}
+		links = append(links, newMessageLink(linkSourceText, href, ""))
+	}
+	return links
+}
+
+// htmlLinks returns the anchors, images and forms of an HTML body.
+func htmlLinks(body string) []messageLink {
+	if body == "" {
+		return nil
+	}
+	var links []messageLink
+	// anchor is the index in links of the anchor being read, to collect its
+	// text, or -1
+	anchor := -1
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return links
+		case html.TextToken:
+			if anchor >= 0 {
+				links[anchor].Text += string(z.Text())
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); atom.Lookup(name) == atom.A && anchor >= 0 {
+				links[anchor].finishAnchor()
+				anchor = -1
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			attrs := map[string]string{}
+			for hasAttr {
+				var key, value []byte
+				key, value, hasAttr = z.TagAttr()
+				attrs[string(key)] = strings.TrimSpace(string(value))
+			}
+			switch atom.Lookup(name) {
+			case atom.A:
+				if anchor >= 0 {
+					links[anchor].finishAnchor()
+					anchor = -1
+				}
+				if href := attrs["href"]; href != "" && !strings.HasPrefix(href, "#") {
+					links = append(links, newMessageLink(linkSourceAnchor, href, ""))
+					anchor = len(links) - 1
+				}
+			case atom.Img:
+				if src := attrs["src"]; src != "" {
+					l := newMessageLink(linkSourceImage, src, attrs["alt"])
+					l.TrackingPixel = (l.Scheme == "http" || l.Scheme == "https") && hiddenImage(attrs)
+					links = append(links, l)
+					// An image is the visible content of an anchor around it
+					if anchor >= 0 && strings.TrimSpace(links[anchor].Text) == "" {
+						links[anchor].Text = attrs["alt"]
+					}
+				}
+			case atom.Form:
+				if action := attrs["action"]; action != "" {
+					links = append(links, newMessageLink(linkSourceForm, action, ""))
+				}
+			}
+		}
+	}
+}
+
+func newMessageLink(source, href, text string) messageLink {
+	l := messageLink{Source: source, Href: href, Text: text}
+	if u, err := url.Parse(href); err == nil {
+		l.Scheme = strings.ToLower(u.Scheme)
+		l.Domain = strings.ToLower(u.Hostname())
+	}
+	return l
+}
+
+// finishAnchor tidies the text of an anchor, and checks whether it shows a
+// domain other than the one it links to, a common trick of phishing.
+func (l *messageLink) finishAnchor() {
+	l.Text = strings.Join(strings.Fields(l.Text), " ")
+	if l.Domain == "" || (l.Scheme != "http" && l.Scheme != "https") {
+		return
+	}
+	shown, ok := shownDomain(l.Text)
+	if !ok {
+		return
+	}
+	shown = strings.TrimPrefix(shown, "www.")
+	linked := strings.TrimPrefix(l.Domain, "www.")
+	l.TextDomainMismatch = shown != linked && !strings.HasSuffix(linked, "."+shown) && !strings.HasSuffix(shown, "."+linked)
+}
+
+// shownDomain returns the domain shown by the text of an anchor, if any. Text
+// without a scheme or www. prefix is only taken as a domain if it ends in a
+// public suffix under ICANN, so file names such as report.pdf and index.html
+// are not.
+func shownDomain(text string) (string, bool) {
+	m := textDomain.FindStringSubmatch(text)
+	if m == nil {
+		return "", false
+	}
+	domain := strings.ToLower(m[2])
+	if m[1] != "" || strings.HasPrefix(domain, "www.") {
+		return domain, true
+	}
+	suffix, icann := publicsuffix.PublicSuffix(domain)
+	return domain, icann && suffix != domain
+}
+
+// hiddenImage says whether an image is at most one pixel in size, or hidden,
+// which is how tracking pixels are included.
+func hiddenImage(attrs map[string]string) bool {
+	if _, ok := attrs["hidden"]; ok {
+		return true
+	}
+	if hiddenStyle.MatchString(attrs["style"]) {
+		return true
+	}
+	tiny := func(s string) bool {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(s), "px"))
+		return err == nil && n <= 1
+	}
+	return tiny(attrs["width"]) && tiny(attrs["height"])
+}
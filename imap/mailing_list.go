@@ -0,0 +1,83 @@
+package imap
+
+import (
+	"mime"
+	"regexp"
+	"strings"
+)
+
+// mailingListHeaders are the fields that mailing lists and newsletters add
+// to messages, see RFC 2369, RFC 2919 and RFC 8058.
+type mailingListHeaders struct {
+	ListID              string
+	ListName            string
+	ListPost            string
+	UnsubscribeURLs     []string
+	UnsubscribeMailto   string
+	UnsubscribeOneClick bool
+	Precedence          string
+}
+
+// listURIs matches the URIs of a List-* field, which are in angle brackets.
+var listURIs = regexp.MustCompile(`<([^<>]*)>`)
+
+func parseMailingListHeaders(fields []headerField) mailingListHeaders {
+	var h mailingListHeaders
+
+	// List-Id: Announcements <announce.example.com>
+	if id := headerValue(fields, "List-Id"); id != "" {
+		if decoded, err := new(mime.WordDecoder).DecodeHeader(id); err == nil {
+			id = decoded
+		}
+		name := ""
+		if m := listURIs.FindStringSubmatchIndex(id); m != nil {
+			name, id = id[:m[0]], id[m[2]:m[3]]
+		}
+		h.ListID = strings.ToLower(strings.TrimSpace(id))
+		h.ListName = unquote(strings.TrimSpace(stripComments(name)))
+	}
+
+	// List-Post: <mailto:list@example.com>, or NO if posting isn't allowed
+	if post := headerValue(fields, "List-Post"); post != "" {
+		if uris := listFieldURIs(post); len(uris) > 0 {
+			h.ListPost = uris[0]
+		} else {
+			h.ListPost = strings.TrimSpace(stripComments(post))
+		}
+	}
+
+	// List-Unsubscribe: <mailto:leave@example.com>, <https://example.com/u?id=1>
+	https := false
+	for _, uri := range listFieldURIs(headerValue(fields, "List-Unsubscribe")) {
+		scheme, _, _ := strings.Cut(strings.ToLower(uri), ":")
+		switch scheme {
+		case "mailto":
+			if h.UnsubscribeMailto == "" {
+				h.UnsubscribeMailto = uri
+			}
+		case "https":
+			https = true
+			h.UnsubscribeURLs = append(h.UnsubscribeURLs, uri)
+		case "http":
+			h.UnsubscribeURLs = append(h.UnsubscribeURLs, uri)
+		}
+	}
+	// One-click unsubscribing is a POST to an HTTPS URI
+	post := strings.Join(strings.Fields(headerValue(fields, "List-Unsubscribe-Post")), "")
+	h.UnsubscribeOneClick = https && strings.EqualFold(post, "List-Unsubscribe=One-Click")
+
+	h.Precedence = strings.ToLower(strings.TrimSpace(stripComments(headerValue(fields, "Precedence"))))
+	return h
+}
+
+// listFieldURIs returns the URIs of a List-* field, without the whitespace
+// that folding may have left in them.
+func listFieldURIs(value string) []string {
+	var uris []string
+	for _, m := range listURIs.FindAllStringSubmatch(value, -1) {
+		if uri := strings.Join(strings.Fields(m[1]), ""); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	return uris
+}
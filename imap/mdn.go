@@ -0,0 +1,75 @@
+package imap
+
+import (
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// mdn is a message disposition notification, i.e. a read receipt, see RFC
+// 8098, e.g.
+//
+//	Reporting-UA: pc.example.org; Thunderbird 115.0
+//	Final-Recipient: rfc822; bob@example.org
+//	Original-Message-ID: <123@example.com>
+//	Disposition: manual-action/MDN-sent-manually; displayed
+type mdn struct {
+	ReportingUA          string
+	OriginalRecipient    string
+	FinalRecipient       string
+	OriginalMessageID    string
+	Disposition          string
+	ActionMode           string
+	SendingMode          string
+	DispositionType      string
+	DispositionModifiers []string
+}
+
+// parseMDN returns the notification in a message, or nil if it isn't one.
+func parseMDN(env *enmime.Envelope) *mdn {
+	if env == nil || env.Root == nil {
+		return nil
+	}
+	parts := env.Root.DepthMatchAll(func(p *enmime.Part) bool { return p.FirstChild == nil })
+	for _, p := range parts {
+		switch strings.ToLower(p.ContentType) {
+		case "message/disposition-notification", "message/global-disposition-notification":
+		default:
+			continue
+		}
+		var fields []headerField
+		for _, group := range fieldGroups(string(p.Content)) {
+			fields = append(fields, group...)
+		}
+		n := &mdn{
+			ReportingUA:       strings.Join(strings.Fields(headerValue(fields, "Reporting-UA")), " "),
+			OriginalRecipient: dsnAddress(headerValue(fields, "Original-Recipient")),
+			FinalRecipient:    dsnAddress(headerValue(fields, "Final-Recipient")),
+			OriginalMessageID: headerValue(fields, "Original-Message-ID"),
+			Disposition:       headerValue(fields, "Disposition"),
+		}
+		n.parseDisposition()
+		if n.OriginalMessageID == "" {
+			n.OriginalMessageID = originalMessageID(parts, "")
+		}
+		return n
+	}
+	return nil
+}
+
+// parseDisposition splits the Disposition field, which is the action and
+// sending modes, then the type with any modifiers, e.g.
+// "automatic-action/MDN-sent-automatically; deleted/error".
+func (n *mdn) parseDisposition() {
+	modes, disposition, _ := strings.Cut(strings.ToLower(stripComments(n.Disposition)), ";")
+	action, sending, _ := strings.Cut(modes, "/")
+	n.ActionMode = strings.TrimSpace(action)
+	n.SendingMode = strings.TrimSpace(sending)
+	dispositionType, modifiers, _ := strings.Cut(disposition, "/")
+	n.DispositionType = strings.TrimSpace(dispositionType)
+	for _, m := range strings.Split(modifiers, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			n.DispositionModifiers = append(n.DispositionModifiers, m)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/jhillyerd/enmime"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+)
+
+// Results of parsing a message, for the parse_status column
+const (
+	parseOK        = "ok"
+	parseRecovered = "recovered"
+	parseFailed    = "failed"
+)
+
+// MIME parsing modes, for the mime_parsing config setting
+const (
+	mimeParsingLenient = "lenient"
+	mimeParsingStrict  = "strict"
+)
+
+// strictParsing returns true if messages that enmime rejects should fail
+// rather than be parsed again without their malformed parts.
+func strictParsing(d *plugin.QueryData) (bool, error) {
+	imapConfig := GetConfig(d.Connection)
+	if imapConfig.MIMEParsing == nil || *imapConfig.MIMEParsing == "" {
+		return false, nil
+	}
+	switch strings.ToLower(*imapConfig.MIMEParsing) {
+	case mimeParsingLenient:
+		return false, nil
+	case mimeParsingStrict:
+		return true, nil
+	}
+	return false, fmt.Errorf("mime_parsing must be %s or %s", mimeParsingLenient, mimeParsingStrict)
+}
+
+// recoverEnvelope parses a message that enmime rejected, first without any
+// malformed header lines, then as plain text without its MIME structure.
+// This is mostly needed for spam, which is often deliberately malformed.
+func recoverEnvelope(raw []byte) (*enmime.Envelope, error) {
+	header, body := splitMessage(raw)
+
+	// Keep only well formed fields, and their continuation lines
+	var fields [][]byte
+	keep := false
+	for _, line := range bytes.SplitAfter(header, []byte("\n")) {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			if keep {
+				fields[len(fields)-1] = append(fields[len(fields)-1], line...)
+			}
+			continue
+		}
+		if keep = validHeaderLine(line); keep {
+			fields = append(fields, append([]byte{}, line...))
+		}
+	}
+
+	join := func(skip func(name string) bool) []byte {
+		var b bytes.Buffer
+		for _, field := range fields {
+			name, _, _ := bytes.Cut(field, []byte(":"))
+			if skip == nil || !skip(string(name)) {
+				b.Write(field)
+			}
+		}
+		b.WriteString("\r\n")
+		b.Write(body)
+		return b.Bytes()
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(join(nil)))
+	if err == nil {
+		return env, nil
+	}
+	// Without Content-* fields, the body is text/plain
+	return enmime.ReadEnvelope(bytes.NewReader(join(func(name string) bool {
+		return strings.HasPrefix(strings.ToLower(strings.TrimSpace(name)), "content-")
+	})))
+}
+
+// splitMessage splits a message at the blank line that ends its header.
+func splitMessage(raw []byte) ([]byte, []byte) {
+	crlf := bytes.Index(raw, []byte("\r\n\r\n"))
+	lf := bytes.Index(raw, []byte("\n\n"))
+	switch {
+	case crlf >= 0 && (lf < 0 || crlf < lf):
+		return raw[:crlf+2], raw[crlf+4:]
+	case lf >= 0:
+		return raw[:lf+1], raw[lf+2:]
+	}
+	return raw, nil
+}
+
+// validHeaderLine returns true if the line starts a header field that
+// enmime can read. RFC 5322 allows any printable ASCII in field names, but
+// Go's textproto only accepts the token characters of RFC 7230.
+func validHeaderLine(line []byte) bool {
+	name, _, ok := bytes.Cut(line, []byte(":"))
+	name = bytes.TrimRight(name, " \t")
+	if !ok || len(name) == 0 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// headerField is a field of a message header, with its lines unfolded.
+type headerField struct {
+	Name  string
+	Value string
+}
+
+// readHeaderFields returns the fields of a header section in order,
+// including duplicates, and skipping malformed lines.
+func readHeaderFields(header []byte) []headerField {
+	var fields []headerField
+	keep := false
+	for _, line := range bytes.SplitAfter(header, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if keep {
+				fields[len(fields)-1].Value += string(line)
+			}
+			continue
+		}
+		if keep = validHeaderLine(line); keep {
+			name, value, _ := bytes.Cut(line, []byte(":"))
+			fields = append(fields, headerField{Name: string(bytes.TrimRight(name, " \t")), Value: string(value)})
+		}
+	}
+	for i := range fields {
+		fields[i].Value = strings.TrimSpace(strings.ToValidUTF8(fields[i].Value, "\uFFFD"))
+	}
+	return fields
+}
+
+// headerValue returns the value of the first field with the name.
+func headerValue(fields []headerField, name string) string {
+	for _, f := range fields {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// fromIMAPEnvelope sets the columns of a message that could not be parsed
+// from the ENVELOPE the server parsed.
+func (te *wrapper) fromIMAPEnvelope(env *imap.Envelope) {
+	if env == nil {
+		return
+	}
+	te.Subject = strings.ToValidUTF8(env.Subject, "�")
+	te.MessageID = strings.ToValidUTF8(env.MessageId, "�")
+	te.InReplyTo = strings.Fields(strings.ToValidUTF8(env.InReplyTo, "�"))
+	te.Timestamp = env.Date
+	te.FromAddresses = imapAddresses(env.From)
+	te.ToAddresses = imapAddresses(env.To)
+	te.CcAddresses = imapAddresses(env.Cc)
+	te.BccAddresses = imapAddresses(env.Bcc)
+	if len(te.FromAddresses) > 0 {
+		te.From = te.FromAddresses[0].String()
+	}
+}
+
+func imapAddresses(list []*imap.Address) []*mail.Address {
+	var addresses []*mail.Address
+	for _, a := range list {
+		// Group syntax is given as addresses without a host
+		if a.HostName == "" {
+			continue
+		}
+		addresses = append(addresses, &mail.Address{
+			Name:    strings.ToValidUTF8(a.PersonalName, "�"),
+			Address: strings.ToValidUTF8(a.Address(), "�"),
+		})
+	}
+	return addresses
+}
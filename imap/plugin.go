@@ -21,8 +21,19 @@ func Plugin(ctx context.Context) *plugin.Plugin {
 		},
 		DefaultTransform: transform.FromGo(),
 		TableMap: map[string]*plugin.Table{
-			"imap_mailbox": tableIMAPMailbox(ctx),
-			"imap_message": tableIMAPMessage(ctx),
+			"imap_bounce":                 tableIMAPBounce(ctx),
+			"imap_calendar_invite":        tableIMAPCalendarInvite(ctx),
+			"imap_dmarc_report":           tableIMAPDMARCReport(ctx),
+			"imap_eml_file":               tableIMAPEmlFile(ctx),
+			"imap_gmail_label":            tableIMAPGmailLabel(ctx),
+			"imap_mailbox":                tableIMAPMailbox(ctx),
+			"imap_mailing_list":           tableIMAPMailingList(ctx),
+			"imap_mdn":                    tableIMAPMDN(ctx),
+			"imap_message":                tableIMAPMessage(ctx),
+			"imap_message_authentication": tableIMAPMessageAuthentication(ctx),
+			"imap_message_link":           tableIMAPMessageLink(ctx),
+			"imap_message_received_hop":   tableIMAPMessageReceivedHop(ctx),
+			"imap_tls_report":             tableIMAPTLSReport(ctx),
 		},
 	}
 	return p
@@ -0,0 +1,268 @@
+package imap
+
+import (
+	"net"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// receivedHop is a Received header field, see RFC 5321 section 4.4, e.g.
+//
+//	Received: from mail.example.com (mail.example.com [203.0.113.5])
+//	    (using TLSv1.3 with cipher TLS_AES_256_GCM_SHA384 (256/256 bits))
+//	    by mx.example.org (Postfix) with ESMTPS id 4Nm3Kx1234
+//	    for <bob@example.org>; Mon,  2 Jan 2023 10:00:01 +0000 (UTC)
+//
+// The clauses are optional, and each MTA adds its own comments, so the
+// fields are found wherever Postfix, Exim, Exchange, Gmail, qmail and
+// sendmail put them.
+type receivedHop struct {
+	FromHost    string
+	FromIP      string
+	ByHost      string
+	Protocol    string
+	TLSVersion  string
+	TLSCipher   string
+	EnvelopeFor string
+	ID          string
+	Timestamp   time.Time
+	Received    string
+}
+
+// receivedKeywords start the clauses of a Received field
+var receivedKeywords = map[string]bool{"from": true, "by": true, "via": true, "with": true, "id": true, "for": true}
+
+var (
+	// Postfix: (using TLSv1.3 with cipher TLS_AES_256_GCM_SHA384 (256/256 bits) ...)
+	postfixTLS = regexp.MustCompile(`using (TLSv?[0-9._]+) with cipher ([A-Za-z0-9_-]+)`)
+	// Exchange, Gmail and sendmail: (version=TLS1_2, cipher=TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384)
+	versionTLS = regexp.MustCompile(`version=(TLSv?[0-9._]+)`)
+	cipherTLS  = regexp.MustCompile(`cipher=([A-Za-z0-9_-]+)`)
+	// Older Exim: (TLSv1.2:ECDHE-RSA-AES256-GCM-SHA384:256)
+	eximOldTLS = regexp.MustCompile(`\((TLSv?[0-9._]+):([A-Za-z0-9_-]+):[0-9]+\)`)
+	// Exim 4.9x: with esmtps (TLS1.3) tls TLS_AES_256_GCM_SHA384
+	eximVersionTLS = regexp.MustCompile(`\((TLSv?[0-9._]+)\)`)
+	eximCipherTLS  = regexp.MustCompile(`\btls ([A-Za-z0-9_-]+)`)
+	// Protocols of the with clause, see the IANA Mail Transmission Types
+	receivedProtocol = regexp.MustCompile(`(?i)^(UTF8)?(E?SMTP|LMTP)S?A?$|^HTTPS?$|^SMTPS$|^MAPI$|^LOCAL$|^IMAP$`)
+)
+
+// receivedClause is the words and comments following a keyword.
+type receivedClause struct {
+	words    []string
+	comments []string
+}
+
+// parseReceived parses the value of a Received field. Parts it can't make
+// sense of are left empty.
+func parseReceived(value string) receivedHop {
+	hop := receivedHop{Received: value}
+
+	// The date follows the last semicolon outside a comment
+	clauses, date := value, ""
+	depth := 0
+scan:
+	for i := len(value) - 1; i >= 0; i-- {
+		switch value[i] {
+		case ')':
+			depth++
+		case '(':
+			depth--
+		case ';':
+			if depth == 0 {
+				clauses, date = value[:i], value[i+1:]
+				break scan
+			}
+		}
+	}
+	hop.Timestamp = parseReceivedDate(date)
+
+	parsed := map[string]*receivedClause{}
+	current := &receivedClause{}
+	for _, token := range receivedTokens(clauses) {
+		if strings.HasPrefix(token, "(") {
+			current.comments = append(current.comments, strings.TrimSuffix(token[1:], ")"))
+			continue
+		}
+		if keyword := strings.ToLower(token); receivedKeywords[keyword] && parsed[keyword] == nil {
+			current = &receivedClause{}
+			parsed[keyword] = current
+			continue
+		}
+		current.words = append(current.words, token)
+	}
+
+	if from := parsed["from"]; from != nil {
+		hop.FromHost, hop.FromIP = receivedFrom(from)
+	}
+	if by := parsed["by"]; by != nil && len(by.words) > 0 {
+		hop.ByHost = by.words[0]
+	}
+	if with := parsed["with"]; with != nil && len(with.words) > 0 {
+		hop.Protocol = strings.ToUpper(with.words[0])
+		for _, w := range with.words {
+			if receivedProtocol.MatchString(w) {
+				hop.Protocol = strings.ToUpper(w)
+				break
+			}
+		}
+	}
+	if id := parsed["id"]; id != nil && len(id.words) > 0 {
+		hop.ID = id.words[0]
+	}
+	if f := parsed["for"]; f != nil && len(f.words) > 0 {
+		hop.EnvelopeFor = strings.Trim(f.words[0], "<>")
+	}
+
+	hop.TLSVersion, hop.TLSCipher = receivedTLS(clauses)
+	return hop
+}
+
+// receivedTokens splits the clauses of a Received field into words and
+// comments, which keep their parentheses.
+func receivedTokens(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case isSpace(c):
+			i++
+		case c == '(':
+			depth, j := 0, i
+			for ; j < len(s); j++ {
+				if s[j] == '(' {
+					depth++
+				} else if s[j] == ')' {
+					if depth--; depth == 0 {
+						j++
+						break
+					}
+				}
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			j := i
+			for j < len(s) && !isSpace(s[j]) && s[j] != '(' {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+// receivedFrom returns the sending host and its IP address. Servers give
+// the HELO name, the reverse DNS name and the IP address in different
+// places, e.g.
+//
+//	from mail.example.com (mail.example.com [203.0.113.5])   Postfix, Gmail
+//	from [203.0.113.5] (helo=mail.example.com)               Exim
+//	from host.example.com (2603:10a6:20b:1::1)               Exchange
+//	from unknown (HELO mail.example.com) (203.0.113.5)       qmail
+func receivedFrom(from *receivedClause) (string, string) {
+	host, ip := "", ""
+	if len(from.words) > 0 {
+		host = from.words[0]
+		if addr := receivedIP(host); addr != "" {
+			ip, host = addr, ""
+		} else if strings.EqualFold(host, "unknown") {
+			host = ""
+		}
+	}
+	for _, comment := range from.comments {
+		fields := strings.Fields(comment)
+		for i, f := range fields {
+			if ip == "" {
+				ip = receivedIP(f)
+			}
+			if host == "" {
+				if name, ok := strings.CutPrefix(strings.ToLower(f), "helo="); ok {
+					host = name
+				} else if strings.EqualFold(f, "HELO") && i+1 < len(fields) {
+					host = fields[i+1]
+				}
+			}
+		}
+	}
+	if host == "" {
+		// e.g. the reverse DNS name, when the HELO name was an IP address
+		for _, comment := range from.comments {
+			for _, f := range strings.Fields(comment) {
+				if f = strings.TrimSuffix(f, "."); host == "" && strings.Contains(f, ".") && !strings.Contains(f, "=") && receivedIP(f) == "" {
+					host = f
+				}
+			}
+		}
+	}
+	return strings.TrimSuffix(host, "."), ip
+}
+
+// receivedIP returns the IP address in an address literal such as
+// [203.0.113.5] or [IPv6:2001:db8::1], or a bare address.
+func receivedIP(s string) string {
+	s = strings.Trim(s, "[]()<>,;")
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "IPv6:"), "ipv6:")
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// receivedTLS returns the TLS version and cipher, in whichever form the MTA
+// recorded them. Versions are normalized to the form TLSv1.3.
+func receivedTLS(s string) (string, string) {
+	version, cipher := "", ""
+	if m := postfixTLS.FindStringSubmatch(s); m != nil {
+		version, cipher = m[1], m[2]
+	} else if m := eximOldTLS.FindStringSubmatch(s); m != nil {
+		version, cipher = m[1], m[2]
+	} else {
+		if m := versionTLS.FindStringSubmatch(s); m != nil {
+			version = m[1]
+		} else if m := eximVersionTLS.FindStringSubmatch(s); m != nil {
+			version = m[1]
+		}
+		if m := cipherTLS.FindStringSubmatch(s); m != nil {
+			cipher = m[1]
+		} else if m := eximCipherTLS.FindStringSubmatch(s); m != nil {
+			cipher = m[1]
+		}
+	}
+	if version != "" {
+		version = "TLSv" + strings.ReplaceAll(strings.TrimPrefix(strings.TrimPrefix(version, "TLS"), "v"), "_", ".")
+	}
+	return version, cipher
+}
+
+// parseReceivedDate parses the date of a Received field, which often has a
+// comment after the zone, e.g. "Mon, 2 Jan 2023 10:00:01 -0800 (PST)".
+func parseReceivedDate(s string) time.Time {
+	s = strings.TrimSpace(collapseSpace(s))
+	if s == "" {
+		return time.Time{}
+	}
+	if t, err := mail.ParseDate(s); err == nil {
+		return t
+	}
+	if i := strings.IndexByte(s, '('); i > 0 {
+		if t, err := mail.ParseDate(strings.TrimSpace(s[:i])); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// receivedHops returns the Received fields of a message in the order the
+// message passed through the servers, i.e. from the bottom field up.
+func receivedHops(fields []headerField) []receivedHop {
+	var hops []receivedHop
+	for i := len(fields) - 1; i >= 0; i-- {
+		if strings.EqualFold(fields[i].Name, "Received") {
+			hops = append(hops, parseReceived(fields[i].Value))
+		}
+	}
+	return hops
+}
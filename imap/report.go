@@ -0,0 +1,161 @@
+package imap
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// maxReportSize limits the total size of the reports decompressed from a
+// message, and maxReportEntries the number of reports read from each zip
+// attachment, so that a malicious archive can't exhaust memory.
+const (
+	maxReportSize    = 64 * 1024 * 1024
+	maxReportEntries = 100
+)
+
+// reportFile is a report attached to a message, after decompression.
+type reportFile struct {
+	Name string
+	Data []byte
+}
+
+// reportFormat says which attachments hold reports of a kind, e.g. DMARC
+// aggregate reports are .xml files, which may be zipped or gzipped.
+type reportFormat struct {
+	Extensions   []string
+	ContentTypes []string
+}
+
+// reportFormats is every kind of report, so that a mailbox can hold them all.
+var reportFormats = []reportFormat{dmarcReportFormat, tlsReportFormat}
+
+func (f reportFormat) matches(name, contentType string) bool {
+	for _, ext := range f.Extensions {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			return true
+		}
+	}
+	for _, ct := range f.ContentTypes {
+		if contentType == ct {
+			return true
+		}
+	}
+	return false
+}
+
+// other says whether a file is a report of another kind, e.g. a gzipped
+// DMARC report in a mailbox that also has TLS reports.
+func (f reportFormat) other(name string) bool {
+	if f.matches(name, "") {
+		return false
+	}
+	for _, format := range reportFormats {
+		if format.matches(name, "") {
+			return true
+		}
+	}
+	return false
+}
+
+// reportFiles returns the reports attached to a message, unpacking zip and
+// gzip attachments. Attachments that can't be unpacked are returned as
+// errors, so the other reports are still read.
+func reportFiles(env *enmime.Envelope, format reportFormat) ([]reportFile, []error) {
+	if env == nil || env.Root == nil {
+		return nil, nil
+	}
+	var files []reportFile
+	var errs []error
+	// remaining is what's left of maxReportSize for the message
+	remaining := int64(maxReportSize)
+	for _, part := range env.Root.DepthMatchAll(func(p *enmime.Part) bool { return p.FirstChild == nil }) {
+		name := part.FileName
+		contentType := strings.ToLower(part.ContentType)
+		switch {
+		case strings.HasSuffix(strings.ToLower(name), ".zip") || contentType == "application/zip" || contentType == "application/x-zip-compressed":
+			r, err := zip.NewReader(bytes.NewReader(part.Content), int64(len(part.Content)))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				continue
+			}
+			entries := 0
+			for _, f := range r.File {
+				if !format.matches(f.Name, "") {
+					continue
+				}
+				if entries++; entries > maxReportEntries {
+					errs = append(errs, fmt.Errorf("%s: more than %d reports in the archive", name, maxReportEntries))
+					break
+				}
+				rc, err := f.Open()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %s: %w", name, f.Name, err))
+					continue
+				}
+				data, err := readReport(rc, &remaining)
+				rc.Close()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %s: %w", name, f.Name, err))
+					continue
+				}
+				files = append(files, reportFile{Name: path.Base(f.Name), Data: data})
+			}
+		case strings.HasSuffix(strings.ToLower(name), ".gz") || contentType == "application/gzip" || contentType == "application/x-gzip" || contentType == "application/tlsrpt+gzip":
+			inner := strings.TrimSuffix(name, path.Ext(name))
+			if format.other(inner) {
+				continue
+			}
+			r, err := gzip.NewReader(bytes.NewReader(part.Content))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				continue
+			}
+			data, err := readReport(r, &remaining)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				continue
+			}
+			if inner == "" {
+				inner = r.Name
+			}
+			files = append(files, reportFile{Name: inner, Data: data})
+		case format.matches(name, contentType):
+			files = append(files, reportFile{Name: name, Data: part.Content})
+		}
+	}
+	return files, errs
+}
+
+// readReport reads a decompressed report, taking its size from remaining.
+func readReport(r io.Reader, remaining *int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, *remaining+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > *remaining {
+		*remaining = 0
+		return nil, fmt.Errorf("reports in the message are larger than %d MB", maxReportSize/1024/1024)
+	}
+	*remaining -= int64(len(data))
+	return data, nil
+}
+
+// xmlCharsetReader lets encoding/xml read reports in other charsets than
+// UTF-8, e.g. <?xml version="1.0" encoding="windows-1252"?>.
+func xmlCharsetReader(label string, input io.Reader) (io.Reader, error) {
+	enc, _ := lookupCharset(label)
+	if enc == nil {
+		if strings.EqualFold(label, "utf-8") || strings.EqualFold(label, "utf8") {
+			return input, nil
+		}
+		return nil, fmt.Errorf("unsupported charset %s", label)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
@@ -0,0 +1,313 @@
+package imap
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// messageSearch is the set of conditions sent to the server in a SEARCH
+// command. Criteria holds the RFC 3501 search keys, while Extra holds any
+// extension keys (e.g. YOUNGER and OLDER from RFC 5032) that
+// imap.SearchCriteria cannot express. All keys are ANDed together.
+type messageSearch struct {
+	Criteria *imap.SearchCriteria
+	Extra    []interface{}
+}
+
+func newMessageSearch() *messageSearch {
+	return &messageSearch{Criteria: imap.NewSearchCriteria()}
+}
+
+// addKey appends an extension search key and its arguments.
+func (s *messageSearch) addKey(key string, args ...interface{}) {
+	s.Extra = append(s.Extra, imap.RawString(key))
+	s.Extra = append(s.Extra, args...)
+}
+
+func (s *messageSearch) format() []interface{} {
+	return append(s.Criteria.Format(), s.Extra...)
+}
+
+// searchCommand is a SEARCH command, as defined in RFC 3501 section 6.4.4,
+// built from a messageSearch.
+type searchCommand struct {
+	Charset string
+	Search  *messageSearch
+}
+
+func (cmd *searchCommand) Command() *imap.Command {
+	var args []interface{}
+	if cmd.Charset != "" {
+		args = append(args, imap.RawString("CHARSET"), imap.RawString(cmd.Charset))
+	}
+	args = append(args, cmd.Search.format()...)
+
+	return &imap.Command{
+		Name:      "SEARCH",
+		Arguments: args,
+	}
+}
+
+// search runs the search against the selected mailbox and returns the UIDs of
+// the matching messages.
+func (s *messageSearch) search(c *client.Client) ([]uint32, error) {
+	ids, status, err := s.execute(c, "UTF-8")
+	if status != nil && status.Code == imap.CodeBadCharset {
+		// Some servers don't support UTF-8
+		ids, _, err = s.execute(c, "US-ASCII")
+	}
+	return ids, err
+}
+
+func (s *messageSearch) execute(c *client.Client, charset string) ([]uint32, *imap.StatusResp, error) {
+	if c.State() != imap.SelectedState {
+		return nil, nil, client.ErrNoMailboxSelected
+	}
+	res := new(responses.Search)
+	status, err := c.Execute(&commands.Uid{Cmd: &searchCommand{Charset: charset, Search: s}}, res)
+	if err != nil {
+		return nil, status, err
+	}
+	return res.Ids, status, status.Err()
+}
+
+// sortCriterion is an RFC 5256 sort key, e.g. ARRIVAL or DATE.
+type sortCriterion struct {
+	Key     string
+	Reverse bool
+}
+
+// sortCommand is a SORT command, as defined in RFC 5256. If Partial is set the
+// ESORT and CONTEXT=SORT extensions (RFC 5267) are used to return just the
+// first Partial results.
+type sortCommand struct {
+	Charset  string
+	Criteria []sortCriterion
+	Partial  uint32
+	Search   *messageSearch
+}
+
+func (cmd *sortCommand) Command() *imap.Command {
+	var args []interface{}
+	if cmd.Partial > 0 {
+		partial := new(imap.SeqSet)
+		partial.AddRange(1, cmd.Partial)
+		args = append(args, imap.RawString("RETURN"), []interface{}{imap.RawString("PARTIAL"), partial})
+	}
+	var keys []interface{}
+	for _, sc := range cmd.Criteria {
+		if sc.Reverse {
+			keys = append(keys, imap.RawString("REVERSE"))
+		}
+		keys = append(keys, imap.RawString(sc.Key))
+	}
+	args = append(args, keys, imap.RawString(cmd.Charset))
+	args = append(args, cmd.Search.format()...)
+
+	return &imap.Command{
+		Name:      "SORT",
+		Arguments: args,
+	}
+}
+
+// sortResponse handles both the SORT response and, for a partial sort, the
+// ESEARCH response.
+type sortResponse struct {
+	Ids []uint32
+}
+
+func (r *sortResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok {
+		return responses.ErrUnhandled
+	}
+	switch name {
+	case "SORT":
+		for _, f := range fields {
+			id, err := imap.ParseNumber(f)
+			if err != nil {
+				return err
+			}
+			r.Ids = append(r.Ids, id)
+		}
+		return nil
+	case "ESEARCH":
+		// e.g. * ESEARCH (TAG "A1") PARTIAL (1:10 34,29:27,15)
+		for i := 0; i < len(fields)-1; i++ {
+			key, _ := fields[i].(string)
+			if !strings.EqualFold(key, "PARTIAL") {
+				continue
+			}
+			partial, _ := fields[i+1].([]interface{})
+			if len(partial) < 2 {
+				return nil
+			}
+			set, _ := partial[1].(string)
+			ids, err := parseOrderedSeqSet(set)
+			if err != nil {
+				return err
+			}
+			r.Ids = ids
+		}
+		return nil
+	}
+	return responses.ErrUnhandled
+}
+
+// parseOrderedSeqSet expands a sequence set while keeping its order, which
+// imap.ParseSeqSet does not. Ranges such as 29:27 are expanded in the order
+// given.
+func parseOrderedSeqSet(set string) ([]uint32, error) {
+	var ids []uint32
+	if set == "" || set == "NIL" {
+		return ids, nil
+	}
+	for _, part := range strings.Split(set, ",") {
+		bounds := strings.SplitN(part, ":", 2)
+		from, err := strconv.ParseUint(bounds[0], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.ParseUint(bounds[1], 10, 32); err != nil {
+				return nil, err
+			}
+		}
+		for n := from; ; {
+			ids = append(ids, uint32(n))
+			if n == to {
+				break
+			}
+			if n < to {
+				n++
+			} else {
+				n--
+			}
+		}
+	}
+	return ids, nil
+}
+
+// sort runs the search against the selected mailbox and returns the UIDs of
+// the matching messages in the requested order. Servers with the SORT extension do
+// the sorting, and with ESORT and CONTEXT=SORT only the first limit results are
+// returned. Otherwise just the sort keys are fetched and sorted locally.
+func (s *messageSearch) sort(c *client.Client, criteria []sortCriterion, limit int) ([]uint32, error) {
+	if ok, _ := c.Support("SORT"); !ok {
+		ids, err := s.search(c)
+		if err != nil || len(ids) == 0 {
+			return ids, err
+		}
+		return sortLocally(c, ids, criteria)
+	}
+
+	cmd := &sortCommand{Criteria: criteria, Search: s}
+	esort, _ := c.Support("ESORT")
+	partial, _ := c.Support("CONTEXT=SORT")
+	if esort && partial && limit > 0 {
+		cmd.Partial = uint32(limit)
+	}
+
+	ids, status, err := executeSort(c, cmd, "UTF-8")
+	if status != nil && status.Code == imap.CodeBadCharset {
+		// Some servers don't support UTF-8
+		ids, _, err = executeSort(c, cmd, "US-ASCII")
+	}
+	return ids, err
+}
+
+func executeSort(c *client.Client, cmd *sortCommand, charset string) ([]uint32, *imap.StatusResp, error) {
+	if c.State() != imap.SelectedState {
+		return nil, nil, client.ErrNoMailboxSelected
+	}
+	cmd.Charset = charset
+	res := new(sortResponse)
+	status, err := c.Execute(&commands.Uid{Cmd: cmd}, res)
+	if err != nil {
+		return nil, status, err
+	}
+	return res.Ids, status, status.Err()
+}
+
+// sortLocally orders the messages the same way as the SORT extension, by
+// fetching only the items needed for the sort keys. Ties are broken by UID,
+// which is in the same order as the sequence number.
+func sortLocally(c *client.Client, uids []uint32, criteria []sortCriterion) ([]uint32, error) {
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate}
+	for _, sc := range criteria {
+		switch sc.Key {
+		case "DATE":
+			items = append(items, imap.FetchEnvelope)
+		case "SIZE":
+			items = append(items, imap.FetchRFC822Size)
+		}
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, items, messages)
+	}()
+	var list []*imap.Message
+	for msg := range messages {
+		list = append(list, msg)
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		for _, sc := range criteria {
+			cmp := compareSortKey(list[i], list[j], sc.Key)
+			if sc.Reverse {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return list[i].Uid < list[j].Uid
+	})
+
+	sorted := make([]uint32, len(list))
+	for i, msg := range list {
+		sorted[i] = msg.Uid
+	}
+	return sorted, nil
+}
+
+func compareSortKey(a, b *imap.Message, key string) int {
+	switch key {
+	case "ARRIVAL":
+		return a.InternalDate.Compare(b.InternalDate)
+	case "DATE":
+		return sortDate(a).Compare(sortDate(b))
+	case "SIZE":
+		switch {
+		case a.Size < b.Size:
+			return -1
+		case a.Size > b.Size:
+			return 1
+		}
+	}
+	return 0
+}
+
+// sortDate is the sent date used by the DATE sort key, falling back to the
+// internal date if the message has no valid Date header.
+func sortDate(msg *imap.Message) time.Time {
+	if msg.Envelope != nil && !msg.Envelope.Date.IsZero() {
+		return msg.Envelope.Date
+	}
+	return msg.InternalDate
+}
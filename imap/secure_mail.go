@@ -0,0 +1,483 @@
+package imap
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/smallstep/pkcs7"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+)
+
+// S/MIME (RFC 8551) and PGP (RFC 3156 and inline) signatures are verified
+// here, against the certificates of smime_ca_file and the keys of
+// pgp_keyring_file, so no network access is needed. The system's CAs are not
+// used for S/MIME, as they are trusted to vouch for web servers rather than
+// for email addresses. A signature inside encrypted content can't be seen, so
+// only the encryption is reported.
+
+// Values of the signature_type column
+const (
+	signatureTypeSMIME = "smime"
+	signatureTypePGP   = "pgp"
+	signatureTypeNone  = "none"
+)
+
+// maxSecureMailDepth limits how deeply nested multiparts are searched for
+// signed or encrypted parts, e.g. a signed message forwarded as a part of a
+// multipart/mixed with a mailing list footer.
+const maxSecureMailDepth = 10
+
+var (
+	// Content types of S/MIME signed data
+	oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	// Content types of S/MIME encrypted data
+	oidEnvelopedData     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidAuthEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 23}
+	// Inline PGP encrypted text
+	pgpMessageBlock = regexp.MustCompile(`(?m)^-----BEGIN PGP MESSAGE-----\r?$`)
+	// Armored public keys, of which a keyring file may have several
+	pgpPublicKeyBlock = regexp.MustCompile(`(?s)-----BEGIN PGP PUBLIC KEY BLOCK-----.*?-----END PGP PUBLIC KEY BLOCK-----`)
+)
+
+// secureMail holds whether a message is signed or encrypted with S/MIME or
+// PGP, and the result of verifying its signature.
+type secureMail struct {
+	SignatureType string
+	Encrypted     bool
+	// SignatureValid is nil if the message is not signed, or the PGP key that
+	// signed it is not in the keyring
+	SignatureValid  *bool
+	SignerSubject   string
+	SignerEmail     string
+	SignerIssuer    string
+	SignerExpiresAt time.Time
+	PGPKeyID        string
+	// Errors explain why a signature did not verify
+	Errors []string
+}
+
+// secureMailTrust is what signatures are verified against. roots is nil if
+// smime_ca_file is not configured.
+type secureMailTrust struct {
+	roots   *x509.CertPool
+	keyring openpgp.EntityList
+}
+
+var secureMailTrusts sync.Map // smime_ca_file and pgp_keyring_file -> *secureMailTrust
+
+// newSecureMailTrust returns the trusted certificates and keys of the
+// connection: the CA certificates of smime_ca_file and the keys of
+// pgp_keyring_file. Files are only read once.
+func newSecureMailTrust(d *plugin.QueryData) (*secureMailTrust, error) {
+	imapConfig := GetConfig(d.Connection)
+	var caFile, keyringFile string
+	var err error
+	if imapConfig.SMIMECAFile != nil && *imapConfig.SMIMECAFile != "" {
+		if caFile, err = expandHome(*imapConfig.SMIMECAFile); err != nil {
+			return nil, err
+		}
+	}
+	if imapConfig.PGPKeyringFile != nil && *imapConfig.PGPKeyringFile != "" {
+		if keyringFile, err = expandHome(*imapConfig.PGPKeyringFile); err != nil {
+			return nil, err
+		}
+	}
+	key := caFile + "\x00" + keyringFile
+	if t, ok := secureMailTrusts.Load(key); ok {
+		return t.(*secureMailTrust), nil
+	}
+
+	t := &secureMailTrust{}
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read smime_ca_file: %w", err)
+		}
+		t.roots = x509.NewCertPool()
+		if !t.roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("smime_ca_file has no PEM encoded certificates")
+		}
+	}
+	if keyringFile != "" {
+		if t.keyring, err = readPGPKeyring(keyringFile); err != nil {
+			return nil, err
+		}
+	}
+	v, _ := secureMailTrusts.LoadOrStore(key, t)
+	return v.(*secureMailTrust), nil
+}
+
+// readPGPKeyring reads a keyring of public keys, either binary as from
+// gpg --export, or armored as from gpg --export --armor. Armored files may
+// have several key blocks.
+func readPGPKeyring(path string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read pgp_keyring_file: %w", err)
+	}
+	blocks := pgpPublicKeyBlock.FindAll(data, -1)
+	if blocks == nil {
+		keyring, err := openpgp.ReadKeyRing(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("pgp_keyring_file: %w", err)
+		}
+		return keyring, nil
+	}
+	var keyring openpgp.EntityList
+	for _, block := range blocks {
+		keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(block))
+		if err != nil {
+			return nil, fmt.Errorf("pgp_keyring_file: %w", err)
+		}
+		keyring = append(keyring, keys...)
+	}
+	return keyring, nil
+}
+
+// secureMailVerifier finds the signed or encrypted part of a message.
+type secureMailVerifier struct {
+	trust *secureMailTrust
+	// at is the time the message was received, when certificates and keys
+	// must have been valid
+	at time.Time
+	// from is the address of the From field, in lower case, which signers'
+	// certificates and keys must have
+	from   string
+	result secureMail
+}
+
+// checkSecureMail returns whether a message is signed or encrypted, and
+// verifies its signature.
+func checkSecureMail(trust *secureMailTrust, raw []byte, at time.Time) secureMail {
+	raw = toCRLF(raw)
+	v := &secureMailVerifier{trust: trust, at: at}
+	header, _ := splitMessage(raw)
+	if from, err := mail.ParseAddress(headerValue(readHeaderFields(header), "From")); err == nil {
+		v.from = strings.ToLower(from.Address)
+	}
+	v.result.SignatureType = signatureTypeNone
+	v.walk(raw, 0)
+	return v.result
+}
+
+// walk searches a part and its children for the first signed or encrypted
+// part, and returns true if it found one.
+func (v *secureMailVerifier) walk(part []byte, depth int) bool {
+	header, body := splitMessage(part)
+	fields := readHeaderFields(header)
+	mediaType, params, err := mime.ParseMediaType(headerValue(fields, "Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	switch mediaType {
+	case "multipart/signed":
+		parts := multipartBodies(body, params["boundary"])
+		if len(parts) < 2 {
+			return false
+		}
+		sigHeader, sigBody := splitMessage(parts[1])
+		signature := decodeTransferEncoding(readHeaderFields(sigHeader), sigBody)
+		switch strings.ToLower(params["protocol"]) {
+		case "application/pkcs7-signature", "application/x-pkcs7-signature":
+			v.verifySMIME(signature, parts[0])
+		case "application/pgp-signature":
+			v.verifyPGP(parts[0], signature)
+		default:
+			return false
+		}
+		return true
+	case "multipart/encrypted":
+		v.result.Encrypted = true
+		return true
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		return v.readPKCS7MIME(params, decodeTransferEncoding(fields, body))
+	case "text/plain":
+		return v.readInlinePGP(decodeTransferEncoding(fields, body))
+	}
+	if strings.HasPrefix(mediaType, "multipart/") && depth < maxSecureMailDepth {
+		for _, p := range multipartBodies(body, params["boundary"]) {
+			if v.walk(p, depth+1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readPKCS7MIME reads an application/pkcs7-mime part, which is either
+// encrypted or signed with the content inside the signature.
+func (v *secureMailVerifier) readPKCS7MIME(params map[string]string, data []byte) bool {
+	// Senders may omit smime-type, so it's taken from the content type of
+	// the PKCS #7 data
+	smimeType := strings.ToLower(params["smime-type"])
+	if smimeType == "" {
+		switch oid := pkcs7ContentType(data); {
+		case oid.Equal(oidSignedData):
+			smimeType = "signed-data"
+		case oid.Equal(oidEnvelopedData), oid.Equal(oidAuthEnvelopedData):
+			smimeType = "enveloped-data"
+		}
+	}
+	switch smimeType {
+	case "enveloped-data", "authenveloped-data":
+		v.result.Encrypted = true
+		return true
+	case "signed-data":
+		v.verifySMIME(data, nil)
+		return true
+	}
+	return false
+}
+
+// verifySMIME verifies a PKCS #7 signature, of the content if it's detached
+// or else of the content it holds, that the signer's certificate chains to a
+// CA of smime_ca_file, and that it is for the From address (RFC 8551 section
+// 3.1). Without smime_ca_file the signature is not verified.
+func (v *secureMailVerifier) verifySMIME(signature, content []byte) {
+	v.result.SignatureType = signatureTypeSMIME
+	p7, err := pkcs7.Parse(signature)
+	if err != nil {
+		v.invalid(fmt.Errorf("smime: %w", err))
+		return
+	}
+	if content != nil {
+		p7.Content = content
+	}
+	cert := p7.GetOnlySigner()
+	if cert != nil {
+		v.result.SignerSubject = cert.Subject.String()
+		v.result.SignerIssuer = cert.Issuer.String()
+		v.result.SignerEmail = certificateEmail(cert)
+		v.result.SignerExpiresAt = cert.NotAfter
+	}
+	if v.trust.roots == nil {
+		v.result.Errors = append(v.result.Errors, "smime: smime_ca_file is not configured")
+		return
+	}
+	if err := p7.VerifyWithChainAtTime(v.trust.roots, v.at); err != nil {
+		v.invalid(fmt.Errorf("smime: %w", err))
+		return
+	}
+	if cert == nil || !certificateHasEmail(cert, v.from) {
+		v.invalid(errors.New("smime: signer's certificate is not for the From address"))
+		return
+	}
+	v.valid()
+}
+
+// verifyPGP verifies a detached PGP signature, armored or binary, of the
+// signed content.
+func (v *secureMailVerifier) verifyPGP(signed, signature []byte) {
+	v.result.SignatureType = signatureTypePGP
+	if block, err := armor.Decode(bytes.NewReader(signature)); err == nil {
+		if signature, err = io.ReadAll(block.Body); err != nil {
+			v.invalid(fmt.Errorf("pgp: %w", err))
+			return
+		}
+	}
+	p, err := packet.Read(bytes.NewReader(signature))
+	if err != nil {
+		v.invalid(fmt.Errorf("pgp: %w", err))
+		return
+	}
+	sig, ok := p.(*packet.Signature)
+	if !ok || sig.IssuerKeyId == nil {
+		v.invalid(errors.New("pgp: signature has no issuer key ID"))
+		return
+	}
+	v.result.PGPKeyID = fmt.Sprintf("%016X", *sig.IssuerKeyId)
+
+	keys := v.trust.keyring.KeysById(*sig.IssuerKeyId)
+	if len(keys) == 0 {
+		v.result.Errors = append(v.result.Errors, fmt.Sprintf("pgp: key %s is not in pgp_keyring_file", v.result.PGPKeyID))
+		return
+	}
+	if identity := keys[0].Entity.PrimaryIdentity(); identity != nil {
+		v.result.SignerSubject = identity.Name
+		if identity.UserId != nil {
+			v.result.SignerEmail = strings.ToLower(identity.UserId.Email)
+		}
+	}
+	if self := keys[0].SelfSignature; self != nil && self.KeyLifetimeSecs != nil && *self.KeyLifetimeSecs > 0 {
+		v.result.SignerExpiresAt = keys[0].PublicKey.CreationTime.Add(time.Duration(*self.KeyLifetimeSecs) * time.Second)
+	}
+
+	config := &packet.Config{Time: func() time.Time { return v.at }}
+	if _, _, err := openpgp.VerifyDetachedSignature(v.trust.keyring, bytes.NewReader(signed), bytes.NewReader(signature), config); err != nil {
+		if errors.Is(err, pgperrors.ErrUnknownIssuer) {
+			v.result.Errors = append(v.result.Errors, fmt.Sprintf("pgp: %s", err))
+			return
+		}
+		v.invalid(fmt.Errorf("pgp: %w", err))
+		return
+	}
+	if !entityHasEmail(keys[0].Entity, v.from) {
+		v.invalid(errors.New("pgp: signer's key has no user ID for the From address"))
+		return
+	}
+	v.valid()
+}
+
+// entityHasEmail reports whether any user ID of a PGP key has the address.
+func entityHasEmail(entity *openpgp.Entity, address string) bool {
+	if address == "" {
+		return false
+	}
+	for _, identity := range entity.Identities {
+		if identity.UserId != nil && strings.ToLower(identity.UserId.Email) == address {
+			return true
+		}
+	}
+	return false
+}
+
+// readInlinePGP reads text that is clearsigned, or encrypted, with PGP.
+func (v *secureMailVerifier) readInlinePGP(text []byte) bool {
+	if block, _ := clearsign.Decode(text); block != nil {
+		signature, err := io.ReadAll(block.ArmoredSignature.Body)
+		if err != nil {
+			v.result.SignatureType = signatureTypePGP
+			v.invalid(fmt.Errorf("pgp: %w", err))
+			return true
+		}
+		v.verifyPGP(block.Bytes, signature)
+		return true
+	}
+	if pgpMessageBlock.Match(text) {
+		v.result.Encrypted = true
+		return true
+	}
+	return false
+}
+
+func (v *secureMailVerifier) valid() {
+	valid := true
+	v.result.SignatureValid = &valid
+}
+
+func (v *secureMailVerifier) invalid(err error) {
+	valid := false
+	v.result.SignatureValid = &valid
+	v.result.Errors = append(v.result.Errors, err.Error())
+}
+
+// certificateEmail returns the email address of a certificate, from its
+// subject alternative names or else its subject.
+func certificateEmail(cert *x509.Certificate) string {
+	if len(cert.EmailAddresses) > 0 {
+		return strings.ToLower(cert.EmailAddresses[0])
+	}
+	oidEmailAddress := asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+	for _, name := range cert.Subject.Names {
+		if s, ok := name.Value.(string); ok && name.Type.Equal(oidEmailAddress) {
+			return strings.ToLower(s)
+		}
+	}
+	return ""
+}
+
+// certificateHasEmail says whether a certificate is for an email address, in
+// lower case, in its subject alternative names or else its subject.
+func certificateHasEmail(cert *x509.Certificate, address string) bool {
+	if address == "" {
+		return false
+	}
+	if len(cert.EmailAddresses) > 0 {
+		for _, email := range cert.EmailAddresses {
+			if strings.ToLower(email) == address {
+				return true
+			}
+		}
+		return false
+	}
+	return certificateEmail(cert) == address
+}
+
+// pkcs7ContentType returns the content type of PKCS #7 data, which may be
+// BER encoded with an indefinite length, or nil if it can't be read.
+func pkcs7ContentType(data []byte) asn1.ObjectIdentifier {
+	// ContentInfo is a SEQUENCE starting with the OID
+	if len(data) < 2 || data[0] != 0x30 {
+		return nil
+	}
+	n := 2
+	if data[1] > 0x80 {
+		n += int(data[1] & 0x7f)
+	}
+	if len(data) < n {
+		return nil
+	}
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(data[n:], &oid); err != nil {
+		return nil
+	}
+	return oid
+}
+
+// multipartBodies splits the body of a multipart into its parts, each with
+// its header and exactly as sent, as a multipart/signed signs the first.
+// The CRLF before each delimiter belongs to the delimiter (RFC 2046 section
+// 5.1.1).
+func multipartBodies(body []byte, boundary string) [][]byte {
+	if boundary == "" {
+		return nil
+	}
+	delimiter := []byte("\r\n--" + boundary)
+	// The first delimiter may start the body
+	b := append([]byte("\r\n"), body...)
+	var parts [][]byte
+	for i := bytes.Index(b, delimiter); i >= 0; {
+		rest := b[i+len(delimiter):]
+		if bytes.HasPrefix(rest, []byte("--")) {
+			break
+		}
+		// Skip any transport padding after the delimiter
+		eol := bytes.Index(rest, []byte("\r\n"))
+		if eol < 0 {
+			break
+		}
+		rest = rest[eol+2:]
+		end := bytes.Index(rest, delimiter)
+		if end < 0 {
+			break
+		}
+		parts = append(parts, rest[:end])
+		b, i = rest[end:], 0
+	}
+	return parts
+}
+
+// decodeTransferEncoding decodes the body of a part from its
+// Content-Transfer-Encoding, returning it as is if it can't be decoded.
+func decodeTransferEncoding(fields []headerField, body []byte) []byte {
+	switch strings.ToLower(headerValue(fields, "Content-Transfer-Encoding")) {
+	case "base64":
+		if decoded, err := base64.StdEncoding.DecodeString(stripSpace(string(body))); err == nil {
+			return decoded
+		}
+	case "quoted-printable":
+		if decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body))); err == nil {
+			return decoded
+		}
+	}
+	return body
+}
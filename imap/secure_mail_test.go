@@ -0,0 +1,62 @@
+package imap
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+)
+
+func TestVerifyPGPFrom(t *testing.T) {
+	at := time.Now()
+	signer, err := openpgp.NewEntity("Dwight Schrute", "", "dwight@dundermifflin.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := openpgp.NewEntity("Jim Halpert", "", "jim@dundermifflin.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var text bytes.Buffer
+	w, err := clearsign.Encode(&text, signer.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("Bears. Beets. Battlestar Galactica.\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		from    string
+		keyring openpgp.EntityList
+		want    *bool
+	}{
+		{"signer is the sender", "Dwight Schrute <Dwight@DunderMifflin.com>", openpgp.EntityList{signer}, boolPtr(true)},
+		{"signer is not the sender", "Jim Halpert <jim@dundermifflin.com>", openpgp.EntityList{signer, other}, boolPtr(false)},
+		{"no From field", "", openpgp.EntityList{signer}, boolPtr(false)},
+		{"key is not in the keyring", "dwight@dundermifflin.com", openpgp.EntityList{other}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "Subject: Test\r\nContent-Type: text/plain\r\n"
+			if tt.from != "" {
+				raw += "From: " + tt.from + "\r\n"
+			}
+			raw += "\r\n" + text.String()
+			result := checkSecureMail(&secureMailTrust{keyring: tt.keyring}, []byte(raw), at)
+			if result.SignatureType != signatureTypePGP {
+				t.Fatalf("signature type = %q, want %q", result.SignatureType, signatureTypePGP)
+			}
+			if !equalBoolPtr(result.SignatureValid, tt.want) {
+				t.Errorf("signature valid = %s, want %s (errors %q)", fmtBoolPtr(result.SignatureValid), fmtBoolPtr(tt.want), result.Errors)
+			}
+		})
+	}
+}
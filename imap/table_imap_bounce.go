@@ -0,0 +1,77 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin/transform"
+)
+
+func tableIMAPBounce(ctx context.Context) *plugin.Table {
+	return &plugin.Table{
+		Name:        "imap_bounce",
+		Description: "Recipients of the bounces (delivery status notifications) in IMAP.",
+		List: &plugin.ListConfig{
+			Hydrate: tableIMAPBounceList,
+			KeyColumns: []*plugin.KeyColumn{
+				{Name: "mailbox", Require: plugin.Optional},
+				{Name: "uid", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+				{Name: "received_at", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+			},
+		},
+		Columns: commonColumns([]*plugin.Column{
+			// Top columns
+			{Name: "mailbox", Type: proto.ColumnType_STRING, Description: "Mailbox holding the bounce message."},
+			{Name: "uid", Type: proto.ColumnType_INT, Transform: transform.FromField("UID"), Description: "Unique identifier of the bounce message in the mailbox."},
+			{Name: "final_recipient", Type: proto.ColumnType_STRING, Transform: transform.FromField("FinalRecipient").Transform(transform.NullIfZeroValue), Description: "Address the delivery was attempted to."},
+			{Name: "original_recipient", Type: proto.ColumnType_STRING, Transform: transform.FromField("OriginalRecipient").Transform(transform.NullIfZeroValue), Description: "Address the message was originally sent to, if it was forwarded or rewritten and the server reported it."},
+			{Name: "action", Type: proto.ColumnType_STRING, Transform: transform.FromField("Action").Transform(transform.NullIfZeroValue), Description: "What happened to the message for the recipient: failed, delayed, delivered, relayed or expanded."},
+			{Name: "status", Type: proto.ColumnType_STRING, Transform: transform.FromField("Status").Transform(transform.NullIfZeroValue), Description: "Enhanced status code, e.g. 5.1.1 for an unknown mailbox. Codes starting with 5 are permanent failures, and 4 temporary ones."},
+			{Name: "diagnostic_code", Type: proto.ColumnType_STRING, Transform: transform.FromField("DiagnosticCode").Transform(transform.NullIfZeroValue), Description: "Response of the remote server, e.g. 550 5.1.1 User unknown."},
+			{Name: "remote_mta", Type: proto.ColumnType_STRING, Transform: transform.FromField("RemoteMTA").Transform(transform.NullIfZeroValue), Description: "Server that gave the diagnostic code."},
+			{Name: "original_message_id", Type: proto.ColumnType_STRING, Transform: transform.FromField("Bounce.OriginalMessageID").Transform(transform.NullIfZeroValue), Description: "Message-ID of the message that bounced, if the bounce includes a copy of it or of its header."},
+			// Other columns
+			{Name: "format", Type: proto.ColumnType_STRING, Transform: transform.FromField("Bounce.Format"), Description: "Format of the bounce: rfc3464 for a standard delivery status notification, or exchange, gmail or qmail for those servers' plain text formats."},
+			{Name: "last_attempt_date", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("LastAttemptDate").Transform(transform.NullIfZeroValue), Description: "Time of the last delivery attempt, if reported."},
+			{Name: "message_id", Type: proto.ColumnType_STRING, Transform: transform.FromField("MessageID").Transform(transform.NullIfZeroValue), Description: "Message-ID of the bounce message."},
+			{Name: "received_at", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("ReceivedAt").Transform(transform.NullIfZeroValue), Description: "Time when the bounce message was received by the server (INTERNALDATE)."},
+			{Name: "reporting_mta", Type: proto.ColumnType_STRING, Transform: transform.FromField("Bounce.ReportingMTA").Transform(transform.NullIfZeroValue), Description: "Server that sent the bounce."},
+		}),
+	}
+}
+
+type bounceRow struct {
+	Mailbox    string
+	UID        uint32
+	ReceivedAt time.Time
+	MessageID  string
+	Bounce     *bounce
+	bounceRecipient
+}
+
+func tableIMAPBounceList(ctx context.Context, d *plugin.QueryData, _ *plugin.HydrateData) (interface{}, error) {
+	opts := listOptions{Body: true}
+	if imapConfig := GetConfig(d.Connection); imapConfig.BounceMailbox != nil {
+		opts.Mailbox = *imapConfig.BounceMailbox
+	}
+	return nil, listMessages(ctx, d, opts, func(mw msgWrapper) {
+		te := parseMessage(bytes.NewReader(mw.Body), false)
+		b := parseBounce(te.Envelope)
+		if b == nil {
+			return
+		}
+		for _, r := range b.Recipients {
+			d.StreamListItem(ctx, bounceRow{
+				Mailbox:         mw.Mailbox,
+				UID:             mw.Message.Uid,
+				ReceivedAt:      mw.Message.InternalDate,
+				MessageID:       te.MessageID,
+				Bounce:          b,
+				bounceRecipient: r,
+			})
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin/transform"
+)
+
+func tableIMAPCalendarInvite(ctx context.Context) *plugin.Table {
+	return &plugin.Table{
+		Name:        "imap_calendar_invite",
+		Description: "Meeting invitations, replies and cancellations in the text/calendar parts of messages in IMAP.",
+		List: &plugin.ListConfig{
+			Hydrate: tableIMAPCalendarInviteList,
+			KeyColumns: []*plugin.KeyColumn{
+				{Name: "mailbox", Require: plugin.Optional},
+				{Name: "uid", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+				{Name: "received_at", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+			},
+		},
+		Columns: commonColumns([]*plugin.Column{
+			// Top columns
+			{Name: "mailbox", Type: proto.ColumnType_STRING, Description: "Mailbox holding the message."},
+			{Name: "uid", Type: proto.ColumnType_INT, Transform: transform.FromField("UID"), Description: "Unique identifier of the message in the mailbox."},
+			{Name: "method", Type: proto.ColumnType_STRING, Transform: transform.FromField("Method").Transform(transform.NullIfZeroValue), Description: "iTIP method of the calendar: REQUEST for an invitation or update, REPLY, CANCEL, or PUBLISH for an event that needs no answer."},
+			{Name: "event_uid", Type: proto.ColumnType_STRING, Transform: transform.FromField("UID").Transform(transform.NullIfZeroValue), Description: "UID of the event, the same in the invitation, its updates, replies and cancellation."},
+			{Name: "sequence", Type: proto.ColumnType_INT, Description: "Revision of the event, incremented by the organizer for each significant update."},
+			{Name: "summary", Type: proto.ColumnType_STRING, Transform: transform.FromField("Summary").Transform(transform.NullIfZeroValue), Description: "Title of the event."},
+			{Name: "start_time", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("Start").Transform(transform.NullIfZeroValue), Description: "Start of the event (DTSTART). All-day events start at midnight UTC."},
+			{Name: "end_time", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("End").Transform(transform.NullIfZeroValue), Description: "End of the event (DTEND), or its start plus its DURATION."},
+			{Name: "organizer", Type: proto.ColumnType_STRING, Transform: transform.FromField("Organizer").Transform(transform.NullIfZeroValue), Description: "Email address, in lower case, of the organizer."},
+			{Name: "partstat", Type: proto.ColumnType_STRING, Transform: transform.FromField("PartStat").Transform(transform.NullIfZeroValue), Description: "Answer in a REPLY: ACCEPTED, DECLINED, TENTATIVE or DELEGATED."},
+			// Other columns
+			{Name: "all_day", Type: proto.ColumnType_BOOL, Transform: transform.FromField("AllDay"), Description: "True if the event is for whole days, rather than from a time of day."},
+			{Name: "attendees", Type: proto.ColumnType_JSON, Description: "Array of the attendees, with their email, name, role, partstat (participation status) and rsvp (whether an answer is requested)."},
+			{Name: "description", Type: proto.ColumnType_STRING, Transform: transform.FromField("Description").Transform(transform.NullIfZeroValue), Description: "Description of the event."},
+			{Name: "end_time_zone", Type: proto.ColumnType_STRING, Transform: transform.FromField("EndTimeZone").Transform(transform.NullIfZeroValue), Description: "Time zone (TZID) the end is given in, e.g. Europe/Berlin or W. Europe Standard Time."},
+			{Name: "location", Type: proto.ColumnType_STRING, Transform: transform.FromField("Location").Transform(transform.NullIfZeroValue), Description: "Location of the event, e.g. a room or a meeting URL."},
+			{Name: "message_id", Type: proto.ColumnType_STRING, Transform: transform.FromField("MessageID").Transform(transform.NullIfZeroValue), Description: "Message-ID of the message."},
+			{Name: "organizer_name", Type: proto.ColumnType_STRING, Transform: transform.FromField("OrganizerName").Transform(transform.NullIfZeroValue), Description: "Name (CN) of the organizer."},
+			{Name: "received_at", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("ReceivedAt").Transform(transform.NullIfZeroValue), Description: "Time when the message was received by the server (INTERNALDATE)."},
+			{Name: "recurrence_id", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("RecurrenceID").Transform(transform.NullIfZeroValue), Description: "Original start of the occurrence of a recurring event that this event changes."},
+			{Name: "rrule", Type: proto.ColumnType_STRING, Transform: transform.FromField("RRule").Transform(transform.NullIfZeroValue), Description: "Recurrence rule of a recurring event, e.g. FREQ=WEEKLY;BYDAY=MO."},
+			{Name: "start_time_zone", Type: proto.ColumnType_STRING, Transform: transform.FromField("StartTimeZone").Transform(transform.NullIfZeroValue), Description: "Time zone (TZID) the start is given in, e.g. Europe/Berlin or W. Europe Standard Time."},
+			{Name: "status", Type: proto.ColumnType_STRING, Transform: transform.FromField("Status").Transform(transform.NullIfZeroValue), Description: "Status of the event: TENTATIVE, CONFIRMED or CANCELLED."},
+		}),
+	}
+}
+
+type calendarInviteRow struct {
+	Mailbox    string
+	UID        uint32
+	ReceivedAt time.Time
+	MessageID  string
+	calendarEvent
+}
+
+func tableIMAPCalendarInviteList(ctx context.Context, d *plugin.QueryData, _ *plugin.HydrateData) (interface{}, error) {
+	return nil, listMessages(ctx, d, listOptions{Body: true}, func(mw msgWrapper) {
+		te := parseMessage(bytes.NewReader(mw.Body), false)
+		for _, e := range calendarEvents(te.Envelope) {
+			d.StreamListItem(ctx, calendarInviteRow{
+				Mailbox:       mw.Mailbox,
+				UID:           mw.Message.Uid,
+				ReceivedAt:    mw.Message.InternalDate,
+				MessageID:     te.MessageID,
+				calendarEvent: e,
+			})
+		}
+	})
+}
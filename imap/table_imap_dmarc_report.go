@@ -0,0 +1,107 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin/transform"
+)
+
+func tableIMAPDMARCReport(ctx context.Context) *plugin.Table {
+	return &plugin.Table{
+		Name:        "imap_dmarc_report",
+		Description: "Records of the DMARC aggregate reports attached to messages in IMAP.",
+		List: &plugin.ListConfig{
+			Hydrate: tableIMAPDMARCReportList,
+			KeyColumns: []*plugin.KeyColumn{
+				{Name: "mailbox", Require: plugin.Optional},
+				{Name: "uid", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+				{Name: "received_at", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+			},
+		},
+		Columns: commonColumns([]*plugin.Column{
+			// Top columns
+			{Name: "org_name", Type: proto.ColumnType_STRING, Transform: transform.FromField("Feedback.ReportMetadata.OrgName"), Description: "Organization that sent the report, e.g. google.com."},
+			{Name: "report_id", Type: proto.ColumnType_STRING, Transform: transform.FromField("Feedback.ReportMetadata.ReportID"), Description: "Identifier of the report, unique for the reporting organization."},
+			{Name: "date_begin", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("Feedback.ReportMetadata.DateRange.Begin").Transform(dmarcDateTransform), Description: "Start of the period the report covers."},
+			{Name: "date_end", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("Feedback.ReportMetadata.DateRange.End").Transform(dmarcDateTransform), Description: "End of the period the report covers."},
+			{Name: "source_ip", Type: proto.ColumnType_IPADDR, Transform: transform.FromField("Record.Row.SourceIP").Transform(transform.NullIfZeroValue), Description: "IP address the messages of the record were sent from."},
+			{Name: "count", Type: proto.ColumnType_INT, Transform: transform.FromField("Record.Row.Count"), Description: "Number of messages sent from the source IP with the same results."},
+			{Name: "disposition", Type: proto.ColumnType_STRING, Transform: transform.FromField("Record.Row.PolicyEvaluated.Disposition"), Description: "Policy applied to the messages: none, quarantine or reject."},
+			{Name: "dkim_alignment", Type: proto.ColumnType_STRING, Transform: transform.FromField("Record.Row.PolicyEvaluated.DKIM"), Description: "Result of DKIM for DMARC, pass if a DKIM signature passed and is aligned with the header_from domain, or fail."},
+			{Name: "spf_alignment", Type: proto.ColumnType_STRING, Transform: transform.FromField("Record.Row.PolicyEvaluated.SPF"), Description: "Result of SPF for DMARC, pass if SPF passed and is aligned with the header_from domain, or fail."},
+			{Name: "header_from", Type: proto.ColumnType_STRING, Transform: transform.FromField("Record.Identifiers.HeaderFrom"), Description: "Domain of the From header of the messages."},
+			// Other columns
+			{Name: "dkim_auth_results", Type: proto.ColumnType_JSON, Transform: transform.FromField("Record.AuthResults.DKIM"), Description: "Results of each DKIM signature, whether aligned or not, with its domain and selector."},
+			{Name: "email", Type: proto.ColumnType_STRING, Transform: transform.FromField("Feedback.ReportMetadata.Email").Transform(transform.NullIfZeroValue), Description: "Contact email address of the reporting organization."},
+			{Name: "envelope_from", Type: proto.ColumnType_STRING, Transform: transform.FromField("Record.Identifiers.EnvelopeFrom").Transform(transform.NullIfZeroValue), Description: "Domain of the envelope sender (RFC5321.MailFrom) of the messages."},
+			{Name: "envelope_to", Type: proto.ColumnType_STRING, Transform: transform.FromField("Record.Identifiers.EnvelopeTo").Transform(transform.NullIfZeroValue), Description: "Domain of the envelope recipients of the messages."},
+			{Name: "file_name", Type: proto.ColumnType_STRING, Description: "Name of the report file, after unpacking any zip or gzip attachment."},
+			{Name: "mailbox", Type: proto.ColumnType_STRING, Description: "Mailbox holding the report message."},
+			{Name: "policy_adkim", Type: proto.ColumnType_STRING, Transform: transform.FromField("Feedback.PolicyPublished.ADKIM").Transform(transform.NullIfZeroValue), Description: "Published DKIM alignment mode: r for relaxed or s for strict."},
+			{Name: "policy_aspf", Type: proto.ColumnType_STRING, Transform: transform.FromField("Feedback.PolicyPublished.ASPF").Transform(transform.NullIfZeroValue), Description: "Published SPF alignment mode: r for relaxed or s for strict."},
+			{Name: "policy_domain", Type: proto.ColumnType_STRING, Transform: transform.FromField("Feedback.PolicyPublished.Domain"), Description: "Domain whose published DMARC policy was applied."},
+			{Name: "policy_p", Type: proto.ColumnType_STRING, Transform: transform.FromField("Feedback.PolicyPublished.P"), Description: "Published policy for the domain: none, quarantine or reject."},
+			{Name: "policy_pct", Type: proto.ColumnType_INT, Transform: transform.FromField("Feedback.PolicyPublished.PCT"), Description: "Published percentage of messages the policy applies to."},
+			{Name: "policy_published", Type: proto.ColumnType_JSON, Transform: transform.FromField("Feedback.PolicyPublished"), Description: "DMARC policy published for the domain, as seen by the reporter."},
+			{Name: "policy_sp", Type: proto.ColumnType_STRING, Transform: transform.FromField("Feedback.PolicyPublished.SP").Transform(transform.NullIfZeroValue), Description: "Published policy for subdomains: none, quarantine or reject."},
+			{Name: "reasons", Type: proto.ColumnType_JSON, Transform: transform.FromField("Record.Row.PolicyEvaluated.Reasons"), Description: "Reasons the disposition differs from the published policy, e.g. forwarded or mailing_list."},
+			{Name: "received_at", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("ReceivedAt").Transform(transform.NullIfZeroValue), Description: "Time when the report message was received by the server (INTERNALDATE)."},
+			{Name: "report_errors", Type: proto.ColumnType_JSON, Transform: transform.FromField("Feedback.ReportMetadata.Errors"), Description: "Errors the reporter had while evaluating the messages."},
+			{Name: "spf_auth_results", Type: proto.ColumnType_JSON, Transform: transform.FromField("Record.AuthResults.SPF"), Description: "Results of SPF, whether aligned or not, with the domain checked."},
+			{Name: "uid", Type: proto.ColumnType_INT, Transform: transform.FromField("UID"), Description: "Unique identifier of the report message in the mailbox."},
+		}),
+	}
+}
+
+type dmarcReportRow struct {
+	Mailbox    string
+	UID        uint32
+	ReceivedAt time.Time
+	FileName   string
+	Feedback   *dmarcFeedback
+	Record     dmarcRecord
+}
+
+func tableIMAPDMARCReportList(ctx context.Context, d *plugin.QueryData, _ *plugin.HydrateData) (interface{}, error) {
+	opts := listOptions{Body: true}
+	if imapConfig := GetConfig(d.Connection); imapConfig.DMARCReportMailbox != nil {
+		opts.Mailbox = *imapConfig.DMARCReportMailbox
+	}
+	return nil, listMessages(ctx, d, opts, func(mw msgWrapper) {
+		te := parseMessage(bytes.NewReader(mw.Body), false)
+		files, errs := reportFiles(te.Envelope, dmarcReportFormat)
+		for _, err := range errs {
+			plugin.Logger(ctx).Warn("imap_dmarc_report.tableIMAPDMARCReportList", "report_error", err, "mailbox", mw.Mailbox, "uid", mw.Message.Uid)
+		}
+		for _, f := range files {
+			feedback, err := parseDMARCReport(f.Data)
+			if err != nil {
+				plugin.Logger(ctx).Warn("imap_dmarc_report.tableIMAPDMARCReportList", "parse_error", err, "mailbox", mw.Mailbox, "uid", mw.Message.Uid, "file", f.Name)
+				continue
+			}
+			for _, record := range feedback.Records {
+				d.StreamListItem(ctx, dmarcReportRow{
+					Mailbox:    mw.Mailbox,
+					UID:        mw.Message.Uid,
+					ReceivedAt: mw.Message.InternalDate,
+					FileName:   f.Name,
+					Feedback:   feedback,
+					Record:     record,
+				})
+			}
+		}
+	})
+}
+
+// dmarcDateTransform converts the Unix time of a report's date range.
+func dmarcDateTransform(_ context.Context, d *transform.TransformData) (interface{}, error) {
+	t, ok := d.Value.(int64)
+	if !ok || t == 0 {
+		return nil, nil
+	}
+	return time.Unix(t, 0).UTC(), nil
+}
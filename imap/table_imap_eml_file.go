@@ -0,0 +1,152 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin/transform"
+)
+
+func tableIMAPEmlFile(ctx context.Context) *plugin.Table {
+	return &plugin.Table{
+		Name:        "imap_eml_file",
+		Description: "Messages stored in .eml files.",
+		List: &plugin.ListConfig{
+			Hydrate:    tableIMAPEmlFileList,
+			KeyColumns: plugin.OptionalColumns([]string{"path"}),
+		},
+		Columns: commonColumns([]*plugin.Column{
+			// Top columns
+			{Name: "path", Type: proto.ColumnType_STRING, Description: "Path to the .eml file."},
+			{Name: "timestamp", Type: proto.ColumnType_TIMESTAMP, Hydrate: tableIMAPEmlFileParse, Description: "Time when the message was sent."},
+			{Name: "from_email", Type: proto.ColumnType_STRING, Hydrate: tableIMAPEmlFileParse, Transform: transform.FromField("FromAddresses").Transform(getFirstAddress), Description: "Email address, in lower case, of the first (and usually only) mailbox in the From header."},
+			{Name: "subject", Type: proto.ColumnType_STRING, Hydrate: tableIMAPEmlFileParse, Transform: transform.FromField("Subject"), Description: "Subject of the message."},
+			{Name: "message_id", Type: proto.ColumnType_STRING, Hydrate: tableIMAPEmlFileParse, Description: "Unique message identifier that refers to a particular version of a particular message."},
+			{Name: "to_addresses", Type: proto.ColumnType_JSON, Hydrate: tableIMAPEmlFileParse, Description: "Array of To addresses."},
+			{Name: "cc_addresses", Type: proto.ColumnType_JSON, Hydrate: tableIMAPEmlFileParse, Description: "Array of CC addresses."},
+			{Name: "bcc_addresses", Type: proto.ColumnType_JSON, Hydrate: tableIMAPEmlFileParse, Description: "Array of BCC addresses."},
+			{Name: "file_size", Type: proto.ColumnType_INT, Description: "Size in bytes of the file."},
+			// Other columns
+			{Name: "attachments", Type: proto.ColumnType_JSON, Hydrate: tableIMAPEmlFileParse, Transform: transform.FromField("Envelope.Attachments").Transform(getAttachmentsWithoutData), Description: "All parts having a Content-Disposition of attachment."},
+			{Name: "bcc_email", Type: proto.ColumnType_STRING, Hydrate: tableIMAPEmlFileParse, Transform: transform.FromField("BccAddresses").Transform(getFirstAddress), Description: "Email address, in lower case, of the first mailbox in the BCC header."},
+			{Name: "body_html", Type: proto.ColumnType_STRING, Hydrate: tableIMAPEmlFileParse, Description: "HTML body of the message."},
+			{Name: "body_text", Type: proto.ColumnType_STRING, Hydrate: tableIMAPEmlFileParse, Description: "Text body of the message."},
+			{Name: "cc_email", Type: proto.ColumnType_STRING, Hydrate: tableIMAPEmlFileParse, Transform: transform.FromField("CcAddresses").Transform(getFirstAddress), Description: "Email address, in lower case, of the first mailbox in the CC header."},
+			{Name: "decoding_errors", Type: proto.ColumnType_JSON, Hydrate: tableIMAPEmlFileParse, Description: "Text that could not be decoded from the message's charset, and was replaced with U+FFFD."},
+			{Name: "embedded_files", Type: proto.ColumnType_JSON, Hydrate: tableIMAPEmlFileParse, Transform: transform.FromField("Envelope.Inlines").Transform(getAttachmentsWithoutData), Description: "All parts having a Content-Disposition of inline."},
+			{Name: "errors", Type: proto.ColumnType_JSON, Hydrate: tableIMAPEmlFileParse, Transform: transform.FromField("Envelope.Errors"), Description: "Errors returned while parsing the email."},
+			{Name: "from_addresses", Type: proto.ColumnType_JSON, Hydrate: tableIMAPEmlFileParse, Description: "Array of From addresses."},
+			{Name: "headers", Type: proto.ColumnType_JSON, Hydrate: tableIMAPEmlFileParse, Transform: transform.FromField("Envelope.Root.Header"), Description: "Full set of headers defined in the message."},
+			{Name: "in_reply_to", Type: proto.ColumnType_JSON, Hydrate: tableIMAPEmlFileParse, Description: "Array of message IDs that this message is a reply to."},
+			{Name: "modified_at", Type: proto.ColumnType_TIMESTAMP, Description: "Time when the file was last modified."},
+			{Name: "original_charset", Type: proto.ColumnType_STRING, Hydrate: tableIMAPEmlFileParse, Description: "Character set the message text was decoded from, as declared by the message or, if missing or wrong, detected."},
+			{Name: "parse_error", Type: proto.ColumnType_STRING, Hydrate: tableIMAPEmlFileParse, Transform: transform.FromField("ParseError").Transform(transform.NullIfZeroValue), Description: "Error parsing the message, if parse_status is recovered or failed."},
+			{Name: "parse_status", Type: proto.ColumnType_STRING, Hydrate: tableIMAPEmlFileParse, Description: "Result of parsing the message: ok, recovered if malformed parts were skipped, or failed."},
+			{Name: "to_email", Type: proto.ColumnType_STRING, Hydrate: tableIMAPEmlFileParse, Transform: transform.FromField("ToAddresses").Transform(getFirstAddress), Description: "Email address, in lower case, of the first mailbox in the To header."},
+		}),
+	}
+}
+
+type emlFile struct {
+	Path       string
+	FileSize   int64
+	ModifiedAt time.Time
+}
+
+func tableIMAPEmlFileList(ctx context.Context, d *plugin.QueryData, _ *plugin.HydrateData) (interface{}, error) {
+
+	// A path qual reads just that file, otherwise read every file matching the
+	// eml_path config setting
+	if d.EqualsQuals["path"] != nil {
+		path := d.EqualsQuals["path"].GetStringValue()
+		info, err := os.Stat(path)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if !info.IsDir() {
+			d.StreamListItem(ctx, emlFile{Path: path, FileSize: info.Size(), ModifiedAt: info.ModTime()})
+		}
+		return nil, nil
+	}
+
+	imapConfig := GetConfig(d.Connection)
+	if imapConfig.EmlPath == nil || *imapConfig.EmlPath == "" {
+		return nil, errors.New("eml_path must be configured, or a path given in the query")
+	}
+	pattern, err := expandHome(*imapConfig.EmlPath)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	// Matching files are read whatever their extension, while matching
+	// directories are walked for .eml files
+	seen := map[string]bool{}
+	stream := func(path string, info fs.FileInfo) {
+		if seen[path] {
+			return
+		}
+		seen[path] = true
+		d.StreamListItem(ctx, emlFile{Path: path, FileSize: info.Size(), ModifiedAt: info.ModTime()})
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !info.IsDir() {
+			stream(path, info)
+			continue
+		}
+		err = filepath.WalkDir(path, func(p string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() || !strings.EqualFold(filepath.Ext(p), ".eml") {
+				return nil
+			}
+			if info, err := entry.Info(); err == nil {
+				stream(p, info)
+			}
+			return nil
+		})
+		if err != nil {
+			plugin.Logger(ctx).Error("imap_eml_file.tableIMAPEmlFileList", "walk_error", err, "path", path)
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+func tableIMAPEmlFileParse(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+	file := h.Item.(emlFile)
+
+	f, err := os.Open(file.Path)
+	if err != nil {
+		plugin.Logger(ctx).Error("imap_eml_file.tableIMAPEmlFileParse", "read_error", err, "path", file.Path)
+		return nil, err
+	}
+	defer f.Close()
+
+	strict, err := strictParsing(d)
+	if err != nil {
+		return nil, err
+	}
+	te := parseMessage(f, strict)
+	if te.ParseStatus == parseFailed {
+		plugin.Logger(ctx).Warn("imap_eml_file.tableIMAPEmlFileParse", "parse_error", te.ParseError, "path", file.Path)
+	}
+
+	return te, nil
+}
@@ -0,0 +1,94 @@
+package imap
+
+import (
+	"context"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin/transform"
+)
+
+func tableIMAPGmailLabel(ctx context.Context) *plugin.Table {
+	return &plugin.Table{
+		Name:        "imap_gmail_label",
+		Description: "Gmail labels, for servers supporting the Gmail IMAP extensions.",
+		List: &plugin.ListConfig{
+			Hydrate: tableIMAPGmailLabelList,
+		},
+		Columns: commonColumns([]*plugin.Column{
+			// Top columns
+			{Name: "label", Type: proto.ColumnType_STRING, Description: "Label as it appears in the gmail_labels column of imap_message, e.g. 'Work', '\\Inbox', '\\Starred'."},
+			{Name: "mailbox", Type: proto.ColumnType_STRING, Transform: transform.FromField("Info.Name"), Description: "Name of the mailbox holding the labelled messages, e.g. 'Work', 'INBOX', '[Gmail]/Starred'."},
+			{Name: "messages", Type: proto.ColumnType_INT, Transform: transform.FromField("Status.Messages"), Description: "The number of messages with this label."},
+			{Name: "unseen", Type: proto.ColumnType_INT, Transform: transform.FromField("Status.Unseen"), Description: "The number of unread messages with this label."},
+			// Other columns
+			{Name: "attributes", Type: proto.ColumnType_JSON, Transform: transform.FromField("Info.Attributes"), Description: "Attributes set on the mailbox."},
+		}),
+	}
+}
+
+type gmailLabelRow struct {
+	Label  string
+	Info   *imap.MailboxInfo
+	Status *imap.MailboxStatus
+}
+
+func tableIMAPGmailLabelList(ctx context.Context, d *plugin.QueryData, _ *plugin.HydrateData) (interface{}, error) {
+
+	c, err := login(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = c.Logout()
+	}()
+
+	if !gmailSupported(c) {
+		plugin.Logger(ctx).Warn("imap_gmail_label.tableIMAPGmailLabelList", "unsupported", gmailExtension)
+		return nil, nil
+	}
+
+	// Labels are exposed as mailboxes, so list them all before asking for the
+	// status of each
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", "*", mailboxes)
+	}()
+
+	var labels []gmailLabelRow
+	for m := range mailboxes {
+		// Skip containers such as [Gmail], and mailboxes that are not labels
+		label := gmailLabel(m)
+		if label == "" || hasAttribute(m, imap.NoSelectAttr) {
+			continue
+		}
+		labels = append(labels, gmailLabelRow{Label: label, Info: m})
+	}
+
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	for _, l := range labels {
+		l.Status, err = c.Status(l.Info.Name, []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen})
+		if err != nil {
+			plugin.Logger(ctx).Error("imap_gmail_label.tableIMAPGmailLabelList", "query_error", err, "mailbox", l.Info.Name)
+			return nil, err
+		}
+		d.StreamListItem(ctx, l)
+	}
+
+	return nil, nil
+}
+
+func hasAttribute(m *imap.MailboxInfo, attr string) bool {
+	for _, a := range m.Attributes {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
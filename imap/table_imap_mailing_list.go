@@ -0,0 +1,97 @@
+package imap
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin/transform"
+)
+
+func tableIMAPMailingList(ctx context.Context) *plugin.Table {
+	return &plugin.Table{
+		Name:        "imap_mailing_list",
+		Description: "Mailing lists and newsletters with messages in an IMAP mailbox, from their List-Id headers.",
+		List: &plugin.ListConfig{
+			Hydrate: tableIMAPMailingListList,
+			KeyColumns: []*plugin.KeyColumn{
+				{Name: "mailbox", Require: plugin.Optional},
+			},
+		},
+		Columns: commonColumns([]*plugin.Column{
+			// Top columns
+			{Name: "list_id", Type: proto.ColumnType_STRING, Transform: transform.FromField("ListID"), Description: "Identifier of the mailing list, in lower case, e.g. announce.example.com."},
+			{Name: "list_name", Type: proto.ColumnType_STRING, Transform: transform.FromField("ListName").Transform(transform.NullIfZeroValue), Description: "Description of the list in its most recent List-Id header."},
+			{Name: "message_count", Type: proto.ColumnType_INT, Description: "Number of messages from the list in the mailbox."},
+			{Name: "unread_count", Type: proto.ColumnType_INT, Description: "Number of messages from the list that have not been read."},
+			{Name: "total_size", Type: proto.ColumnType_INT, Description: "Total size in bytes of the messages from the list."},
+			{Name: "first_seen", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("FirstSeen").Transform(transform.NullIfZeroValue), Description: "Time when the oldest message from the list was received by the server."},
+			{Name: "last_seen", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("LastSeen").Transform(transform.NullIfZeroValue), Description: "Time when the most recent message from the list was received by the server."},
+			// Other columns
+			{Name: "list_post", Type: proto.ColumnType_STRING, Transform: transform.FromField("ListPost").Transform(transform.NullIfZeroValue), Description: "Address for posting to the list in its most recent message, or NO if posting is not allowed."},
+			{Name: "mailbox", Type: proto.ColumnType_STRING, Description: "Mailbox holding the messages."},
+			{Name: "unsubscribe_mailto", Type: proto.ColumnType_STRING, Transform: transform.FromField("UnsubscribeMailto").Transform(transform.NullIfZeroValue), Description: "mailto URI to unsubscribe by email, from the most recent message."},
+			{Name: "unsubscribe_one_click", Type: proto.ColumnType_BOOL, Transform: transform.FromField("UnsubscribeOneClick"), Description: "True if the most recent message supports one-click unsubscribing (RFC 8058)."},
+			{Name: "unsubscribe_urls", Type: proto.ColumnType_JSON, Transform: transform.FromField("UnsubscribeURLs"), Description: "Array of HTTP and HTTPS URLs to unsubscribe, from the most recent message."},
+		}),
+	}
+}
+
+// mailingListRow sums up the messages of a list. The other fields are from
+// the most recent message, as unsubscribe URLs often have a token that
+// expires.
+type mailingListRow struct {
+	Mailbox      string
+	MessageCount int64
+	UnreadCount  int64
+	TotalSize    int64
+	FirstSeen    time.Time
+	LastSeen     time.Time
+	mailingListHeaders
+}
+
+func tableIMAPMailingListList(ctx context.Context, d *plugin.QueryData, _ *plugin.HydrateData) (interface{}, error) {
+	lists := map[string]*mailingListRow{}
+	// Only the header section is needed
+	err := listMessages(ctx, d, listOptions{Header: true}, func(mw msgWrapper) {
+		h := parseMailingListHeaders(readHeaderFields(mw.header()))
+		if h.ListID == "" {
+			return
+		}
+		msg := mw.Message
+		row := lists[h.ListID]
+		if row == nil {
+			row = &mailingListRow{Mailbox: mw.Mailbox, FirstSeen: msg.InternalDate}
+			lists[h.ListID] = row
+		}
+		row.MessageCount++
+		row.TotalSize += int64(msg.Size)
+		if !hasFoldedString(msg.Flags, imap.SeenFlag) {
+			row.UnreadCount++
+		}
+		if msg.InternalDate.Before(row.FirstSeen) {
+			row.FirstSeen = msg.InternalDate
+		}
+		if !msg.InternalDate.Before(row.LastSeen) {
+			row.LastSeen = msg.InternalDate
+			row.mailingListHeaders = h
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(lists))
+	for id := range lists {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		d.StreamListItem(ctx, *lists[id])
+	}
+	return nil, nil
+}
@@ -0,0 +1,68 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin/transform"
+)
+
+func tableIMAPMDN(ctx context.Context) *plugin.Table {
+	return &plugin.Table{
+		Name:        "imap_mdn",
+		Description: "Read receipts (message disposition notifications) in IMAP.",
+		List: &plugin.ListConfig{
+			Hydrate: tableIMAPMDNList,
+			KeyColumns: []*plugin.KeyColumn{
+				{Name: "mailbox", Require: plugin.Optional},
+				{Name: "uid", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+				{Name: "received_at", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+			},
+		},
+		Columns: commonColumns([]*plugin.Column{
+			// Top columns
+			{Name: "mailbox", Type: proto.ColumnType_STRING, Description: "Mailbox holding the notification."},
+			{Name: "uid", Type: proto.ColumnType_INT, Transform: transform.FromField("UID"), Description: "Unique identifier of the notification in the mailbox."},
+			{Name: "original_message_id", Type: proto.ColumnType_STRING, Transform: transform.FromField("OriginalMessageID").Transform(transform.NullIfZeroValue), Description: "Message-ID of the message the notification is about."},
+			{Name: "final_recipient", Type: proto.ColumnType_STRING, Transform: transform.FromField("FinalRecipient").Transform(transform.NullIfZeroValue), Description: "Recipient whose mail client sent the notification."},
+			{Name: "disposition_type", Type: proto.ColumnType_STRING, Transform: transform.FromField("DispositionType").Transform(transform.NullIfZeroValue), Description: "What happened to the message: displayed, deleted, dispatched or processed."},
+			{Name: "action_mode", Type: proto.ColumnType_STRING, Transform: transform.FromField("ActionMode").Transform(transform.NullIfZeroValue), Description: "Whether the disposition was by the user (manual-action) or by a rule (automatic-action)."},
+			{Name: "sending_mode", Type: proto.ColumnType_STRING, Transform: transform.FromField("SendingMode").Transform(transform.NullIfZeroValue), Description: "Whether the user agreed to send the notification (mdn-sent-manually) or it was sent without asking (mdn-sent-automatically)."},
+			{Name: "reporting_ua", Type: proto.ColumnType_STRING, Transform: transform.FromField("ReportingUA").Transform(transform.NullIfZeroValue), Description: "Host and mail client that sent the notification, e.g. pc.example.org; Thunderbird 115.0."},
+			// Other columns
+			{Name: "disposition", Type: proto.ColumnType_STRING, Transform: transform.FromField("Disposition").Transform(transform.NullIfZeroValue), Description: "Value of the Disposition field."},
+			{Name: "disposition_modifiers", Type: proto.ColumnType_JSON, Transform: transform.FromField("DispositionModifiers"), Description: "Modifiers of the disposition type, e.g. error."},
+			{Name: "message_id", Type: proto.ColumnType_STRING, Transform: transform.FromField("MessageID").Transform(transform.NullIfZeroValue), Description: "Message-ID of the notification."},
+			{Name: "original_recipient", Type: proto.ColumnType_STRING, Transform: transform.FromField("OriginalRecipient").Transform(transform.NullIfZeroValue), Description: "Address the message was originally sent to, if the notification gives it."},
+			{Name: "received_at", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("ReceivedAt").Transform(transform.NullIfZeroValue), Description: "Time when the notification was received by the server (INTERNALDATE)."},
+		}),
+	}
+}
+
+type mdnRow struct {
+	Mailbox    string
+	UID        uint32
+	ReceivedAt time.Time
+	MessageID  string
+	mdn
+}
+
+func tableIMAPMDNList(ctx context.Context, d *plugin.QueryData, _ *plugin.HydrateData) (interface{}, error) {
+	return nil, listMessages(ctx, d, listOptions{Body: true}, func(mw msgWrapper) {
+		te := parseMessage(bytes.NewReader(mw.Body), false)
+		n := parseMDN(te.Envelope)
+		if n == nil {
+			return
+		}
+		d.StreamListItem(ctx, mdnRow{
+			Mailbox:    mw.Mailbox,
+			UID:        mw.Message.Uid,
+			ReceivedAt: mw.Message.InternalDate,
+			MessageID:  te.MessageID,
+			mdn:        *n,
+		})
+	})
+}
@@ -1,11 +1,16 @@
 package imap
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math"
 	"net/mail"
+	"reflect"
 	"strings"
 	"time"
-	"unicode/utf8"
 
 	"github.com/emersion/go-imap"
 	"github.com/jhillyerd/enmime"
@@ -23,18 +28,31 @@ func tableIMAPMessage(ctx context.Context) *plugin.Table {
 			Hydrate: tableIMAPMessageList,
 			KeyColumns: []*plugin.KeyColumn{
 				{Name: "mailbox", Require: plugin.Optional},
-				{Name: "size", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+				{Name: "size", Operators: []string{">", ">=", "=", "<>", "<", "<="}, Require: plugin.Optional},
 				{Name: "timestamp", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
-				{Name: "seq_num", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
-				{Name: "from_email", Require: plugin.Optional},
-				{Name: "message_id", Require: plugin.Optional},
-				{Name: "subject", Require: plugin.Optional},
+				{Name: "received_at", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+				{Name: "seq_num", Operators: []string{">", ">=", "=", "<>", "<", "<="}, Require: plugin.Optional},
+				{Name: "uid", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+				{Name: "from_email", Operators: []string{"=", "~~", "~~*"}, Require: plugin.Optional},
+				{Name: "to_email", Operators: []string{"=", "~~", "~~*"}, Require: plugin.Optional},
+				{Name: "cc_email", Operators: []string{"=", "~~", "~~*"}, Require: plugin.Optional},
+				{Name: "bcc_email", Operators: []string{"=", "~~", "~~*"}, Require: plugin.Optional},
+				{Name: "message_id", Operators: []string{"=", "~~", "~~*"}, Require: plugin.Optional},
+				{Name: "subject", Operators: []string{"=", "~~", "~~*"}, Require: plugin.Optional},
 				{Name: "query", Require: plugin.Optional},
+				{Name: "gmail_query", Require: plugin.Optional},
+				{Name: "answered", Operators: []string{"=", "<>"}, Require: plugin.Optional},
+				{Name: "deleted", Operators: []string{"=", "<>"}, Require: plugin.Optional},
+				{Name: "draft", Operators: []string{"=", "<>"}, Require: plugin.Optional},
+				{Name: "flagged", Operators: []string{"=", "<>"}, Require: plugin.Optional},
+				{Name: "recent", Operators: []string{"=", "<>"}, Require: plugin.Optional},
+				{Name: "seen", Operators: []string{"=", "<>"}, Require: plugin.Optional},
+				{Name: "keywords", Operators: []string{"?", "?|", "?&"}, Require: plugin.Optional},
 			},
 		},
 		Columns: commonColumns([]*plugin.Column{
 			// Top columns
-			{Name: "timestamp", Type: proto.ColumnType_TIMESTAMP, Hydrate: tableIMAPParsedMessage, Description: "Time when the message was sent."},
+			{Name: "timestamp", Type: proto.ColumnType_TIMESTAMP, Hydrate: tableIMAPParsedMessage, Sort: plugin.SortAll, Description: "Time when the message was sent, or when it was received if it has no valid Date header."},
 			{Name: "from_email", Type: proto.ColumnType_STRING, Hydrate: tableIMAPParsedMessage, Transform: transform.FromField("FromAddresses").Transform(getFirstAddress), Description: "Email address, in lower case, of the first (and usually only) mailbox in the From header."},
 			{Name: "subject", Type: proto.ColumnType_STRING, Hydrate: tableIMAPParsedMessage, Transform: transform.FromField("Subject"), Description: "Subject of the message."},
 			{Name: "message_id", Type: proto.ColumnType_STRING, Hydrate: tableIMAPParsedMessage, Description: "Unique message identifier that refers to a particular version of a particular message."},
@@ -42,26 +60,137 @@ func tableIMAPMessage(ctx context.Context) *plugin.Table {
 			{Name: "cc_addresses", Type: proto.ColumnType_JSON, Hydrate: tableIMAPParsedMessage, Description: "Array of CC addresses."},
 			{Name: "bcc_addresses", Type: proto.ColumnType_JSON, Hydrate: tableIMAPParsedMessage, Description: "Array of BCC addresses."},
 			{Name: "seq_num", Type: proto.ColumnType_INT, Transform: transform.FromField("Message.SeqNum"), Description: "Sequence number of the message."},
-			{Name: "size", Type: proto.ColumnType_INT, Transform: transform.FromField("Message.Size"), Description: "Size in bytes of the message."},
+			{Name: "uid", Type: proto.ColumnType_INT, Transform: transform.FromField("Message.Uid"), Description: "Unique identifier of the message in the mailbox."},
+			{Name: "size", Type: proto.ColumnType_INT, Transform: transform.FromField("Message.Size"), Sort: plugin.SortAll, Description: "Size in bytes of the message."},
 			// Other columns
+			{Name: "answered", Type: proto.ColumnType_BOOL, Transform: transform.FromField("Message.Flags").TransformP(hasFlag, imap.AnsweredFlag), Description: "True if the message has been answered."},
+			{Name: "arc_chain_valid", Type: proto.ColumnType_BOOL, Hydrate: tableIMAPMessageSignatures, Transform: transform.FromField("ARCChainValid"), Description: "True if the ARC chain of the message was verified by the plugin, false if it failed. Null if the message has no ARC headers."},
+			{Name: "arc_result", Type: proto.ColumnType_STRING, Hydrate: tableIMAPMessageAuthResults, Transform: transform.FromField("ARC").Transform(transform.NullIfZeroValue), Description: "Result of ARC chain validation (arc) in the receiving server's Authentication-Results header, e.g. pass, fail or none."},
 			{Name: "attachments", Type: proto.ColumnType_JSON, Hydrate: tableIMAPParsedMessage, Transform: transform.FromField("Envelope.Attachments").Transform(getAttachmentsWithoutData), Description: "All parts having a Content-Disposition of attachment."},
+			{Name: "bcc_email", Type: proto.ColumnType_STRING, Hydrate: tableIMAPParsedMessage, Transform: transform.FromField("BccAddresses").Transform(getFirstAddress), Description: "Email address, in lower case, of the first mailbox in the BCC header."},
 			{Name: "body_html", Type: proto.ColumnType_STRING, Hydrate: tableIMAPParsedMessage, Description: "HTML body of the message."},
 			{Name: "body_text", Type: proto.ColumnType_STRING, Hydrate: tableIMAPParsedMessage, Description: "Text body of the message."},
+			{Name: "cc_email", Type: proto.ColumnType_STRING, Hydrate: tableIMAPParsedMessage, Transform: transform.FromField("CcAddresses").Transform(getFirstAddress), Description: "Email address, in lower case, of the first mailbox in the CC header."},
+			{Name: "decoding_errors", Type: proto.ColumnType_JSON, Hydrate: tableIMAPParsedMessage, Description: "Text that could not be decoded from the message's charset, and was replaced with U+FFFD."},
+			{Name: "deleted", Type: proto.ColumnType_BOOL, Transform: transform.FromField("Message.Flags").TransformP(hasFlag, imap.DeletedFlag), Description: "True if the message is marked for deletion."},
+			{Name: "disposition_notification_to", Type: proto.ColumnType_JSON, Hydrate: tableIMAPMessageDispositionNotificationTo, Transform: transform.FromValue(), Description: "Array of addresses in the Disposition-Notification-To header, which asks recipients for a read receipt. Null if no receipt was requested."},
+			{Name: "dkim_domains", Type: proto.ColumnType_JSON, Hydrate: tableIMAPMessageSignatures, Transform: transform.FromField("DKIMDomains"), Description: "Signing domains (d=) of the DKIM signatures verified by the plugin."},
+			{Name: "dkim_result", Type: proto.ColumnType_STRING, Hydrate: tableIMAPMessageAuthResults, Transform: transform.FromField("DKIM").Transform(transform.NullIfZeroValue), Description: "Result of DKIM verification in the receiving server's Authentication-Results header, e.g. pass, fail or none. pass if any signature passed."},
+			{Name: "dkim_verified", Type: proto.ColumnType_BOOL, Hydrate: tableIMAPMessageSignatures, Transform: transform.FromField("DKIMVerified"), Description: "True if a DKIM signature of the message was verified by the plugin, false if none were. Null if the message is not signed."},
+			{Name: "dmarc_result", Type: proto.ColumnType_STRING, Hydrate: tableIMAPMessageAuthResults, Transform: transform.FromField("DMARC").Transform(transform.NullIfZeroValue), Description: "Result of the DMARC check in the receiving server's Authentication-Results header, e.g. pass, fail or none."},
+			{Name: "draft", Type: proto.ColumnType_BOOL, Transform: transform.FromField("Message.Flags").TransformP(hasFlag, imap.DraftFlag), Description: "True if the message is a draft."},
 			{Name: "embedded_files", Type: proto.ColumnType_JSON, Hydrate: tableIMAPParsedMessage, Transform: transform.FromField("Envelope.Inlines").Transform(getAttachmentsWithoutData), Description: "All parts having a Content-Disposition of inline."},
+			{Name: "encrypted", Type: proto.ColumnType_BOOL, Hydrate: tableIMAPMessageSecureMail, Description: "True if the message is encrypted with S/MIME or PGP, as a whole or in an inline PGP message."},
 			{Name: "errors", Type: proto.ColumnType_JSON, Hydrate: tableIMAPParsedMessage, Transform: transform.FromField("Envelope.Errors"), Description: "Errors returned while parsing the email."},
+			{Name: "flagged", Type: proto.ColumnType_BOOL, Transform: transform.FromField("Message.Flags").TransformP(hasFlag, imap.FlaggedFlag), Description: "True if the message is flagged for urgent or special attention."},
 			{Name: "flags", Type: proto.ColumnType_JSON, Transform: transform.FromField("Message.Flags"), Description: "Flags set on the message."},
 			{Name: "from_addresses", Type: proto.ColumnType_JSON, Hydrate: tableIMAPParsedMessage, Description: "Array of From addresses."},
+			{Name: "gmail_labels", Type: proto.ColumnType_JSON, Transform: transform.FromField("Message.Items").Transform(getGmailLabels), Description: "Array of Gmail labels on the message (X-GM-LABELS). Only set for servers supporting the Gmail IMAP extensions, and Google Takeout exports read with the mbox backend."},
+			{Name: "gmail_message_id", Type: proto.ColumnType_STRING, Transform: transform.FromField("Message.Items").TransformP(getGmailID, gmailMessageID), Description: "Gmail message ID (X-GM-MSGID), an unsigned 64-bit number as a decimal string. Only set for servers supporting the Gmail IMAP extensions."},
+			{Name: "gmail_query", Type: proto.ColumnType_STRING, Transform: transform.FromQual("gmail_query"), Description: "Gmail search query to match messages, using the same syntax as the Gmail web interface (X-GM-RAW). Only supported by Gmail servers."},
+			{Name: "gmail_thread_id", Type: proto.ColumnType_STRING, Transform: transform.FromField("Message.Items").TransformP(getGmailID, gmailThreadID), Description: "Gmail thread ID (X-GM-THRID), an unsigned 64-bit number as a decimal string. Only set for servers supporting the Gmail IMAP extensions, and Google Takeout exports read with the mbox backend."},
 			{Name: "headers", Type: proto.ColumnType_JSON, Hydrate: tableIMAPParsedMessage, Transform: transform.FromField("Envelope.Root.Header"), Description: "Full set of headers defined in the message."},
 			{Name: "in_reply_to", Type: proto.ColumnType_JSON, Hydrate: tableIMAPParsedMessage, Description: "Array of message IDs that this message is a reply to."},
+			{Name: "keywords", Type: proto.ColumnType_JSON, Transform: transform.FromField("Message.Flags").Transform(getKeywords), Description: "Array of custom keywords set on the message, e.g. $Junk or $Forwarded."},
+			{Name: "list_id", Type: proto.ColumnType_STRING, Hydrate: tableIMAPMessageMailingList, Transform: transform.FromField("ListID").Transform(transform.NullIfZeroValue), Description: "Identifier of the mailing list the message was sent to, in lower case, from the List-Id header, e.g. announce.example.com."},
+			{Name: "list_post", Type: proto.ColumnType_STRING, Hydrate: tableIMAPMessageMailingList, Transform: transform.FromField("ListPost").Transform(transform.NullIfZeroValue), Description: "Address for posting to the mailing list, e.g. mailto:list@example.com, or NO if posting is not allowed."},
+			{Name: "list_unsubscribe_mailto", Type: proto.ColumnType_STRING, Hydrate: tableIMAPMessageMailingList, Transform: transform.FromField("UnsubscribeMailto").Transform(transform.NullIfZeroValue), Description: "mailto URI in the List-Unsubscribe header, to unsubscribe by email."},
+			{Name: "list_unsubscribe_one_click", Type: proto.ColumnType_BOOL, Hydrate: tableIMAPMessageMailingList, Transform: transform.FromField("UnsubscribeOneClick"), Description: "True if the sender supports one-click unsubscribing (RFC 8058) with a POST to the HTTPS URL in list_unsubscribe_urls."},
+			{Name: "list_unsubscribe_urls", Type: proto.ColumnType_JSON, Hydrate: tableIMAPMessageMailingList, Transform: transform.FromField("UnsubscribeURLs"), Description: "Array of HTTP and HTTPS URLs in the List-Unsubscribe header."},
 			{Name: "mailbox", Type: proto.ColumnType_STRING, Description: "Mailbox queried for messages."},
+			{Name: "original_charset", Type: proto.ColumnType_STRING, Hydrate: tableIMAPParsedMessage, Description: "Character set the message text was decoded from, as declared by the message or, if missing or wrong, detected."},
+			{Name: "parse_error", Type: proto.ColumnType_STRING, Hydrate: tableIMAPParsedMessage, Transform: transform.FromField("ParseError").Transform(transform.NullIfZeroValue), Description: "Error parsing the message, if parse_status is recovered or failed."},
+			{Name: "parse_status", Type: proto.ColumnType_STRING, Hydrate: tableIMAPParsedMessage, Description: "Result of parsing the message: ok, recovered if malformed parts were skipped, or failed if only the IMAP ENVELOPE columns are set."},
+			{Name: "pgp_key_id", Type: proto.ColumnType_STRING, Hydrate: tableIMAPMessageSecureMail, Transform: transform.FromField("PGPKeyID").Transform(transform.NullIfZeroValue), Description: "ID of the PGP key that signed the message, as 16 hexadecimal digits."},
+			{Name: "precedence", Type: proto.ColumnType_STRING, Hydrate: tableIMAPMessageMailingList, Transform: transform.FromField("Precedence").Transform(transform.NullIfZeroValue), Description: "Value of the Precedence header in lower case, e.g. bulk or list for mass mail."},
 			{Name: "query", Type: proto.ColumnType_STRING, Transform: transform.FromQual("query"), Description: "Search query to match messages."},
+			{Name: "raw_headers", Type: proto.ColumnType_STRING, Hydrate: tableIMAPRawMessage, Transform: transform.FromField("Headers"), Description: "Header section of the message as sent by the server, with the order and duplicates of fields kept. Bytes that are not valid UTF-8 are replaced with U+FFFD."},
+			{Name: "raw_message", Type: proto.ColumnType_STRING, Hydrate: tableIMAPRawMessage, Transform: transform.FromField("Message"), Description: "Full source of the message, base64 encoded so that every byte is kept. Truncated to raw_message_max_size_mb."},
+			{Name: "raw_truncated", Type: proto.ColumnType_BOOL, Hydrate: tableIMAPRawMessage, Transform: transform.FromField("Truncated"), Description: "True if raw_message was truncated to raw_message_max_size_mb."},
+			{Name: "recent", Type: proto.ColumnType_BOOL, Transform: transform.FromField("Message.Flags").TransformP(hasFlag, imap.RecentFlag), Description: "True if this is the first session to be notified about the message."},
+			{Name: "received_at", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("Message.InternalDate").Transform(transform.NullIfZeroValue), Sort: plugin.SortAll, Description: "Time when the message was received by the server (INTERNALDATE)."},
+			{Name: "seen", Type: proto.ColumnType_BOOL, Transform: transform.FromField("Message.Flags").TransformP(hasFlag, imap.SeenFlag), Description: "True if the message has been read."},
+			{Name: "signature_type", Type: proto.ColumnType_STRING, Hydrate: tableIMAPMessageSecureMail, Description: "Type of signature of the message: smime, pgp or none. none if a signature is inside encrypted content."},
+			{Name: "signature_valid", Type: proto.ColumnType_BOOL, Hydrate: tableIMAPMessageSecureMail, Description: "True if the S/MIME or PGP signature was verified by the plugin, with an S/MIME certificate chaining to smime_ca_file or a PGP key in pgp_keyring_file, for the From address and valid when the message was received. Null if the message is not signed, smime_ca_file is not configured for an S/MIME signature, or its PGP key is not in the keyring."},
+			{Name: "signer_email", Type: proto.ColumnType_STRING, Hydrate: tableIMAPMessageSecureMail, Transform: transform.FromField("SignerEmail").Transform(transform.NullIfZeroValue), Description: "Email address, in lower case, of the signer's certificate or PGP key."},
+			{Name: "signer_expires_at", Type: proto.ColumnType_TIMESTAMP, Hydrate: tableIMAPMessageSecureMail, Transform: transform.FromField("SignerExpiresAt").Transform(transform.NullIfZeroValue), Description: "Time when the signer's certificate or PGP key expires. Null if the key does not expire."},
+			{Name: "signer_issuer", Type: proto.ColumnType_STRING, Hydrate: tableIMAPMessageSecureMail, Transform: transform.FromField("SignerIssuer").Transform(transform.NullIfZeroValue), Description: "Distinguished name of the CA that issued the signer's S/MIME certificate."},
+			{Name: "signer_subject", Type: proto.ColumnType_STRING, Hydrate: tableIMAPMessageSecureMail, Transform: transform.FromField("SignerSubject").Transform(transform.NullIfZeroValue), Description: "Distinguished name of the signer's S/MIME certificate, or the primary user ID of the PGP key, e.g. Alice <alice@example.com>."},
+			{Name: "spf_result", Type: proto.ColumnType_STRING, Hydrate: tableIMAPMessageAuthResults, Transform: transform.FromField("SPF").Transform(transform.NullIfZeroValue), Description: "Result of the SPF check in the receiving server's Authentication-Results header, e.g. pass, softfail or fail."},
+			{Name: "to_email", Type: proto.ColumnType_STRING, Hydrate: tableIMAPParsedMessage, Transform: transform.FromField("ToAddresses").Transform(getFirstAddress), Description: "Email address, in lower case, of the first mailbox in the To header."},
 		}),
 	}
 }
 
+// flagColumns maps the boolean flag columns to their system flag.
+var flagColumns = map[string]string{
+	"answered": imap.AnsweredFlag,
+	"deleted":  imap.DeletedFlag,
+	"draft":    imap.DraftFlag,
+	"flagged":  imap.FlaggedFlag,
+	"recent":   imap.RecentFlag,
+	"seen":     imap.SeenFlag,
+}
+
+// searchColumns maps the string columns to the header searched for them.
+// body_text is not searched, since a server's BODY search covers every text
+// part and decodes charsets its own way, so it may miss messages whose
+// body_text matches.
+var searchColumns = map[string]string{
+	"subject":    "Subject",
+	"message_id": "Message-Id",
+	"from_email": "From",
+	"to_email":   "To",
+	"cc_email":   "Cc",
+	"bcc_email":  "Bcc",
+}
+
+// sortColumns maps the columns that can be sorted by the server to their RFC
+// 5256 sort key. The FROM and SUBJECT keys compare the mailbox name and base
+// subject rather than the from_email and subject values, so those columns are
+// left for Postgres to sort.
+var sortColumns = map[string]string{
+	"timestamp":   "DATE",
+	"received_at": "ARRIVAL",
+	"size":        "SIZE",
+}
+
 type msgWrapper struct {
 	Message *imap.Message
 	Mailbox string
+	// Body and Header are the fetched message source and header section
+	Body   []byte
+	Header []byte
+}
+
+// Sections of the message fetched for the parsed and raw columns. Peek so
+// that reading them does not set the \Seen flag.
+var (
+	bodySection   = &imap.BodySectionName{Peek: true}
+	headerSection = &imap.BodySectionName{BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier}, Peek: true}
+)
+
+// newMsgWrapper reads the fetched sections of the message. They are
+// literals, which can only be read once.
+func newMsgWrapper(msg *imap.Message, mailbox string) msgWrapper {
+	mw := msgWrapper{Message: msg, Mailbox: mailbox}
+	if r := msg.GetBody(bodySection); r != nil {
+		mw.Body, _ = io.ReadAll(r)
+	}
+	if r := msg.GetBody(headerSection); r != nil {
+		mw.Header, _ = io.ReadAll(r)
+	}
+	return mw
+}
+
+// header returns the header section of the message, including the blank
+// line that ends it. The header section is only fetched if the body isn't.
+func (mw msgWrapper) header() []byte {
+	if mw.Body == nil {
+		return mw.Header
+	}
+	_, body := splitMessage(mw.Body)
+	return mw.Body[:len(mw.Body)-len(body)]
 }
 
 type wrapper struct {
@@ -78,20 +207,54 @@ type wrapper struct {
 	Subject       string
 	BodyText      string
 	BodyHTML      string
+	// OriginalCharset is the charset the text was decoded from
+	OriginalCharset string
+	DecodingErrors  []string
+	ParseStatus     string
+	ParseError      string
 }
 
 func tableIMAPMessageList(ctx context.Context, d *plugin.QueryData, _ *plugin.HydrateData) (interface{}, error) {
+	needBody := bodyRequired(d)
+	opts := listOptions{
+		Body: needBody,
+		// Columns read from the header alone only need the header section
+		Header:        !needBody && headerRequired(d),
+		RowPerMessage: true,
+	}
+	return nil, listMessages(ctx, d, opts, func(mw msgWrapper) {
+		d.StreamListItem(ctx, mw)
+	})
+}
+
+// listOptions says which sections of the messages listMessages fetches.
+type listOptions struct {
+	// Body fetches the message source, and Header just its header section
+	Body   bool
+	Header bool
+	// RowPerMessage is true if each message is a row of the table, so that
+	// the query's LIMIT and sort order apply to the messages
+	RowPerMessage bool
+	// Mailbox is searched if the query doesn't give one, rather than the
+	// mailbox config setting
+	Mailbox string
+}
+
+// listMessages searches the mailbox for the messages matching the quals, and
+// calls stream with each of them. Tables derived from messages use the same
+// key columns as imap_message, e.g. mailbox and uid, to narrow the search.
+func listMessages(ctx context.Context, d *plugin.QueryData, opts listOptions, stream func(msgWrapper)) error {
 
 	c, err := login(ctx, d)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer func() {
 		err = c.Logout()
 	}()
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// Convenience
 	quals := d.Quals
@@ -99,11 +262,14 @@ func tableIMAPMessageList(ctx context.Context, d *plugin.QueryData, _ *plugin.Hy
 
 	// Select the mailbox for queries:
 	// 1. Check the mailbox qual
-	// 2. Use the mailbox config setting
-	// 3. Default to INBOX
+	// 2. Use the table's mailbox, e.g. the dmarc_report_mailbox config setting
+	// 3. Use the mailbox config setting
+	// 4. Default to INBOX
 	var mailbox string
 	if keyQuals["mailbox"] != nil {
 		mailbox = keyQuals["mailbox"].GetStringValue()
+	} else if opts.Mailbox != "" {
+		mailbox = opts.Mailbox
 	} else if d.Connection != nil {
 		imapConfig := GetConfig(d.Connection)
 		if imapConfig.Mailbox != nil {
@@ -114,18 +280,45 @@ func tableIMAPMessageList(ctx context.Context, d *plugin.QueryData, _ *plugin.Hy
 		mailbox = "INBOX"
 	}
 
+	// The cache must be prepared before the mailbox is selected, and is
+	// trimmed to its size limit once the messages have been fetched
+	cache, err := newMessageCache(d)
+	if err != nil {
+		return err
+	}
+	var cached *cachedMailbox
+	if cache != nil {
+		if err := cache.prepare(d, c, mailbox); err != nil {
+			plugin.Logger(ctx).Error("imap_message.listMessages", "cache_error", err, "mailbox", mailbox)
+			return err
+		}
+		defer cache.finish(ctx)
+	}
+
 	mbox, err := c.Select(mailbox, false)
 	if err != nil {
-		plugin.Logger(ctx).Error("imap_message.tableIMAPMessageList", "query_error", err, "mailbox", mailbox)
-		return nil, err
+		plugin.Logger(ctx).Error("imap_message.listMessages", "query_error", err, "mailbox", mailbox)
+		return err
+	}
+
+	gmail := gmailSupported(c)
+	gmailItems := gmailItemsSupported(d, c)
+	if cache != nil {
+		cached, err = cache.sync(ctx, c, mbox, gmailItems)
+		if err != nil {
+			plugin.Logger(ctx).Error("imap_message.listMessages", "cache_error", err, "mailbox", mailbox)
+			return err
+		}
 	}
 
 	// Setup search criteria
-	criteria := imap.NewSearchCriteria()
+	search := newMessageSearch()
+	criteria := search.Criteria
 
 	// Limit by sequence number. Adding multiple ranges expands the range (or), so instead we collect the pieces
 	from := uint32(1)
 	to := mbox.Messages
+	var excludeSeqNums []*imap.SearchCriteria
 	if quals["seq_num"] != nil {
 		for _, q := range quals["seq_num"].Quals {
 			sn := uint32(q.Value.GetInt64Value())
@@ -145,6 +338,11 @@ func tableIMAPMessageList(ctx context.Context, d *plugin.QueryData, _ *plugin.Hy
 				if sn <= to {
 					to = sn - 1
 				}
+			case "<>":
+				not := imap.NewSearchCriteria()
+				not.SeqNum = new(imap.SeqSet)
+				not.SeqNum.AddNum(sn)
+				excludeSeqNums = append(excludeSeqNums, not)
 			case "<=":
 				if sn < to {
 					to = sn
@@ -154,21 +352,76 @@ func tableIMAPMessageList(ctx context.Context, d *plugin.QueryData, _ *plugin.Hy
 	}
 	criteria.SeqNum = new(imap.SeqSet)
 	criteria.SeqNum.AddRange(from, to)
+	criteria.Not = append(criteria.Not, excludeSeqNums...)
 
-	if keyQuals["query"] != nil {
-		criteria.Text = append(criteria.Text, keyQuals["query"].GetStringValue())
+	// Limit by UID in the same way, where a range ending in 0 is open ended
+	if quals["uid"] != nil {
+		uidFrom, uidTo := uint32(1), uint32(0)
+		for _, q := range quals["uid"].Quals {
+			uid := uint32(q.Value.GetInt64Value())
+			switch q.Operator {
+			case "=":
+				uidFrom = uid
+				uidTo = uid
+			case ">":
+				if uid >= uidFrom {
+					uidFrom = uid + 1
+				}
+			case ">=":
+				if uid > uidFrom {
+					uidFrom = uid
+				}
+			case "<":
+				if uid <= 1 {
+					return nil
+				}
+				if uidTo == 0 || uid <= uidTo {
+					uidTo = uid - 1
+				}
+			case "<=":
+				if uid == 0 {
+					return nil
+				}
+				if uidTo == 0 || uid < uidTo {
+					uidTo = uid
+				}
+			}
+		}
+		criteria.Uid = new(imap.SeqSet)
+		criteria.Uid.AddRange(uidFrom, uidTo)
 	}
 
-	if keyQuals["subject"] != nil {
-		criteria.Header.Add("Subject", keyQuals["subject"].GetStringValue())
+	if keyQuals["query"] != nil {
+		criteria.Text = append(criteria.Text, keyQuals["query"].GetStringValue())
 	}
 
-	if keyQuals["message_id"] != nil {
-		criteria.Header.Add("Message-Id", keyQuals["message_id"].GetStringValue())
+	if keyQuals["gmail_query"] != nil {
+		if !gmail {
+			return errors.New("gmail_query requires a server supporting the Gmail IMAP extensions (X-GM-EXT-1)")
+		}
+		search.addKey("X-GM-RAW", keyQuals["gmail_query"].GetStringValue())
 	}
 
-	if keyQuals["from_email"] != nil {
-		criteria.Header.Add("From", keyQuals["from_email"].GetStringValue())
+	// IMAP searches are case-insensitive substring matches, so they can only
+	// narrow the messages down for Postgres to do the exact match. That rules
+	// out pushing <> or NOT ILIKE down as NOT, since servers match more than
+	// the substring (e.g. ignoring accents, or matching word stems), and a NOT
+	// search would remove messages that should be returned.
+	for column, header := range searchColumns {
+		if quals[column] == nil {
+			continue
+		}
+		for _, q := range quals[column].Quals {
+			value := q.Value.GetStringValue()
+			switch q.Operator {
+			case "=":
+				addStringSearch(criteria, header, value)
+			case "~~", "~~*":
+				for _, literal := range likeLiterals(value) {
+					addStringSearch(criteria, header, literal)
+				}
+			}
+		}
 	}
 
 	// Note: I don't know how these SentSince and SentBefore settings work,
@@ -195,6 +448,101 @@ func tableIMAPMessageList(ctx context.Context, d *plugin.QueryData, _ *plugin.Hy
 		}
 	}
 
+	// SINCE and BEFORE match the INTERNALDATE on whole days in the server's
+	// time zone. When search_timezone tells us that zone the day bounds are
+	// exact, otherwise they are expanded by a day each side. Servers with the
+	// WITHIN extension (RFC 5032) can then narrow the search to the second
+	// using YOUNGER and OLDER, unless the interval is too long for them.
+	if quals["received_at"] != nil {
+		loc, err := searchLocation(d)
+		if err != nil {
+			return err
+		}
+		var lower, upper time.Time
+		exclusive := false
+		for _, q := range quals["received_at"].Quals {
+			ts := q.Value.GetTimestampValue().AsTime()
+			if q.Operator != "<" && q.Operator != "<=" {
+				if lower.IsZero() || ts.After(lower) {
+					lower = ts
+				}
+			}
+			if q.Operator != ">" && q.Operator != ">=" {
+				if upper.IsZero() || ts.Before(upper) || (ts.Equal(upper) && q.Operator == "<") {
+					upper = ts
+					exclusive = q.Operator == "<"
+				}
+			}
+		}
+		within, _ := c.Support("WITHIN")
+		now := time.Now()
+		if !lower.IsZero() {
+			criteria.Since = searchSinceDate(lower, loc)
+			if within {
+				if n := int64(math.Ceil((now.Sub(lower) + withinSlack).Seconds())); n > 0 && n <= math.MaxUint32 {
+					search.addKey("YOUNGER", uint32(n))
+				}
+			}
+		}
+		if !upper.IsZero() {
+			criteria.Before = searchBeforeDate(upper, exclusive, loc)
+			if within {
+				if n := int64(math.Floor((now.Sub(upper) - withinSlack).Seconds())); n > 0 && n <= math.MaxUint32 {
+					search.addKey("OLDER", uint32(n))
+				}
+			}
+		}
+	}
+
+	// Flag columns map to SEEN / UNSEEN, FLAGGED / UNFLAGGED and so on
+	for column, flag := range flagColumns {
+		if quals[column] == nil {
+			continue
+		}
+		for _, q := range quals[column].Quals {
+			if q.Value.GetBoolValue() == (q.Operator == "=") {
+				criteria.WithFlags = append(criteria.WithFlags, flag)
+			} else {
+				criteria.WithoutFlags = append(criteria.WithoutFlags, flag)
+			}
+		}
+	}
+
+	// Keywords map to KEYWORD, with ?| needing an OR of each keyword. KEYWORD
+	// takes an atom, so other values are left for Postgres to filter, and an
+	// OR is only pushed down if every keyword in it can be.
+	if quals["keywords"] != nil {
+		for _, q := range quals["keywords"].Quals {
+			switch q.Operator {
+			case "?":
+				if keyword := q.Value.GetStringValue(); isAtom(keyword) {
+					criteria.WithFlags = append(criteria.WithFlags, keyword)
+				}
+			case "?&":
+				for _, v := range q.Value.GetListValue().GetValues() {
+					if keyword := v.GetStringValue(); isAtom(keyword) {
+						criteria.WithFlags = append(criteria.WithFlags, keyword)
+					}
+				}
+			case "?|":
+				var alternatives []*imap.SearchCriteria
+				for _, v := range q.Value.GetListValue().GetValues() {
+					keyword := v.GetStringValue()
+					if !isAtom(keyword) {
+						alternatives = nil
+						break
+					}
+					alternatives = append(alternatives, &imap.SearchCriteria{WithFlags: []string{keyword}})
+				}
+				if len(alternatives) == 1 {
+					criteria.WithFlags = append(criteria.WithFlags, alternatives[0].WithFlags...)
+				} else if len(alternatives) > 1 {
+					criteria.Or = append(criteria.Or, orCriteria(alternatives).Or...)
+				}
+			}
+		}
+	}
+
 	if quals["size"] != nil {
 		for _, q := range quals["size"].Quals {
 			size := q.Value.GetInt64Value()
@@ -210,57 +558,206 @@ func tableIMAPMessageList(ctx context.Context, d *plugin.QueryData, _ *plugin.Hy
 				criteria.Smaller = uint32(size) + 1
 			case "<":
 				criteria.Smaller = uint32(size)
+			case "<>":
+				not := imap.NewSearchCriteria()
+				if size > 0 {
+					not.Larger = uint32(size) - 1
+				}
+				not.Smaller = uint32(size) + 1
+				criteria.Not = append(criteria.Not, not)
 			}
 		}
 	}
 
-	plugin.Logger(ctx).Warn("imap_message.tableIMAPMessageList", "criteria", criteria)
+	plugin.Logger(ctx).Warn("imap_message.listMessages", "criteria", criteria, "extra", search.Extra)
+
+	// Let the server order the messages if the query is sorted, so that a
+	// LIMIT returns the right messages
+	var sortCriteria []sortCriterion
+	for _, sc := range d.QueryContext.SortOrder {
+		if !opts.RowPerMessage {
+			break
+		}
+		key, ok := sortColumns[sc.Column]
+		if !ok {
+			sortCriteria = nil
+			break
+		}
+		sortCriteria = append(sortCriteria, sortCriterion{Key: key, Reverse: sc.Order == plugin.SortDesc})
+	}
 
-	ids, err := c.Search(criteria)
+	var ids []uint32
+	if len(sortCriteria) > 0 {
+		limit := 0
+		if d.QueryContext.Limit != nil && opts.RowPerMessage {
+			limit = int(*d.QueryContext.Limit)
+		}
+		ids, err = search.sort(c, sortCriteria, limit)
+	} else {
+		ids, err = search.search(c)
+	}
 	if err != nil {
-		plugin.Logger(ctx).Error("imap_message.tableIMAPMessageList", "query_error", err, "criteria", criteria)
-		return nil, err
+		plugin.Logger(ctx).Error("imap_message.listMessages", "query_error", err, "criteria", criteria, "extra", search.Extra)
+		return err
 	}
 
-	plugin.Logger(ctx).Warn("imap_message.tableIMAPMessageList", "ids", ids)
+	plugin.Logger(ctx).Warn("imap_message.listMessages", "ids", ids)
 
 	if len(ids) == 0 {
-		return nil, nil
+		return nil
 	}
 
-	searchSeqset := new(imap.SeqSet)
 	limit := len(ids)
-	if d.QueryContext.Limit != nil {
+	if d.QueryContext.Limit != nil && opts.RowPerMessage {
 		i := int(*d.QueryContext.Limit)
 		if i < limit {
 			limit = i
 		}
 	}
-	searchSeqset.AddNum(ids[:limit]...)
+	ids = ids[:limit]
 
-	section := &imap.BodySectionName{}
-	fetchItems := append(imap.FetchFull.Expand(), section.FetchItem())
+	// Unsorted messages are streamed as soon as they are available, while
+	// sorted messages are collected and then streamed in the sorted order
+	sorted := len(sortCriteria) > 0
+	rows := map[uint32]msgWrapper{}
+	emit := func(mw msgWrapper) {
+		if sorted {
+			rows[mw.Message.Uid] = mw
+			return
+		}
+		stream(mw)
+	}
 
-	messages := make(chan *imap.Message, limit)
-	done := make(chan error, 1)
-	go func() {
-		done <- c.Fetch(searchSeqset, fetchItems, messages)
-	}()
+	// Only fetch the messages (and bodies) that are not already cached. The
+	// header section is not cached.
+	needBody, needHeader := opts.Body, opts.Header
+	fetchSeqset := new(imap.SeqSet)
+	for _, uid := range ids {
+		if cached != nil && !needHeader {
+			var body []byte
+			if needBody {
+				if body, _ = cache.body(uid); body == nil {
+					fetchSeqset.AddNum(uid)
+					continue
+				}
+			}
+			if msg, ok := cached.message(uid); ok {
+				emit(msgWrapper{Message: msg, Mailbox: mailbox, Body: body})
+				continue
+			}
+		}
+		fetchSeqset.AddNum(uid)
+	}
 
-	for msg := range messages {
-		mw := msgWrapper{
-			Message: msg,
-			Mailbox: mailbox,
+	if !fetchSeqset.Empty() {
+		fetchItems := append(imap.FetchFull.Expand(), imap.FetchUid)
+		if needBody {
+			fetchItems = append(fetchItems, bodySection.FetchItem())
+		}
+		if needHeader {
+			fetchItems = append(fetchItems, headerSection.FetchItem())
+		}
+		if gmailItems {
+			fetchItems = append(fetchItems, gmailLabels, gmailThreadID, gmailMessageID)
+		}
+
+		messages := make(chan *imap.Message, limit)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(fetchSeqset, fetchItems, messages)
+		}()
+
+		for msg := range messages {
+			mw := newMsgWrapper(msg, mailbox)
+			// Messages delivered since the sync are cached by the next one
+			if cached != nil && mw.Body != nil {
+				if _, ok := cached.Messages[msg.Uid]; ok {
+					if err := cache.putBody(msg.Uid, mw.Body); err != nil {
+						plugin.Logger(ctx).Error("imap_message.listMessages", "cache_error", err, "mailbox", mailbox)
+					}
+				}
+			}
+			emit(mw)
+		}
+
+		if err := <-done; err != nil {
+			plugin.Logger(ctx).Error("imap_message.listMessages", "query_error", err, "mailbox", mailbox)
+			return err
 		}
-		d.StreamListItem(ctx, mw)
 	}
 
-	if err := <-done; err != nil {
-		plugin.Logger(ctx).Error("imap_message.tableIMAPMessageList", "query_error", err, "mailbox", mailbox)
-		return nil, err
+	for _, uid := range ids {
+		if mw, ok := rows[uid]; ok {
+			stream(mw)
+		}
 	}
 
-	return nil, nil
+	return nil
+}
+
+// bodyRequired returns true if any of the requested columns are parsed or
+// verified from the message body, or are the raw message, which is otherwise
+// not fetched.
+func bodyRequired(d *plugin.QueryData) bool {
+	return columnRequested(d, "raw_message") || hydrateRequested(d, tableIMAPParsedMessage) || hydrateRequested(d, tableIMAPMessageSignatures) || hydrateRequested(d, tableIMAPMessageSecureMail)
+}
+
+// headerRequired returns true if any of the requested columns are parsed from
+// the header section of the message.
+func headerRequired(d *plugin.QueryData) bool {
+	return columnRequested(d, "raw_headers") || hydrateRequested(d, tableIMAPMessageAuthResults) || hydrateRequested(d, tableIMAPMessageMailingList) || hydrateRequested(d, tableIMAPMessageDispositionNotificationTo)
+}
+
+// hydrateRequested returns true if any of the requested columns are set by
+// the hydrate function.
+func hydrateRequested(d *plugin.QueryData, hydrate plugin.HydrateFunc) bool {
+	fn := reflect.ValueOf(hydrate).Pointer()
+	requested := map[string]bool{}
+	for _, name := range d.QueryContext.Columns {
+		requested[name] = true
+	}
+	for _, col := range d.Table.Columns {
+		if requested[col.Name] && col.Hydrate != nil && reflect.ValueOf(col.Hydrate).Pointer() == fn {
+			return true
+		}
+	}
+	return false
+}
+
+// columnRequested returns true if the query requests the column.
+func columnRequested(d *plugin.QueryData, name string) bool {
+	for _, col := range d.QueryContext.Columns {
+		if col == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withinSlack widens YOUNGER and OLDER searches to allow for clock drift
+// between the plugin and the server. Postgres does the exact filtering.
+const withinSlack = 5 * time.Minute
+
+// searchSinceDate returns the SINCE date for messages received at or after ts.
+func searchSinceDate(ts time.Time, loc *time.Location) time.Time {
+	if loc == nil {
+		return ts.Add(-24 * time.Hour)
+	}
+	t := ts.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// searchBeforeDate returns the BEFORE date for messages received at or before
+// ts, or strictly before ts if exclusive is set.
+func searchBeforeDate(ts time.Time, exclusive bool, loc *time.Location) time.Time {
+	if loc == nil {
+		return ts.Add(24 * time.Hour)
+	}
+	day := searchSinceDate(ts, loc)
+	if exclusive && day.Equal(ts) {
+		return day
+	}
+	return day.AddDate(0, 0, 1)
 }
 
 func tableIMAPParsedMessage(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
@@ -269,34 +766,180 @@ func tableIMAPParsedMessage(ctx context.Context, d *plugin.QueryData, h *plugin.
 	// Convenience
 	msg := mw.Message
 
-	r := msg.GetBody(&imap.BodySectionName{})
+	strict, err := strictParsing(d)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse message body, falling back to the IMAP ENVELOPE if it can't be
+	var r io.Reader
+	if mw.Body != nil {
+		r = bytes.NewReader(mw.Body)
+	}
+	te := parseMessage(r, strict)
+	if te.ParseStatus == parseFailed {
+		plugin.Logger(ctx).Warn("imap_message.tableIMAPParsedMessage", "parse_error", te.ParseError, "mailbox", mw.Mailbox, "uid", msg.Uid)
+		te.fromIMAPEnvelope(msg.Envelope)
+	}
+	// Like SORT DATE, fall back to the INTERNALDATE if there's no valid Date
+	// header, so the server's order agrees with the column
+	if te.Timestamp.IsZero() {
+		te.Timestamp = msg.InternalDate
+	}
+	te.Mailbox = mw.Mailbox
+
+	return te, nil
+}
+
+// tableIMAPMessageAuthResults returns the verdicts of the receiving server's
+// Authentication-Results header.
+func tableIMAPMessageAuthResults(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+	mw := h.Item.(msgWrapper)
+	return summarizeAuthResults(d, authResults(readHeaderFields(mw.header()))), nil
+}
 
-	// Parse message body
-	env, err := enmime.ReadEnvelope(r)
+// tableIMAPMessageMailingList parses the mailing list fields of the message.
+func tableIMAPMessageMailingList(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+	mw := h.Item.(msgWrapper)
+	return parseMailingListHeaders(readHeaderFields(mw.header())), nil
+}
+
+// tableIMAPMessageDispositionNotificationTo parses the addresses a read
+// receipt is requested to be sent to.
+func tableIMAPMessageDispositionNotificationTo(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+	mw := h.Item.(msgWrapper)
+	dnt := headerValue(readHeaderFields(mw.header()), "Disposition-Notification-To")
+	if dnt == "" {
+		return nil, nil
+	}
+	list, err := mail.ParseAddressList(dnt)
 	if err != nil {
-		plugin.Logger(ctx).Error("imap_message.tableIMAPParsedMessage", "CANNOT READ ENVELOPE", msg.Envelope.Subject)
 		return nil, nil
 	}
+	return list, nil
+}
 
-	te := wrapper{
-		Mailbox:   mw.Mailbox,
-		Envelope:  env,
-		From:      env.GetHeader("From"),
-		InReplyTo: env.GetHeaderValues("In-Reply-To"),
+// tableIMAPMessageSignatures verifies the DKIM signatures and ARC chain of
+// the message.
+func tableIMAPMessageSignatures(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+	mw := h.Item.(msgWrapper)
+	if mw.Body == nil {
+		return messageSignatures{}, nil
+	}
+	resolver, err := newDKIMKeyResolver(d)
+	if err != nil {
+		return nil, err
+	}
+	at := mw.Message.InternalDate
+	if at.IsZero() {
+		at = time.Now()
+	}
+	result := verifySignatures(ctx, resolver, mw.Body, at)
+	if len(result.Errors) > 0 {
+		plugin.Logger(ctx).Debug("imap_message.tableIMAPMessageSignatures", "errors", result.Errors, "mailbox", mw.Mailbox, "uid", mw.Message.Uid)
+	}
+	return result, nil
+}
+
+// tableIMAPMessageSecureMail checks whether the message is signed or
+// encrypted with S/MIME or PGP, and verifies its signature.
+func tableIMAPMessageSecureMail(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+	mw := h.Item.(msgWrapper)
+	if mw.Body == nil {
+		return secureMail{SignatureType: signatureTypeNone}, nil
+	}
+	trust, err := newSecureMailTrust(d)
+	if err != nil {
+		return nil, err
+	}
+	at := mw.Message.InternalDate
+	if at.IsZero() {
+		at = time.Now()
 	}
+	result := checkSecureMail(trust, mw.Body, at)
+	if len(result.Errors) > 0 {
+		plugin.Logger(ctx).Debug("imap_message.tableIMAPMessageSecureMail", "errors", result.Errors, "mailbox", mw.Mailbox, "uid", mw.Message.Uid)
+	}
+	return result, nil
+}
+
+// defaultRawMessageMaxSizeMB limits the size of raw_message unless
+// raw_message_max_size_mb is configured.
+const defaultRawMessageMaxSizeMB = 10
+
+type rawMessage struct {
+	Headers   *string
+	Message   *string
+	Truncated bool
+}
+
+func tableIMAPRawMessage(ctx context.Context, d *plugin.QueryData, h *plugin.HydrateData) (interface{}, error) {
+	mw := h.Item.(msgWrapper)
 
-	// Sometimes the subject has invalid UTF-8
-	subject := env.GetHeader("Subject")
-	if utf8.ValidString(subject) {
-		te.Subject = subject
+	maxSize := defaultRawMessageMaxSizeMB
+	if imapConfig := GetConfig(d.Connection); imapConfig.RawMessageMaxSizeMB != nil {
+		maxSize = *imapConfig.RawMessageMaxSizeMB
 	}
 
-	// Even the messageID is not always valid UTF-8!
-	messageID := env.GetHeader("Message-Id")
-	if utf8.ValidString(messageID) {
-		te.MessageID = messageID
+	header := mw.header()
+	var raw rawMessage
+	if header != nil {
+		headers := strings.ToValidUTF8(string(header), "\uFFFD")
+		raw.Headers = &headers
 	}
 
+	if mw.Body != nil {
+		body := mw.Body
+		if limit := maxSize * 1024 * 1024; len(body) > limit {
+			body = body[:limit]
+			raw.Truncated = true
+		}
+		encoded := base64.StdEncoding.EncodeToString(body)
+		raw.Message = &encoded
+	}
+	return raw, nil
+}
+
+// parseMessage parses a message with enmime into the columns shared by the
+// message tables. Unless strict, a message enmime rejects is parsed again
+// without its malformed parts.
+func parseMessage(r io.Reader, strict bool) wrapper {
+	if r == nil {
+		return wrapper{ParseStatus: parseFailed, ParseError: "message body was not fetched"}
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return wrapper{ParseStatus: parseFailed, ParseError: err.Error()}
+	}
+
+	status := parseOK
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil && !strict {
+		if env, _ = recoverEnvelope(raw); env != nil {
+			status = parseRecovered
+		}
+	}
+	if env == nil {
+		return wrapper{ParseStatus: parseFailed, ParseError: err.Error()}
+	}
+
+	te := wrapper{
+		Envelope:    env,
+		From:        env.GetHeader("From"),
+		InReplyTo:   env.GetHeaderValues("In-Reply-To"),
+		ParseStatus: status,
+	}
+	if err != nil {
+		te.ParseError = err.Error()
+	}
+
+	// Legacy mail often has text that isn't valid UTF-8, e.g. raw 8-bit
+	// headers or a wrongly declared charset. Invalid text causes the gRPC layer
+	// to fail, so decode it from the message's charset instead.
+	td := newTextDecoder(env)
+	te.Subject = td.decode("subject", env.GetHeader("Subject"))
+	te.MessageID = td.decode("message_id", env.GetHeader("Message-Id"))
+
 	from, err := env.AddressList("From")
 	if err == nil {
 		te.FromAddresses = from
@@ -321,16 +964,12 @@ func tableIMAPParsedMessage(ctx context.Context, d *plugin.QueryData, h *plugin.
 		}
 	}
 
-	// It's common for emails to have non-UTF strings. They cause the gRPC layer
-	// to fail, so filter that invalid data out here.
-	if utf8.ValidString(env.Text) {
-		te.BodyText = env.Text
-	}
-	if utf8.ValidString(env.HTML) {
-		te.BodyHTML = env.HTML
-	}
+	te.BodyText = td.decode("body_text", env.Text)
+	te.BodyHTML = td.decode("body_html", env.HTML)
+	te.OriginalCharset = td.charset
+	te.DecodingErrors = td.errors
 
-	return te, nil
+	return te
 }
 
 type attachmentWithoutData struct {
@@ -383,3 +1022,90 @@ func getAttachmentsWithoutData(_ context.Context, d *transform.TransformData) (i
 	}
 	return result, nil
 }
+
+// isAtom returns true if s can be sent as an IMAP atom (RFC 3501), i.e. it is
+// not empty and has no atom-specials or non-ASCII characters.
+func isAtom(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if b <= ' ' || b >= 0x7f || strings.IndexByte(`(){%*"\]`, b) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// addStringSearch adds a substring search of the header.
+func addStringSearch(criteria *imap.SearchCriteria, header string, value string) {
+	if value == "" {
+		return
+	}
+	criteria.Header.Add(header, value)
+}
+
+// likeLiterals returns the literal runs of a LIKE pattern, i.e. the text
+// between the % and _ wildcards. Every match must contain each of them.
+func likeLiterals(pattern string) []string {
+	var literals []string
+	var current strings.Builder
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%' || r == '_':
+			if current.Len() > 0 {
+				literals = append(literals, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		literals = append(literals, current.String())
+	}
+	return literals
+}
+
+// orCriteria combines criteria into a chain of ORs, which match if any one of
+// them matches.
+func orCriteria(criteria []*imap.SearchCriteria) *imap.SearchCriteria {
+	if len(criteria) == 1 {
+		return criteria[0]
+	}
+	return &imap.SearchCriteria{Or: [][2]*imap.SearchCriteria{{criteria[0], orCriteria(criteria[1:])}}}
+}
+
+func hasFlag(_ context.Context, d *transform.TransformData) (interface{}, error) {
+	if d.Value == nil {
+		return false, nil
+	}
+	flag := d.Param.(string)
+	for _, f := range d.Value.([]string) {
+		if strings.EqualFold(f, flag) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func getKeywords(_ context.Context, d *transform.TransformData) (interface{}, error) {
+	keywords := []string{}
+	if d.Value == nil {
+		return keywords, nil
+	}
+	for _, f := range d.Value.([]string) {
+		// System flags start with a backslash, everything else is a keyword
+		if !strings.HasPrefix(f, "\\") {
+			keywords = append(keywords, f)
+		}
+	}
+	return keywords, nil
+}
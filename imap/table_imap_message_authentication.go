@@ -0,0 +1,91 @@
+package imap
+
+import (
+	"context"
+	"time"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin/transform"
+)
+
+func tableIMAPMessageAuthentication(ctx context.Context) *plugin.Table {
+	return &plugin.Table{
+		Name:        "imap_message_authentication",
+		Description: "Method results of the Authentication-Results and ARC-Authentication-Results headers of messages in IMAP.",
+		List: &plugin.ListConfig{
+			Hydrate: tableIMAPMessageAuthenticationList,
+			KeyColumns: []*plugin.KeyColumn{
+				{Name: "mailbox", Require: plugin.Optional},
+				{Name: "uid", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+				{Name: "received_at", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+			},
+		},
+		Columns: commonColumns([]*plugin.Column{
+			// Top columns
+			{Name: "mailbox", Type: proto.ColumnType_STRING, Description: "Mailbox holding the message."},
+			{Name: "uid", Type: proto.ColumnType_INT, Transform: transform.FromField("UID"), Description: "Unique identifier of the message in the mailbox."},
+			{Name: "authserv_id", Type: proto.ColumnType_STRING, Transform: transform.FromField("AuthservID"), Description: "Identifier of the server that added the header, e.g. mx.google.com."},
+			{Name: "method", Type: proto.ColumnType_STRING, Description: "Authentication method, e.g. spf, dkim, dmarc or arc."},
+			{Name: "result", Type: proto.ColumnType_STRING, Description: "Result of the method, e.g. pass, fail, softfail or none."},
+			{Name: "reason", Type: proto.ColumnType_STRING, Transform: transform.FromField("Reason").Transform(transform.NullIfZeroValue), Description: "Reason given for the result."},
+			// Other columns
+			{Name: "arc_instance", Type: proto.ColumnType_INT, Transform: transform.FromField("Instance"), Description: "Instance (i=) of an ARC-Authentication-Results header, from 1 for the first server in the chain."},
+			{Name: "header", Type: proto.ColumnType_STRING, Description: "Header holding the result: Authentication-Results or ARC-Authentication-Results."},
+			{Name: "header_d", Type: proto.ColumnType_STRING, Transform: transform.FromField("Properties").TransformP(getMapValue, "header.d").Transform(transform.NullIfZeroValue), Description: "Signing domain (header.d) of a DKIM result."},
+			{Name: "header_from", Type: proto.ColumnType_STRING, Transform: transform.FromField("Properties").TransformP(getMapValue, "header.from").Transform(transform.NullIfZeroValue), Description: "Domain of the From header (header.from) checked by DMARC."},
+			{Name: "header_index", Type: proto.ColumnType_INT, Transform: transform.FromField("Index"), Description: "Position of the header among the authentication headers of the message, from 0 for the topmost, i.e. the most recently added."},
+			{Name: "message_id", Type: proto.ColumnType_STRING, Transform: transform.FromField("MessageID").Transform(transform.NullIfZeroValue), Description: "Message-ID of the message."},
+			{Name: "properties", Type: proto.ColumnType_JSON, Description: "All properties of the result, keyed by type and name, e.g. {\"smtp.mailfrom\": \"example.com\"}."},
+			{Name: "received_at", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("ReceivedAt").Transform(transform.NullIfZeroValue), Description: "Time when the message was received by the server (INTERNALDATE)."},
+			{Name: "smtp_mailfrom", Type: proto.ColumnType_STRING, Transform: transform.FromField("Properties").TransformP(getMapValue, "smtp.mailfrom").Transform(transform.NullIfZeroValue), Description: "Envelope sender (smtp.mailfrom) checked by SPF."},
+		}),
+	}
+}
+
+type messageAuthenticationRow struct {
+	Mailbox    string
+	UID        uint32
+	ReceivedAt time.Time
+	MessageID  string
+	Header     string
+	Index      int
+	Instance   *int
+	AuthservID string
+	Method     string
+	Result     string
+	Reason     string
+	Properties map[string]string
+}
+
+func tableIMAPMessageAuthenticationList(ctx context.Context, d *plugin.QueryData, _ *plugin.HydrateData) (interface{}, error) {
+	// Only the header section is needed
+	return nil, listMessages(ctx, d, listOptions{Header: true}, func(mw msgWrapper) {
+		fields := readHeaderFields(mw.header())
+		for _, r := range authResults(fields) {
+			d.StreamListItem(ctx, messageAuthenticationRow{
+				Mailbox:    mw.Mailbox,
+				UID:        mw.Message.Uid,
+				ReceivedAt: mw.Message.InternalDate,
+				MessageID:  headerValue(fields, "Message-Id"),
+				Header:     r.Header,
+				Index:      r.Index,
+				Instance:   r.Instance,
+				AuthservID: r.AuthservID,
+				Method:     r.Method,
+				Result:     r.Result,
+				Reason:     r.Reason,
+				Properties: r.Properties,
+			})
+		}
+	})
+}
+
+// getMapValue returns the value of the key given as the transform param.
+func getMapValue(_ context.Context, d *transform.TransformData) (interface{}, error) {
+	m, ok := d.Value.(map[string]string)
+	if !ok {
+		return nil, nil
+	}
+	return m[d.Param.(string)], nil
+}
@@ -0,0 +1,64 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin/transform"
+)
+
+func tableIMAPMessageLink(ctx context.Context) *plugin.Table {
+	return &plugin.Table{
+		Name:        "imap_message_link",
+		Description: "Links, images and forms in the bodies of messages in IMAP.",
+		List: &plugin.ListConfig{
+			Hydrate: tableIMAPMessageLinkList,
+			KeyColumns: []*plugin.KeyColumn{
+				{Name: "mailbox", Require: plugin.Optional},
+				{Name: "uid", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+				{Name: "received_at", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+			},
+		},
+		Columns: commonColumns([]*plugin.Column{
+			// Top columns
+			{Name: "mailbox", Type: proto.ColumnType_STRING, Description: "Mailbox holding the message."},
+			{Name: "uid", Type: proto.ColumnType_INT, Transform: transform.FromField("UID"), Description: "Unique identifier of the message in the mailbox."},
+			{Name: "href", Type: proto.ColumnType_STRING, Description: "URL of the link, image or form."},
+			{Name: "text", Type: proto.ColumnType_STRING, Transform: transform.FromField("Text").Transform(transform.NullIfZeroValue), Description: "Visible text of an anchor, or the alt text of an image."},
+			{Name: "domain", Type: proto.ColumnType_STRING, Transform: transform.FromField("Domain").Transform(transform.NullIfZeroValue), Description: "Host name of the URL, in lower case."},
+			{Name: "scheme", Type: proto.ColumnType_STRING, Transform: transform.FromField("Scheme").Transform(transform.NullIfZeroValue), Description: "Scheme of the URL, e.g. https, mailto or cid."},
+			{Name: "source", Type: proto.ColumnType_STRING, Description: "Where the URL was found: anchor, image or form in the HTML body, or text in the text body."},
+			{Name: "text_domain_mismatch", Type: proto.ColumnType_BOOL, Transform: transform.FromField("TextDomainMismatch"), Description: "True if the text of an anchor shows a domain other than the one it links to, e.g. a link to evil.example shown as www.bank.example."},
+			{Name: "tracking_pixel", Type: proto.ColumnType_BOOL, Transform: transform.FromField("TrackingPixel"), Description: "True if the URL is a remote image of at most 1x1 pixels, or hidden, as used to track when a message is opened."},
+			// Other columns
+			{Name: "message_id", Type: proto.ColumnType_STRING, Transform: transform.FromField("MessageID").Transform(transform.NullIfZeroValue), Description: "Message-ID of the message."},
+			{Name: "received_at", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("ReceivedAt").Transform(transform.NullIfZeroValue), Description: "Time when the message was received by the server (INTERNALDATE)."},
+		}),
+	}
+}
+
+type messageLinkRow struct {
+	Mailbox    string
+	UID        uint32
+	ReceivedAt time.Time
+	MessageID  string
+	messageLink
+}
+
+func tableIMAPMessageLinkList(ctx context.Context, d *plugin.QueryData, _ *plugin.HydrateData) (interface{}, error) {
+	return nil, listMessages(ctx, d, listOptions{Body: true}, func(mw msgWrapper) {
+		te := parseMessage(bytes.NewReader(mw.Body), false)
+		for _, l := range messageLinks(te.BodyText, te.BodyHTML) {
+			d.StreamListItem(ctx, messageLinkRow{
+				Mailbox:     mw.Mailbox,
+				UID:         mw.Message.Uid,
+				ReceivedAt:  mw.Message.InternalDate,
+				MessageID:   te.MessageID,
+				messageLink: l,
+			})
+		}
+	})
+}
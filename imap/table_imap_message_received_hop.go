@@ -0,0 +1,79 @@
+package imap
+
+import (
+	"context"
+	"time"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin/transform"
+)
+
+func tableIMAPMessageReceivedHop(ctx context.Context) *plugin.Table {
+	return &plugin.Table{
+		Name:        "imap_message_received_hop",
+		Description: "Servers that messages in IMAP passed through, from their Received headers.",
+		List: &plugin.ListConfig{
+			Hydrate: tableIMAPMessageReceivedHopList,
+			KeyColumns: []*plugin.KeyColumn{
+				{Name: "mailbox", Require: plugin.Optional},
+				{Name: "uid", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+				{Name: "received_at", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+			},
+		},
+		Columns: commonColumns([]*plugin.Column{
+			// Top columns
+			{Name: "mailbox", Type: proto.ColumnType_STRING, Description: "Mailbox holding the message."},
+			{Name: "uid", Type: proto.ColumnType_INT, Transform: transform.FromField("UID"), Description: "Unique identifier of the message in the mailbox."},
+			{Name: "hop", Type: proto.ColumnType_INT, Description: "Position of the hop in the delivery path, from 1 for the first server, i.e. the bottom Received header."},
+			{Name: "from_host", Type: proto.ColumnType_STRING, Transform: transform.FromField("FromHost").Transform(transform.NullIfZeroValue), Description: "Host name the sending server gave, or its reverse DNS name."},
+			{Name: "from_ip", Type: proto.ColumnType_IPADDR, Transform: transform.FromField("FromIP").Transform(transform.NullIfZeroValue), Description: "IP address of the sending server."},
+			{Name: "by_host", Type: proto.ColumnType_STRING, Transform: transform.FromField("ByHost").Transform(transform.NullIfZeroValue), Description: "Host name of the receiving server that added the header."},
+			{Name: "timestamp", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("Timestamp").Transform(transform.NullIfZeroValue), Description: "Time the receiving server received the message."},
+			{Name: "delay_seconds", Type: proto.ColumnType_DOUBLE, Transform: transform.FromField("DelaySeconds"), Description: "Seconds since the previous hop received the message. Null for the first hop, or if either timestamp is missing. Can be negative if the servers' clocks differ."},
+			// Other columns
+			{Name: "envelope_for", Type: proto.ColumnType_STRING, Transform: transform.FromField("EnvelopeFor").Transform(transform.NullIfZeroValue), Description: "Envelope recipient the message was received for."},
+			{Name: "id", Type: proto.ColumnType_STRING, Transform: transform.FromField("ID").Transform(transform.NullIfZeroValue), Description: "Queue or message identifier assigned by the receiving server."},
+			{Name: "message_id", Type: proto.ColumnType_STRING, Transform: transform.FromField("MessageID").Transform(transform.NullIfZeroValue), Description: "Message-ID of the message."},
+			{Name: "protocol", Type: proto.ColumnType_STRING, Transform: transform.FromField("Protocol").Transform(transform.NullIfZeroValue), Description: "Protocol the message was received with, e.g. SMTP, ESMTPS or LMTP."},
+			{Name: "received", Type: proto.ColumnType_STRING, Description: "Value of the Received header."},
+			{Name: "received_at", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("ReceivedAt").Transform(transform.NullIfZeroValue), Description: "Time when the message was received by the IMAP server (INTERNALDATE)."},
+			{Name: "tls_cipher", Type: proto.ColumnType_STRING, Transform: transform.FromField("TLSCipher").Transform(transform.NullIfZeroValue), Description: "TLS cipher of the connection, if recorded."},
+			{Name: "tls_version", Type: proto.ColumnType_STRING, Transform: transform.FromField("TLSVersion").Transform(transform.NullIfZeroValue), Description: "TLS version of the connection, if recorded, e.g. TLSv1.3."},
+		}),
+	}
+}
+
+type receivedHopRow struct {
+	Mailbox    string
+	UID        uint32
+	ReceivedAt time.Time
+	MessageID  string
+	Hop        int
+	receivedHop
+	DelaySeconds *float64
+}
+
+func tableIMAPMessageReceivedHopList(ctx context.Context, d *plugin.QueryData, _ *plugin.HydrateData) (interface{}, error) {
+	// Only the header section is needed
+	return nil, listMessages(ctx, d, listOptions{Header: true}, func(mw msgWrapper) {
+		fields := readHeaderFields(mw.header())
+		var previous time.Time
+		for i, hop := range receivedHops(fields) {
+			row := receivedHopRow{
+				Mailbox:     mw.Mailbox,
+				UID:         mw.Message.Uid,
+				ReceivedAt:  mw.Message.InternalDate,
+				MessageID:   headerValue(fields, "Message-Id"),
+				Hop:         i + 1,
+				receivedHop: hop,
+			}
+			if !previous.IsZero() && !hop.Timestamp.IsZero() {
+				delay := hop.Timestamp.Sub(previous).Seconds()
+				row.DelaySeconds = &delay
+			}
+			previous = hop.Timestamp
+			d.StreamListItem(ctx, row)
+		}
+	})
+}
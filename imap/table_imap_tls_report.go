@@ -0,0 +1,103 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/turbot/steampipe-plugin-sdk/v5/grpc/proto"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin"
+	"github.com/turbot/steampipe-plugin-sdk/v5/plugin/transform"
+)
+
+func tableIMAPTLSReport(ctx context.Context) *plugin.Table {
+	return &plugin.Table{
+		Name:        "imap_tls_report",
+		Description: "Policies and failures of the SMTP TLS reports (TLS-RPT) attached to messages in IMAP.",
+		List: &plugin.ListConfig{
+			Hydrate: tableIMAPTLSReportList,
+			KeyColumns: []*plugin.KeyColumn{
+				{Name: "mailbox", Require: plugin.Optional},
+				{Name: "uid", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+				{Name: "received_at", Operators: []string{">", ">=", "=", "<", "<="}, Require: plugin.Optional},
+			},
+		},
+		Columns: commonColumns([]*plugin.Column{
+			// Top columns
+			{Name: "organization_name", Type: proto.ColumnType_STRING, Transform: transform.FromField("Report.OrganizationName"), Description: "Organization that sent the report, e.g. Google Inc."},
+			{Name: "report_id", Type: proto.ColumnType_STRING, Transform: transform.FromField("Report.ReportID"), Description: "Identifier of the report."},
+			{Name: "date_begin", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("Report.DateRange.Start").Transform(transform.NullIfZeroValue), Description: "Start of the period the report covers."},
+			{Name: "date_end", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("Report.DateRange.End").Transform(transform.NullIfZeroValue), Description: "End of the period the report covers."},
+			{Name: "policy_type", Type: proto.ColumnType_STRING, Transform: transform.FromField("Policy.Policy.Type"), Description: "Type of the policy applied: sts for MTA-STS, tlsa for DANE, or no-policy-found."},
+			{Name: "policy_domain", Type: proto.ColumnType_STRING, Transform: transform.FromField("Policy.Policy.Domain"), Description: "Domain the policy is for."},
+			{Name: "successful_session_count", Type: proto.ColumnType_INT, Transform: transform.FromField("Policy.Summary.TotalSuccessfulSessionCount"), Description: "Number of TLS sessions to the policy domain that succeeded."},
+			{Name: "failure_session_count", Type: proto.ColumnType_INT, Transform: transform.FromField("Policy.Summary.TotalFailureSessionCount"), Description: "Number of TLS sessions to the policy domain that failed."},
+			{Name: "result_type", Type: proto.ColumnType_STRING, Transform: transform.FromField("Failure.ResultType"), Description: "Type of the failure, e.g. certificate-expired or starttls-not-supported. Null for policies without failures."},
+			{Name: "sending_mta_ip", Type: proto.ColumnType_IPADDR, Transform: transform.FromField("Failure.SendingMTAIP").Transform(transform.NullIfZeroValue), Description: "IP address of the sending server that had the failures."},
+			{Name: "receiving_mx_hostname", Type: proto.ColumnType_STRING, Transform: transform.FromField("Failure.ReceivingMXHostname").Transform(transform.NullIfZeroValue), Description: "Host name of the receiving MX the failures were with."},
+			{Name: "failed_session_count", Type: proto.ColumnType_INT, Transform: transform.FromField("Failure.FailedSessionCount"), Description: "Number of sessions with this failure."},
+			// Other columns
+			{Name: "additional_information", Type: proto.ColumnType_STRING, Transform: transform.FromField("Failure.AdditionalInformation").Transform(transform.NullIfZeroValue), Description: "URI of further information about the failure."},
+			{Name: "contact_info", Type: proto.ColumnType_STRING, Transform: transform.FromField("Report.ContactInfo").Transform(transform.NullIfZeroValue), Description: "Contact details of the reporting organization."},
+			{Name: "failure_reason_code", Type: proto.ColumnType_STRING, Transform: transform.FromField("Failure.FailureReasonCode").Transform(transform.NullIfZeroValue), Description: "Reason code of the failure, specific to the reporter."},
+			{Name: "file_name", Type: proto.ColumnType_STRING, Description: "Name of the report file, after unpacking any gzip or zip attachment."},
+			{Name: "mailbox", Type: proto.ColumnType_STRING, Description: "Mailbox holding the report message."},
+			{Name: "mx_host", Type: proto.ColumnType_JSON, Transform: transform.FromField("Policy.Policy.MXHost"), Description: "MX host patterns of an MTA-STS policy."},
+			{Name: "policy_string", Type: proto.ColumnType_JSON, Transform: transform.FromField("Policy.Policy.String"), Description: "Lines of the policy, i.e. the MTA-STS policy file or the TLSA records."},
+			{Name: "received_at", Type: proto.ColumnType_TIMESTAMP, Transform: transform.FromField("ReceivedAt").Transform(transform.NullIfZeroValue), Description: "Time when the report message was received by the server (INTERNALDATE)."},
+			{Name: "receiving_ip", Type: proto.ColumnType_IPADDR, Transform: transform.FromField("Failure.ReceivingIP").Transform(transform.NullIfZeroValue), Description: "IP address of the receiving MX."},
+			{Name: "receiving_mx_helo", Type: proto.ColumnType_STRING, Transform: transform.FromField("Failure.ReceivingMXHelo").Transform(transform.NullIfZeroValue), Description: "Host name the receiving MX gave in its greeting."},
+			{Name: "uid", Type: proto.ColumnType_INT, Transform: transform.FromField("UID"), Description: "Unique identifier of the report message in the mailbox."},
+		}),
+	}
+}
+
+type tlsReportRow struct {
+	Mailbox    string
+	UID        uint32
+	ReceivedAt time.Time
+	FileName   string
+	Report     *tlsReport
+	Policy     tlsReportPolicy
+	// Failure is nil for a policy without failures
+	Failure *tlsReportFailure
+}
+
+func tableIMAPTLSReportList(ctx context.Context, d *plugin.QueryData, _ *plugin.HydrateData) (interface{}, error) {
+	opts := listOptions{Body: true}
+	if imapConfig := GetConfig(d.Connection); imapConfig.TLSReportMailbox != nil {
+		opts.Mailbox = *imapConfig.TLSReportMailbox
+	}
+	return nil, listMessages(ctx, d, opts, func(mw msgWrapper) {
+		te := parseMessage(bytes.NewReader(mw.Body), false)
+		files, errs := reportFiles(te.Envelope, tlsReportFormat)
+		for _, err := range errs {
+			plugin.Logger(ctx).Warn("imap_tls_report.tableIMAPTLSReportList", "report_error", err, "mailbox", mw.Mailbox, "uid", mw.Message.Uid)
+		}
+		for _, f := range files {
+			report, err := parseTLSReport(f.Data)
+			if err != nil {
+				plugin.Logger(ctx).Warn("imap_tls_report.tableIMAPTLSReportList", "parse_error", err, "mailbox", mw.Mailbox, "uid", mw.Message.Uid, "file", f.Name)
+				continue
+			}
+			for _, policy := range report.Policies {
+				row := tlsReportRow{
+					Mailbox:    mw.Mailbox,
+					UID:        mw.Message.Uid,
+					ReceivedAt: mw.Message.InternalDate,
+					FileName:   f.Name,
+					Report:     report,
+					Policy:     policy,
+				}
+				if len(policy.FailureDetails) == 0 {
+					d.StreamListItem(ctx, row)
+					continue
+				}
+				for i := range policy.FailureDetails {
+					row.Failure = &policy.FailureDetails[i]
+					d.StreamListItem(ctx, row)
+				}
+			}
+		}
+	})
+}
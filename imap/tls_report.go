@@ -0,0 +1,58 @@
+package imap
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// tlsReportFormat is the attachments of SMTP TLS reports, which are usually
+// gzipped as application/tlsrpt+gzip.
+var tlsReportFormat = reportFormat{
+	Extensions:   []string{".json"},
+	ContentTypes: []string{"application/tlsrpt+json", "application/json"},
+}
+
+// tlsReport is an SMTP TLS report, see RFC 8460 section 4.
+type tlsReport struct {
+	OrganizationName string `json:"organization-name"`
+	DateRange        struct {
+		Start time.Time `json:"start-datetime"`
+		End   time.Time `json:"end-datetime"`
+	} `json:"date-range"`
+	ContactInfo string            `json:"contact-info"`
+	ReportID    string            `json:"report-id"`
+	Policies    []tlsReportPolicy `json:"policies"`
+}
+
+type tlsReportPolicy struct {
+	Policy struct {
+		Type   string   `json:"policy-type"`
+		String []string `json:"policy-string"`
+		Domain string   `json:"policy-domain"`
+		MXHost []string `json:"mx-host"`
+	} `json:"policy"`
+	Summary struct {
+		TotalSuccessfulSessionCount int64 `json:"total-successful-session-count"`
+		TotalFailureSessionCount    int64 `json:"total-failure-session-count"`
+	} `json:"summary"`
+	FailureDetails []tlsReportFailure `json:"failure-details"`
+}
+
+type tlsReportFailure struct {
+	ResultType            string `json:"result-type"`
+	SendingMTAIP          string `json:"sending-mta-ip"`
+	ReceivingMXHostname   string `json:"receiving-mx-hostname"`
+	ReceivingMXHelo       string `json:"receiving-mx-helo"`
+	ReceivingIP           string `json:"receiving-ip"`
+	FailedSessionCount    int64  `json:"failed-session-count"`
+	AdditionalInformation string `json:"additional-information"`
+	FailureReasonCode     string `json:"failure-reason-code"`
+}
+
+func parseTLSReport(data []byte) (*tlsReport, error) {
+	var report tlsReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
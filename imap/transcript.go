@@ -0,0 +1,233 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A transcript records IMAP conversations, so problems with a particular
+// server can be reproduced with the replay backend. Each line is prefixed
+// with the connection it belongs to and who sent it, e.g.
+//
+//	18f3a2c41-1 C: a1b2 UID FETCH 1:* (UID FLAGS)
+//	18f3a2c41-1 S: * 1 FETCH (UID 7 FLAGS (\Seen))
+//
+// Lines are recorded byte for byte, including literals, apart from the
+// arguments of LOGIN and AUTHENTICATE, which are redacted.
+
+const transcriptRedacted = "[redacted]"
+
+var (
+	transcriptFiles       sync.Map // path -> *transcriptFile
+	transcriptConnections atomic.Uint64
+	// transcriptProcess distinguishes the connections of plugin processes
+	// appending to the same file
+	transcriptProcess = strconv.FormatInt(time.Now().UnixNano(), 36)
+)
+
+// transcriptFile serializes writes to a transcript file, which is shared by
+// every connection of the process.
+type transcriptFile struct {
+	mu   sync.Mutex
+	file *os.File
+	err  error
+}
+
+func openTranscript(path string) (*transcriptFile, error) {
+	v, _ := transcriptFiles.LoadOrStore(path, &transcriptFile{})
+	t := v.(*transcriptFile)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file == nil && t.err == nil {
+		// The transcript holds mail, so is only readable by the user
+		t.file, t.err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	}
+	if t.err != nil {
+		return nil, fmt.Errorf("cannot open transcript_path: %w", t.err)
+	}
+	return t, nil
+}
+
+func (t *transcriptFile) write(line []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, _ = t.file.Write(line)
+}
+
+// transcriptDialer is a client.Dialer that records every connection. TLS is
+// negotiated here, so the transcript holds the decrypted conversation.
+type transcriptDialer struct {
+	transcript *transcriptFile
+	tlsConfig  *tls.Config
+}
+
+func newTranscriptDialer(path string, tlsEnabled, insecureSkipVerify bool, host string) (*transcriptDialer, error) {
+	path, err := expandHome(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := openTranscript(path)
+	if err != nil {
+		return nil, err
+	}
+	td := &transcriptDialer{transcript: t}
+	if tlsEnabled {
+		td.tlsConfig = &tls.Config{ServerName: host, InsecureSkipVerify: insecureSkipVerify}
+	}
+	return td, nil
+}
+
+func (td *transcriptDialer) Dial(network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if td.tlsConfig != nil {
+		conn, err = tls.Dial(network, addr, td.tlsConfig)
+	} else {
+		conn, err = net.Dial(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("%s-%d", transcriptProcess, transcriptConnections.Add(1))
+	return &transcriptConn{Conn: conn, transcript: td.transcript, id: id}, nil
+}
+
+// transcriptConn records the lines read and written on a connection.
+type transcriptConn struct {
+	net.Conn
+	transcript *transcriptFile
+	id         string
+
+	mu             sync.Mutex
+	client, server []byte
+	// redactTag is the tag of a LOGIN or AUTHENTICATE command, whose client
+	// lines are not recorded until the server completes it
+	redactTag string
+}
+
+func (c *transcriptConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.record(false, b[:n])
+	return n, err
+}
+
+func (c *transcriptConn) Write(b []byte) (int, error) {
+	c.record(true, b)
+	return c.Conn.Write(b)
+}
+
+func (c *transcriptConn) Close() error {
+	c.mu.Lock()
+	// A line is only incomplete if the connection was cut off
+	if len(c.client) > 0 {
+		c.recordLine(true, append(c.client, '\n'))
+	}
+	if len(c.server) > 0 {
+		c.recordLine(false, append(c.server, '\n'))
+	}
+	c.client, c.server = nil, nil
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// record buffers the data, and records each complete line.
+func (c *transcriptConn) record(fromClient bool, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	buf := &c.server
+	if fromClient {
+		buf = &c.client
+	}
+	*buf = append(*buf, data...)
+	for {
+		i := bytes.IndexByte(*buf, '\n')
+		if i < 0 {
+			return
+		}
+		line := make([]byte, i+1)
+		copy(line, *buf)
+		*buf = (*buf)[i+1:]
+		c.recordLine(fromClient, line)
+	}
+}
+
+func (c *transcriptConn) recordLine(fromClient bool, line []byte) {
+	prefix := c.id + " S: "
+	if fromClient {
+		prefix = c.id + " C: "
+		if c.redactTag != "" {
+			return
+		}
+		if fields := strings.SplitN(string(line), " ", 3); len(fields) >= 2 {
+			command := strings.ToUpper(strings.TrimRight(fields[1], "\r\n"))
+			if command == "LOGIN" || command == "AUTHENTICATE" {
+				c.redactTag = fields[0]
+				line = []byte(fields[0] + " " + command + " " + transcriptRedacted + "\r\n")
+			}
+		}
+	} else if c.redactTag != "" && bytes.HasPrefix(line, []byte(c.redactTag+" ")) {
+		c.redactTag = ""
+	}
+	c.transcript.write(append([]byte(prefix), line...))
+}
+
+// readTranscriptLine reads a line, including any literals it ends with, see
+// RFC 3501 section 4.3. onLiteral is called before reading a synchronizing
+// literal, which needs a continuation request from the server.
+func readTranscriptLine(r *bufio.Reader, onLiteral func() error) ([]byte, error) {
+	var result []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		result = append(result, line...)
+		if err != nil {
+			return result, err
+		}
+		n, synchronizing, ok := literalSize(line)
+		if !ok {
+			return result, nil
+		}
+		if synchronizing && onLiteral != nil {
+			if err := onLiteral(); err != nil {
+				return result, err
+			}
+		}
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(r, literal); err != nil {
+			return result, err
+		}
+		result = append(result, literal...)
+	}
+}
+
+// literalSize returns the size of the literal a line ends with, and whether
+// it is synchronizing, i.e. {n} rather than {n+}.
+func literalSize(line []byte) (int, bool, bool) {
+	s := strings.TrimRight(string(line), "\r\n")
+	if !strings.HasSuffix(s, "}") {
+		return 0, false, false
+	}
+	i := strings.LastIndexByte(s, '{')
+	if i < 0 {
+		return 0, false, false
+	}
+	size := s[i+1 : len(s)-1]
+	synchronizing := true
+	if strings.HasSuffix(size, "+") {
+		size, synchronizing = size[:len(size)-1], false
+	}
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 {
+		return 0, false, false
+	}
+	return n, synchronizing, true
+}
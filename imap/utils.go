@@ -6,7 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/emersion/go-imap/client"
 
@@ -15,13 +18,26 @@ import (
 
 func login(ctx context.Context, d *plugin.QueryData) (*client.Client, error) {
 
+	// Recorded transcripts are replayed without any network access
+	if backendName(GetConfig(d.Connection)) == backendReplay {
+		return connectReplay(ctx, d)
+	}
+
+	// Local backends are served in-process, without a host or password
+	be, err := newLocalBackend(d)
+	if err != nil {
+		return nil, err
+	}
+	if be != nil {
+		return connectLocal(ctx, d, be)
+	}
+
 	port := 993
 	tlsEnabled := true
 	insecureSkipVerify := false
 
 	// Check env var settings
-	host := os.Getenv("IMAP_HOST")
-	login := os.Getenv("IMAP_LOGIN")
+	host, login := hostAndLogin(d)
 	password := os.Getenv("IMAP_PASSWORD")
 
 	if portString, ok := os.LookupEnv("IMAP_PORT"); ok {
@@ -33,15 +49,9 @@ func login(ctx context.Context, d *plugin.QueryData) (*client.Client, error) {
 
 	// Prefer config settings
 	imapConfig := GetConfig(d.Connection)
-	if imapConfig.Host != nil {
-		host = *imapConfig.Host
-	}
 	if imapConfig.Port != nil {
 		port = *imapConfig.Port
 	}
-	if imapConfig.Login != nil {
-		login = *imapConfig.Login
-	}
 	if imapConfig.Password != nil {
 		password = *imapConfig.Password
 	}
@@ -71,8 +81,13 @@ func login(ctx context.Context, d *plugin.QueryData) (*client.Client, error) {
 	// Connect to server
 	hostPort := fmt.Sprintf("%s:%d", host, port)
 	var c *client.Client
-	var err error
-	if tlsEnabled {
+	if imapConfig.TranscriptPath != nil && *imapConfig.TranscriptPath != "" {
+		var dialer *transcriptDialer
+		if dialer, err = newTranscriptDialer(*imapConfig.TranscriptPath, tlsEnabled, insecureSkipVerify, host); err != nil {
+			return nil, err
+		}
+		c, err = client.DialWithDialer(dialer, hostPort)
+	} else if tlsEnabled {
 		c, err = client.DialTLS(hostPort, &tls.Config{InsecureSkipVerify: insecureSkipVerify})
 	} else {
 		c, err = client.Dial(hostPort)
@@ -91,6 +106,47 @@ func login(ctx context.Context, d *plugin.QueryData) (*client.Client, error) {
 	return c, nil
 }
 
+// hostAndLogin returns the host and login name, preferring config settings
+// over env vars.
+func hostAndLogin(d *plugin.QueryData) (string, string) {
+	host := os.Getenv("IMAP_HOST")
+	login := os.Getenv("IMAP_LOGIN")
+	imapConfig := GetConfig(d.Connection)
+	if imapConfig.Host != nil {
+		host = *imapConfig.Host
+	}
+	if imapConfig.Login != nil {
+		login = *imapConfig.Login
+	}
+	return host, login
+}
+
 func validatePort(port int) bool {
 	return port == 143 || port == 993 || (port >= 1024 && port <= 65535)
 }
+
+// searchLocation returns the time zone the server uses for the day
+// boundaries of SINCE and BEFORE searches, or nil if it is not configured.
+func searchLocation(d *plugin.QueryData) (*time.Location, error) {
+	imapConfig := GetConfig(d.Connection)
+	if imapConfig.SearchTimezone == nil || *imapConfig.SearchTimezone == "" {
+		return nil, nil
+	}
+	loc, err := time.LoadLocation(*imapConfig.SearchTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("search_timezone is not a valid time zone: %w", err)
+	}
+	return loc, nil
+}
+
+// expandHome expands a leading ~/ in a configured path to the home directory.
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, path[2:]), nil
+}